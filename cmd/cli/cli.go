@@ -1,15 +1,24 @@
 package cli
 
 import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/tiereum/trmnode/internal/blockStore"
+	"github.com/tiereum/trmnode/internal/network"
 	"github.com/tiereum/trmnode/internal/node"
+	"github.com/tiereum/trmnode/internal/rpc"
 	"github.com/tiereum/trmnode/internal/t_config"
 	"github.com/tiereum/trmnode/internal/t_error"
+	"github.com/tiereum/trmnode/internal/utxoSet"
 	"github.com/tiereum/trmnode/internal/wallet"
 )
 
@@ -30,8 +39,12 @@ func (cli *CommandLine) PrintUsage() {
 	fmt.Println("command [--arg_name [arg_value]] ...")
 
 	fmt.Println("\nrun | node")
+	fmt.Println("run starts the node in the foreground. wallet, blockchain and interactive talk to it over RPC.")
 	fmt.Printf("%-20s%-30s%s", "--numTx", "[num]", "Number of txs to include before mining current block. Default 10\n")
-	fmt.Printf("%-20s%-30s%s", "--port", "[port]", "Port to listen and send on. Default "+fmt.Sprint(t_config.RpcEndpointPort)+"\n")
+	fmt.Printf("%-20s%-30s%s", "--port", "[port]", "Port to listen and send on. Default "+fmt.Sprint(t_config.P2PPort)+"\n")
+	fmt.Printf("%-20s%-30s%s", "--rpcport", "[port]", "Port for JSON-RPC requests. Default "+fmt.Sprint(t_config.RpcPort)+"\n")
+	fmt.Printf("%-20s%-30s%s", "--host", "[host]", "Host to listen on. Default "+t_config.BindHost+"\n")
+	fmt.Printf("%-20s%-30s%s", "--peer", "[host:port]", "Peer to connect to, may be repeated\n")
 	fmt.Printf("%-20s%-30s%s", "--nodeAddr", "[address]", "Address for block rewards\n")
 
 	fmt.Println("\nnode")
@@ -45,7 +58,6 @@ func (cli *CommandLine) PrintUsage() {
 	fmt.Printf("%-20s%-30s%s", "--validateTx", "[tx_hash]", "Validates a transaction\n")
 	fmt.Printf("%-20s%-30s%s", "--addTxToMem", "[tx_hash]", "Adds tx to mempool. Validate first\n")
 	fmt.Printf("%-20s%-30s%s", "--addTxToBlk", "[tx_hash]", "Adds a validated transaction to block\n")
-	fmt.Printf("%-20s%-30s%s", "--addTxsToUtxos", "[tx_hash]", "Updates utxoset with txs from node's current block\n")
 
 	fmt.Println("\nwallet")
 	fmt.Printf("%-20s%-30s%s", "--name", "<name>", "Name of wallet to use, creates one if it doesnt exist\n")
@@ -53,10 +65,35 @@ func (cli *CommandLine) PrintUsage() {
 	fmt.Printf("%-20s%-30s%s", "--tx", "<address:value,...>", "Create a transaction. arg is hex encoded address:value,...\n")
 	fmt.Printf("%-20s%-30s%s", "--sendTx", "[tx_hash]", "Broadcast transaction. Arg is the txid.\n")
 
+	fmt.Println("\nban")
+	fmt.Printf("%-50s%s", "--list", "Print banned hosts\n")
+	fmt.Printf("%-20s%-30s%s", "--add", "<host> [seconds]", "Ban host for seconds, or until removed if omitted\n")
+	fmt.Printf("%-20s%-30s%s", "--remove", "<host>", "Lift the ban on host\n")
+
+	fmt.Println("\nblockstore, with the node stopped")
+	fmt.Printf("%-50s%s", "--repair", "Rebuild block file positions in the index and cut damaged file tails\n")
+	fmt.Printf("%-50s%s", "--compact", "Rewrite the block files without deleted blocks\n")
+
+	fmt.Println("\nutxoset")
+	fmt.Printf("%-50s%s", "--info", "Print the size, total value and hash of the utxo set\n")
+	fmt.Printf("%-20s%-30s%s", "--dump", "<file>", "Write the utxo set to a snapshot file\n")
+	fmt.Printf("%-20s%-30s%s", "--load", "<file>", "Replace the utxo set with a snapshot, with the node stopped\n")
+	fmt.Printf("%-50s%s", "--json", "Print the node's JSON result instead\n")
+
 	fmt.Println("\nblockchain")
 	fmt.Printf("%-50s%s", "--print", "Print the block header hashes of the main branch\n")
 	fmt.Printf("%-50s%s", "--utxo", "Print the utxo outpoints in the utxo set\n")
 	fmt.Printf("%-50s%s", "--mempool", "Print the tx hashes in the mempool\n")
+	fmt.Printf("%-50s%s", "--json", "Print the node's JSON result instead\n")
+
+	fmt.Println("\nblock | tx | address")
+	fmt.Printf("%-20s%-30s%s", "block", "<hash|height>", "Print a block\n")
+	fmt.Printf("%-20s%-30s%s", "tx", "<txid>", "Print a tx from the mempool or the chain\n")
+	fmt.Printf("%-20s%-30s%s", "address", "<address>", "Print the balance and utxos of an address\n")
+	fmt.Printf("%-50s%s", "--json", "Print the node's JSON result instead\n")
+
+	fmt.Println("\ninteractive")
+	fmt.Println("Reads `method [param ...]` lines and sends them to the running node. Params are JSON, or strings otherwise.")
 }
 
 func (cli *CommandLine) ValidateArgs() {
@@ -79,11 +116,21 @@ func (cli *CommandLine) ValidateArgs() {
 		cli.Genesis()
 	case "wallet":
 		cli.Wallet()
+	case "ban":
+		cli.Ban()
+	case "blockstore":
+		cli.BlockStore()
+	case "utxoset":
+		cli.UtxoSet()
 	case "blockchain":
-		os.Exit(1)
 		cli.Blockchain()
+	case "block":
+		cli.Block()
+	case "tx":
+		cli.Tx()
+	case "address":
+		cli.Address()
 	case "interactive":
-		os.Exit(1)
 		cli.Interactive()
 	default:
 		cli.PrintUsage()
@@ -96,7 +143,7 @@ func (cli *CommandLine) Run() {
 
 	nodeConf, _ := cli.extractConf()
 	node := node.NewNode(cli.ctx, nodeConf)
-	go node.Run()
+	node.Run()
 }
 
 func (cli *CommandLine) Node() {
@@ -128,25 +175,22 @@ func (cli *CommandLine) Node() {
 			node.Mine()
 		case "--validateBlk", "-v":
 			cli.getBlockFromArg(&i, args, node)
-			node.ValidateBlock()
+			cli.printValidation(node.ValidateBlock())
 		case "--addBlk", "-d":
 			cli.getBlockFromArg(&i, args, node)
-			node.AddBlock()
-		case "--updateUtxoSet", "-u":
-			cli.getBlockFromArg(&i, args, node)
-			node.UpdateUtxoSet()
+			t_error.LogWarn(node.AddBlock())
 		case "--broadcastBlk", "-b":
 			cli.getBlockFromArg(&i, args, node)
 			node.Broadcast()
 		case "--validateTx", "-t":
 			cli.getTxFromArg(&i, args, node)
-			node.ValidateTx()
+			cli.printValidation(node.ValidateTx())
 		case "--addTxToPool", "-o":
 			cli.getTxFromArg(&i, args, node)
-			node.AddTxToPool()
+			cli.printValidation(node.AddTxToPool())
 		case "--addTxToBlk", "-k":
 			cli.getTxFromArg(&i, args, node)
-			node.AddTxToBlock()
+			t_error.LogWarn(node.AddTxToBlock())
 		default:
 			cli.PrintUsage()
 			os.Exit(1)
@@ -154,8 +198,36 @@ func (cli *CommandLine) Node() {
 	}
 }
 
+// Interactive is a console for the running node's RPC methods.
 func (cli *CommandLine) Interactive() {
-
+	client := rpc.NewClient(cli.ctx)
+	scanner := bufio.NewScanner(os.Stdin)
+	fmt.Print("> ")
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			fmt.Print("> ")
+			continue
+		}
+		if fields[0] == "quit" || fields[0] == "exit" {
+			return
+		}
+		params := make([]any, len(fields)-1)
+		for i, field := range fields[1:] {
+			if !json.Valid([]byte(field)) {
+				params[i] = field
+			} else {
+				params[i] = json.RawMessage(field)
+			}
+		}
+		var result json.RawMessage
+		if err := client.Call(fields[0], &result, params...); err != nil {
+			fmt.Println(err.Error())
+		} else {
+			cli.printJson(result)
+		}
+		fmt.Print("> ")
+	}
 }
 
 func (cli *CommandLine) Wallet() {
@@ -207,10 +279,21 @@ func (cli *CommandLine) Wallet() {
 		case "--getAddr", "-a":
 			fmt.Printf("Wallet: %s\nAddress: %s", w.Name, w.ClientId.Address)
 			i++
-		case "--genTx", "-g":
-			os.Exit(1)
+		case "--tx", "--genTx", "-g":
+			cli.assertMoreArgs(i+1, N)
+			addrs, values := cli.ParseTx(args[i+1])
+			tx := wc.GenP2PKH(nil, addrs, values, nil, 0)
+			wc.WriteTmpTx(tx)
+			fmt.Println(hex.EncodeToString(tx.Hash()))
+			i += 2
 		case "--sendTx", "-s":
-			os.Exit(1)
+			cli.assertMoreArgs(i+1, N)
+			if err := wc.BroadcastTx(wc.ReadTmpTx(args[i+1])); err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+			fmt.Println("Sent " + args[i+1])
+			i += 2
 		default:
 			cli.PrintUsage()
 			os.Exit(1)
@@ -218,8 +301,139 @@ func (cli *CommandLine) Wallet() {
 	}
 }
 
-func (cli *CommandLine) Blockchain() {
+func (cli *CommandLine) Ban() {
+	if len(os.Args) < 3 {
+		cli.PrintUsage()
+		os.Exit(1)
+	}
+	args := os.Args[2:]
+	bans := network.NewBanList(cli.ctx)
+
+	switch args[0] {
+	case "--list", "-l":
+		for _, ban := range bans.List() {
+			until := "permanent"
+			if ban.Until != 0 {
+				until = time.Unix(ban.Until, 0).Format(time.RFC3339)
+			}
+			fmt.Printf("%-40s%-30s%s\n", ban.Host, until, ban.Reason)
+		}
+	case "--add", "-a":
+		cli.assertMoreArgs(1, len(args))
+		var duration time.Duration
+		if len(args) > 2 {
+			seconds, err := strconv.Atoi(args[2])
+			if err != nil || seconds <= 0 {
+				cli.PrintUsage()
+				os.Exit(1)
+			}
+			duration = time.Duration(seconds) * time.Second
+		}
+		bans.Add(args[1], duration, "added manually")
+	case "--remove", "-r":
+		cli.assertMoreArgs(1, len(args))
+		if !bans.Remove(args[1]) {
+			fmt.Println("Host is not banned.")
+		}
+	default:
+		cli.PrintUsage()
+		os.Exit(1)
+	}
+}
 
+// call runs an RPC method on the running node and exits on failure.
+func (cli *CommandLine) call(client *rpc.Client, method string, result any, params ...any) {
+	if err := client.Call(method, result, params...); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+}
+
+func (cli *CommandLine) printJson(raw json.RawMessage) {
+	b, err := json.MarshalIndent(raw, "", "  ")
+	t_error.LogErr(err)
+	fmt.Println(string(b))
+}
+
+func (cli *CommandLine) BlockStore() {
+	if len(os.Args) != 3 {
+		cli.PrintUsage()
+		os.Exit(1)
+	}
+	store := blockStore.NewBlockStore(cli.ctx)
+	defer store.Close()
+
+	switch os.Args[2] {
+	case "--repair", "-r":
+		report := store.Repair()
+		fmt.Printf("Relinked %d, missing %d, truncated %d files.\n", report.Relinked, report.Missing, report.Truncated)
+	case "--compact", "-c":
+		report := store.Compact()
+		fmt.Printf("Kept %d records, %d bytes down to %d.\n", report.Records, report.Before, report.After)
+	default:
+		cli.PrintUsage()
+		os.Exit(1)
+	}
+}
+
+func (cli *CommandLine) UtxoSet() {
+	args, asJson := cli.explorerArgs()
+	if len(args) == 0 {
+		cli.PrintUsage()
+		os.Exit(1)
+	}
+
+	info := new(rpc.TxOutSetInfo)
+	switch {
+	case len(args) == 1 && (args[0] == "--info" || args[0] == "-i"):
+		if !cli.query(asJson, "gettxoutsetinfo", info) {
+			return
+		}
+	case len(args) == 2 && (args[0] == "--dump" || args[0] == "-d"):
+		// the node resolves relative paths against its own working dir
+		p, err := filepath.Abs(args[1])
+		t_error.LogErr(err)
+		if !cli.query(asJson, "dumptxoutset", info, p) {
+			return
+		}
+		fmt.Printf("%-16s%s\n", "Written to", info.Path)
+	case len(args) == 2 && (args[0] == "--load" || args[0] == "-l"):
+		cli.loadUtxoSnapshot(args[1])
+		return
+	default:
+		cli.PrintUsage()
+		os.Exit(1)
+	}
+	fmt.Printf("%-16s%d\n", "Height", info.Height)
+	fmt.Printf("%-16s%s\n", "Best block", info.BestBlock)
+	fmt.Printf("%-16s%d\n", "Outputs", info.TxOuts)
+	fmt.Printf("%-16s%d TRM\n", "Total", info.TotalAmount)
+	fmt.Printf("%-16s%s\n", "Hash", info.Hash)
+}
+
+// loadUtxoSnapshot replaces the utxo set of the stopped node with a
+// snapshot. The node connects the blocks between the snapshot's block and
+// its tip when it next starts.
+func (cli *CommandLine) loadUtxoSnapshot(file string) {
+	f, err := os.Open(file)
+	t_error.LogErr(err)
+	defer f.Close()
+
+	blocks := blockStore.NewBlockStore(cli.ctx)
+	defer blocks.Close()
+	utxos := utxoSet.NewUtxoStore(cli.ctx)
+	defer utxos.Close()
+
+	stats, err := utxos.Load(f, func(hash []byte) bool {
+		_, meta := blocks.Read(hash)
+		return meta != nil
+	})
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("Loaded %d outputs, %d TRM, at block %s\n", stats.Count, stats.Total, hex.EncodeToString(stats.BestBlock))
+	fmt.Printf("%-16s%s\n", "Hash", hex.EncodeToString(stats.Hash))
 }
 
 func (cli *CommandLine) ParseTx(tx string) ([]string, []int64) {
@@ -247,12 +461,8 @@ func (cli *CommandLine) Genesis() {
 	}
 	nodeAddr := os.Args[2]
 
-	_numTx := uint8(10)
-	_port := uint16(t_config.RpcEndpointPort)
 	nodeConf := t_config.Config{
-		NumTxInBlock:    &_numTx,
-		RpcEndpointPort: &_port,
-		ClientAddress:   &nodeAddr,
+		ClientAddress: &nodeAddr,
 	}
 
 	node := node.NewNode(cli.ctx, &nodeConf)
@@ -279,9 +489,9 @@ func (cli *CommandLine) extractConf() (*t_config.Config, []string) {
 		os.Exit(1)
 	}
 
-	var numTx uint8 = t_config.NumTxInBlock
-	nodeAddr := ""
-	var port uint16 = t_config.RpcEndpointPort
+	// fields stay nil unless their flag is given, so only given flags
+	// override the config
+	nodeConf := t_config.Config{Peers: make([]string, 0)}
 
 	args := make([]string, len(os.Args)-2)
 	copy(args, os.Args[2:])
@@ -294,46 +504,77 @@ func (cli *CommandLine) extractConf() (*t_config.Config, []string) {
 		switch arg {
 		case "--numTx", "-n":
 			cli.assertMoreArgs(i, N)
-			_numTx, err := strconv.Atoi(os.Args[i+1])
+			_numTx, err := strconv.Atoi(args[i+1])
 			if err != nil {
 				cli.PrintUsage()
 				os.Exit(1)
 			} else {
-				numTx = uint8(_numTx)
+				numTx := uint8(_numTx)
+				nodeConf.NumTxInBlock = &numTx
 				args[i] = ""
 				args[i+1] = ""
 				i += 2
 			}
 		case "--nodeAddr", "-a":
 			cli.assertMoreArgs(i, N)
-			nodeAddr = os.Args[i+1]
+			nodeAddr := args[i+1]
+			nodeConf.ClientAddress = &nodeAddr
 			args[i] = ""
 			args[i+1] = ""
 			i += 2
 		case "--port", "-p":
 			cli.assertMoreArgs(i, N)
-			_port, err := strconv.Atoi(os.Args[i+1])
+			_port, err := strconv.Atoi(args[i+1])
 			if err != nil {
 				cli.PrintUsage()
 				os.Exit(1)
 			} else {
-				port = uint16(_port)
+				port := uint16(_port)
+				nodeConf.P2PPort = &port
 				args[i] = ""
 				args[i+1] = ""
 				i += 2
 			}
+		case "--rpcport":
+			cli.assertMoreArgs(i, N)
+			_port, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				cli.PrintUsage()
+				os.Exit(1)
+			}
+			rpcPort := uint16(_port)
+			nodeConf.RpcPort = &rpcPort
+			args[i] = ""
+			args[i+1] = ""
+			i += 2
+		case "--host":
+			cli.assertMoreArgs(i, N)
+			host := args[i+1]
+			nodeConf.BindHost = &host
+			args[i] = ""
+			args[i+1] = ""
+			i += 2
+		case "--peer":
+			cli.assertMoreArgs(i, N)
+			nodeConf.Peers = append(nodeConf.Peers, args[i+1])
+			args[i] = ""
+			args[i+1] = ""
+			i += 2
 		default:
 			i++
 		}
 	}
-	nodeConf := t_config.Config{
-		NumTxInBlock:    &numTx,
-		RpcEndpointPort: &port,
-		ClientAddress:   &nodeAddr,
-	}
 	return &nodeConf, args
 }
 
+func (cli *CommandLine) printValidation(err error) {
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	fmt.Println("Valid.")
+}
+
 func (cli *CommandLine) assertMoreArgs(argI, N int) {
 	if argI == N {
 		cli.PrintUsage()
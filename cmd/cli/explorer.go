@@ -0,0 +1,193 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/tiereum/trmnode/internal/rpc"
+	"github.com/tiereum/trmnode/internal/t_error"
+)
+
+// explorerArgs splits the arguments after the command into positional
+// args and the --json switch.
+func (cli *CommandLine) explorerArgs() ([]string, bool) {
+	args := make([]string, 0)
+	asJson := false
+	for _, arg := range os.Args[2:] {
+		if arg == "--json" || arg == "-j" {
+			asJson = true
+		} else {
+			args = append(args, arg)
+		}
+	}
+	return args, asJson
+}
+
+// query runs method on the running node. With asJson the raw result is
+// printed and query returns false, otherwise it is decoded into result for
+// the caller to print.
+func (cli *CommandLine) query(asJson bool, method string, result any, params ...any) bool {
+	var raw json.RawMessage
+	cli.call(rpc.NewClient(cli.ctx), method, &raw, params...)
+	if asJson {
+		cli.printJson(raw)
+		return false
+	}
+	t_error.LogErr(json.Unmarshal(raw, result))
+	return true
+}
+
+func (cli *CommandLine) Blockchain() {
+	args, asJson := cli.explorerArgs()
+	if len(args) != 1 {
+		cli.PrintUsage()
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "--print", "-p":
+		var chain []rpc.ChainEntry
+		if !cli.query(asJson, "getchain", &chain) {
+			return
+		}
+		for _, entry := range chain {
+			fmt.Printf("%-8d%s  %s  %d txs\n", entry.Height, entry.Hash, formatTime(entry.Time), entry.TxCount)
+		}
+	case "--utxo", "-u":
+		var unspent []rpc.UnspentResult
+		if !cli.query(asJson, "listunspent", &unspent) {
+			return
+		}
+		var total int64
+		for _, u := range unspent {
+			fmt.Printf("%s:%-6d%14d  %s\n", u.TxId, u.Vout, u.Value, u.Address)
+			total += u.Value
+		}
+		fmt.Printf("\n%d outputs, %d TRM\n", len(unspent), total)
+	case "--mempool", "-m":
+		var entries []rpc.MempoolEntry
+		if !cli.query(asJson, "getrawmempool", &entries, true) {
+			return
+		}
+		for _, entry := range entries {
+			fmt.Printf("%s  %8d bytes  fee %d\n", entry.TxId, entry.Size, entry.Fee)
+		}
+		fmt.Printf("\n%d txs\n", len(entries))
+	default:
+		cli.PrintUsage()
+		os.Exit(1)
+	}
+}
+
+// Block prints the block with the given hash, or the main chain block at
+// the given height.
+func (cli *CommandLine) Block() {
+	args, asJson := cli.explorerArgs()
+	if len(args) != 1 {
+		cli.PrintUsage()
+		os.Exit(1)
+	}
+	hash := args[0]
+	if height, err := strconv.ParseInt(hash, 10, 64); err == nil && len(hash) < 64 {
+		cli.call(rpc.NewClient(cli.ctx), "getblockhash", &hash, height)
+	}
+
+	b := new(rpc.BlockResult)
+	if !cli.query(asJson, "getblock", b, hash) {
+		return
+	}
+	fmt.Printf("%-16s%s\n", "Block", b.Hash)
+	fmt.Printf("%-16s%d\n", "Height", b.Height)
+	if b.Confirmations < 0 {
+		fmt.Printf("%-16s%s\n", "Confirmations", "not on the main chain")
+	} else {
+		fmt.Printf("%-16s%d\n", "Confirmations", b.Confirmations)
+	}
+	fmt.Printf("%-16s%s\n", "Time", formatTime(b.Time))
+	fmt.Printf("%-16s%s\n", "Median time", formatTime(b.MedianTime))
+	fmt.Printf("%-16s%s\n", "Bits", b.Bits)
+	fmt.Printf("%-16s%d\n", "Nonce", b.Nonce)
+	fmt.Printf("%-16s%s\n", "Merkle root", b.MerkleRoot)
+	fmt.Printf("%-16s%s\n", "Chain work", b.ChainWork)
+	if b.PreviousBlockHash != "" {
+		fmt.Printf("%-16s%s\n", "Previous", b.PreviousBlockHash)
+	}
+	if b.NextBlockHash != "" {
+		fmt.Printf("%-16s%s\n", "Next", b.NextBlockHash)
+	}
+	fmt.Printf("\n%d transactions\n", b.TxCount)
+	for _, txid := range b.Tx {
+		fmt.Println("  " + txid)
+	}
+}
+
+// Tx prints a tx from the mempool or, through the tx index, from the chain.
+func (cli *CommandLine) Tx() {
+	args, asJson := cli.explorerArgs()
+	if len(args) != 1 {
+		cli.PrintUsage()
+		os.Exit(1)
+	}
+
+	tx := new(rpc.TxResult)
+	if !cli.query(asJson, "getrawtransaction", tx, args[0], true) {
+		return
+	}
+	fmt.Printf("%-16s%s\n", "Tx", tx.TxId)
+	if tx.BlockHash == "" {
+		fmt.Printf("%-16s%s\n", "Block", "in the mempool")
+	} else {
+		fmt.Printf("%-16s%s\n", "Block", tx.BlockHash)
+		fmt.Printf("%-16s%d\n", "Confirmations", tx.Confirmations)
+	}
+	fmt.Printf("%-16s%d\n", "Version", tx.Version)
+	fmt.Printf("%-16s%d\n", "Locktime", tx.LockTime)
+
+	fmt.Printf("\n%d inputs\n", len(tx.Vin))
+	for _, in := range tx.Vin {
+		if in.Coinbase {
+			fmt.Println("  coinbase")
+		} else {
+			fmt.Printf("  %s:%d\n", in.TxId, in.Vout)
+		}
+	}
+	fmt.Printf("\n%d outputs\n", len(tx.Vout))
+	for _, out := range tx.Vout {
+		to := out.Address
+		if to == "" {
+			to = "script " + out.ScriptPubKey
+		}
+		fmt.Printf("  %-4d%14d  %s\n", out.N, out.Value, to)
+	}
+}
+
+// Address prints the balance and unspent outputs of an address.
+func (cli *CommandLine) Address() {
+	args, asJson := cli.explorerArgs()
+	if len(args) != 1 {
+		cli.PrintUsage()
+		os.Exit(1)
+	}
+
+	var unspent []rpc.UnspentResult
+	if !cli.query(asJson, "listunspent", &unspent, args[0]) {
+		return
+	}
+	var balance int64
+	for _, u := range unspent {
+		balance += u.Value
+	}
+	fmt.Printf("%-16s%s\n", "Address", args[0])
+	fmt.Printf("%-16s%d TRM\n", "Balance", balance)
+	fmt.Printf("\n%d unspent outputs\n", len(unspent))
+	for _, u := range unspent {
+		fmt.Printf("  %s:%-6d%14d\n", u.TxId, u.Vout, u.Value)
+	}
+}
+
+func formatTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format(time.RFC3339)
+}
@@ -11,7 +11,7 @@ type Header struct {
 	PrevHash       []byte // 32 bytes
 	MerkleRootHash []byte // 32 bytes
 	TimeStamp      uint32
-	Target         uint8
+	Bits           uint32 // compact encoding of the proof-of-work target
 	Nonce          uint32
 }
 
@@ -53,12 +53,16 @@ func (block Block) MerkelRoot() []byte {
 	return MerkelRoot(bits)
 }
 
-func (block Block) Hash() []byte {
+func (header Header) Hash() []byte {
 	e := NewHeaderEncoder(nil)
-	e.Encode(&block.Header)
+	e.Encode(&header)
 	return t_util.Hash256(e.Bytes())
 }
 
+func (block Block) Hash() []byte {
+	return block.Header.Hash()
+}
+
 func (block Block) Serialize() []byte {
 	e := NewBlockEncoder(nil)
 	e.Encode(&block)
@@ -43,7 +43,7 @@ func (d *HeaderDecoder) Clear() {
 
 func (d *HeaderDecoder) Decode(buffer *bytes.Buffer) error {
 
-	if buffer.Len() < 4+32+32+4+1+4 {
+	if buffer.Len() < 4+32+32+4+4+4 {
 		return BAD_HEADER_ERR{}
 	}
 
@@ -51,7 +51,7 @@ func (d *HeaderDecoder) Decode(buffer *bytes.Buffer) error {
 	d.header.PrevHash = buffer.Next(32)
 	d.header.MerkleRootHash = buffer.Next(32)
 	d.header.TimeStamp = binary.BigEndian.Uint32(buffer.Next(4))
-	d.header.Target = buffer.Next(1)[0]
+	d.header.Bits = binary.BigEndian.Uint32(buffer.Next(4))
 	d.header.Nonce = binary.BigEndian.Uint32(buffer.Next(4))
 
 	return nil
@@ -86,7 +86,7 @@ func (e *HeaderEncoder) Encode(header *Header) {
 	binary.Write(e.buffer, binary.BigEndian, header.PrevHash)
 	binary.Write(e.buffer, binary.BigEndian, header.MerkleRootHash)
 	binary.Write(e.buffer, binary.BigEndian, header.TimeStamp)
-	binary.Write(e.buffer, binary.BigEndian, header.Target)
+	binary.Write(e.buffer, binary.BigEndian, header.Bits)
 	binary.Write(e.buffer, binary.BigEndian, header.Nonce)
 }
 
@@ -3,8 +3,6 @@ package blockStore
 import (
 	"bytes"
 	"crypto/sha256"
-	"encoding/hex"
-	"errors"
 	"math/big"
 	"os"
 	"path"
@@ -21,56 +19,80 @@ func (c CorruptBlockErr) Error() string {
 }
 
 type BlockMetaData struct {
-	Hash   []byte
-	Nonce  uint32
-	Height big.Int
+	Hash      []byte
+	PrevHash  []byte
+	Nonce     uint32
+	TimeStamp uint32
+	Bits      uint32
+	Height    big.Int
+	ChainWork big.Int // total work of the chain ending at this block
 }
 
+// BlockIO appends blocks to the blk*.dat files and their undo data to the
+// rev*.dat files under .data/blocks. Where a record lives is kept in the
+// index by BlockStore.
 type BlockIO struct {
-	ctx *t_config.Context
+	ctx    *t_config.Context
+	blocks *FlatFiles
+	undo   *FlatFiles
 }
 
 func NewBlockIO(ctx *t_config.Context) *BlockIO {
-	return &BlockIO{
-		ctx: ctx,
+	b := new(BlockIO)
+	b.ctx = ctx
+	dir := path.Join(ctx.DataDir, FLAT_FILE_DIR)
+	// a compaction stopped between moving the old files aside and moving
+	// the new ones in
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if _, err := os.Stat(dir + ".old"); err == nil {
+			t_error.LogErr(os.Rename(dir+".old", dir))
+		}
 	}
+	b.open(dir)
+	return b
 }
 
-func (b *BlockIO) Write(block *block.Block, hash []byte) error {
+func (b *BlockIO) open(dir string) {
+	var err error
+	b.blocks, err = NewFlatFiles(dir, BLOCK_FILE_PREFIX)
+	t_error.LogErr(err)
+	b.undo, err = NewFlatFiles(dir, UNDO_FILE_PREFIX)
+	t_error.LogErr(err)
+}
 
-	f, err := os.OpenFile(path.Join(b.ctx.DataDir, hex.EncodeToString(hash)), os.O_CREATE|os.O_RDWR, 0644)
+func (b *BlockIO) Write(block *block.Block, hash []byte) (FilePos, error) {
+	return b.blocks.Append(hash, block.Serialize())
+}
 
+func (b *BlockIO) Read(hash []byte, pos FilePos) (*block.Block, error) {
+	data, err := b.blocks.Read(hash, pos)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_bytes := block.Serialize()
-	n, err := f.Write(_bytes)
-	t_error.LogErr(err)
-
-	sum := b.Checksum(_bytes)
-	f.WriteAt(sum, int64(n))
-	return nil
+	blockDecoder := block.NewBlockDecoder(nil)
+	if err := blockDecoder.Decode(bytes.NewBuffer(data)); err != nil {
+		return nil, CorruptBlockErr{}
+	}
+	return blockDecoder.Out(), nil
 }
 
-func (b *BlockIO) Read(hash []byte) *block.Block {
-
-	allBytes, err := os.ReadFile(path.Join(b.ctx.DataDir, hex.EncodeToString(hash)))
-	t_error.LogErr(err)
-	dataBytes := allBytes[:len(allBytes)-32]
-	sum := allBytes[len(allBytes)-32:]
-
-	valid := b.Check(dataBytes, sum)
+// WriteUndo appends the undo data for a block to the rev files.
+func (b *BlockIO) WriteUndo(undo *BlockUndo, hash []byte) (FilePos, error) {
+	enc := NewUndoEncoder(nil)
+	enc.Encode(undo)
+	return b.undo.Append(hash, enc.Bytes())
+}
 
-	if !valid {
-		t_error.LogErr(CorruptBlockErr{})
+func (b *BlockIO) ReadUndo(hash []byte, pos FilePos) (*BlockUndo, error) {
+	data, err := b.undo.Read(hash, pos)
+	if err != nil {
+		return nil, err
 	}
-
-	blockDecoder := block.NewBlockDecoder(nil)
-	buffer := bytes.Buffer{}
-	buffer.Write(dataBytes)
-	blockDecoder.Decode(&buffer)
-
-	return blockDecoder.Out()
+	dec := NewUndoDecoder(nil)
+	if err := dec.Decode(bytes.NewBuffer(data)); err != nil {
+		return nil, err
+	}
+	return dec.Out(), nil
 }
 
 func (b *BlockIO) Checksum(blockBytes []byte) []byte {
@@ -84,17 +106,3 @@ func (b *BlockIO) Check(_bytes, sum []byte) bool {
 	return bytes.Equal(expected[:], sum)
 
 }
-
-func (b *BlockIO) Update(block *block.Block, hash []byte) {
-	b.Delete(hash)
-	b.Write(block, hash)
-}
-
-func (b *BlockIO) Delete(hash []byte) {
-	path := path.Join(b.ctx.DataDir, hex.EncodeToString(hash))
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		t_error.LogWarn(errors.New("file does not exist, cant delete"))
-		return
-	}
-	t_error.LogErr(os.Remove(path))
-}
@@ -17,18 +17,66 @@ func NewBlockStore(ctx *t_config.Context) *BlockStore {
 	store := new(BlockStore)
 	store.blockIO = NewBlockIO(ctx)
 	store.indexIO = NewIndexIO(ctx)
+	if n := store.importLegacy(); n > 0 {
+		t_error.LogInfo("Moved %d block files into %s", n, FLAT_FILE_DIR)
+	}
 	return store
 }
 
+type ERR_BLOCK_NOT_STORED struct{}
+
+func (err ERR_BLOCK_NOT_STORED) Error() string {
+	return "Block data is not stored."
+}
+
+var ErrBlockNotStored ERR_BLOCK_NOT_STORED = ERR_BLOCK_NOT_STORED{}
+
+// Write appends block to the block files and indexes it with metadata.
 func (store *BlockStore) Write(block *block.Block, metadata *BlockMetaData) {
-	store.blockIO.Write(block, metadata.Hash)
+	pos, err := store.blockIO.Write(block, metadata.Hash)
+	t_error.LogErr(err)
+	store.indexIO.WritePos(BLOCK_POS_PREFIX, metadata.Hash, pos)
 	store.indexIO.Write(metadata)
 }
 
+// Read returns the stored block and its metadata, or nils when the block
+// is unknown. A block that fails its checksum is fatal.
 func (store *BlockStore) Read(hash []byte) (*block.Block, *BlockMetaData) {
-	block := store.blockIO.Read(hash)
+	pos, ok := store.indexIO.ReadPos(BLOCK_POS_PREFIX, hash)
+	if !ok {
+		return nil, nil
+	}
+	block, err := store.blockIO.Read(hash, pos)
+	t_error.LogErr(err)
 	meta := store.indexIO.Read(hash)
-	return block, &BlockMetaData{Hash: hash, Nonce: meta.Nonce, Height: meta.Height}
+	return block, store.indexIO.MetaData(hash, meta)
+}
+
+// WriteLast marks hash as the tip of the main chain.
+func (store *BlockStore) WriteLast(hash []byte) {
+	store.indexIO.WriteLastHash(hash)
+}
+
+// WriteHeight records hash as the main chain block at height, replacing
+// whatever was there before a reorg.
+func (store *BlockStore) WriteHeight(height int64, hash []byte) {
+	store.indexIO.WriteHeight(height, hash)
+}
+
+func (store *BlockStore) DeleteHeight(height int64) {
+	store.indexIO.DeleteHeight(height)
+}
+
+func (store *BlockStore) HashAtHeight(height int64) ([]byte, bool) {
+	return store.indexIO.ReadHeight(height)
+}
+
+func (store *BlockStore) ForEachHeight(from, to int64, fn func(height int64, hash []byte) bool) {
+	store.indexIO.ForEachHeight(from, to, fn)
+}
+
+func (store *BlockStore) ForEachMeta(fn func(meta *BlockMetaData)) {
+	store.indexIO.ForEach(fn)
 }
 
 type ERR_NO_BLOCKS_REMAINING struct{}
@@ -46,12 +94,32 @@ func (store *BlockStore) ReadLast() (*block.Block, *BlockMetaData, error) {
 	} else if err != nil {
 		t_error.LogErr(err)
 	}
-	block := store.blockIO.Read(meta.Hash)
+	block, _ := store.Read(meta.Hash)
 	return block, meta, nil
 }
 
+func (store *BlockStore) WriteUndo(undo *BlockUndo, hash []byte) error {
+	pos, err := store.blockIO.WriteUndo(undo, hash)
+	if err != nil {
+		return err
+	}
+	store.indexIO.WritePos(UNDO_POS_PREFIX, hash, pos)
+	return nil
+}
+
+func (store *BlockStore) ReadUndo(hash []byte) (*BlockUndo, error) {
+	pos, ok := store.indexIO.ReadPos(UNDO_POS_PREFIX, hash)
+	if !ok {
+		return nil, ErrBlockNotStored
+	}
+	return store.blockIO.ReadUndo(hash, pos)
+}
+
+// Delete drops the block from the index. Its records stay in the files
+// until they are compacted.
 func (store *BlockStore) Delete(hash []byte) {
-	store.blockIO.Delete(hash)
+	store.indexIO.DeletePos(BLOCK_POS_PREFIX, hash)
+	store.indexIO.DeletePos(UNDO_POS_PREFIX, hash)
 	store.indexIO.Delete(hash)
 }
 
@@ -0,0 +1,254 @@
+package blockStore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Blocks and undo data are appended to numbered files, blk00000.dat and
+// rev00000.dat onwards, which rotate at MAX_FLAT_FILE_SIZE. Each record is
+//
+//	magic     4 bytes
+//	hash     32 bytes, of the block the record belongs to
+//	length    4 bytes, of the data
+//	data
+//	checksum 32 bytes, sha256 of the data
+//
+// The hash makes the files self describing, so the index can be rebuilt
+// from them.
+const (
+	FLAT_FILE_MAGIC    uint32 = 0x74726d62 // "trmb"
+	MAX_FLAT_FILE_SIZE int64  = 128 * 1024 * 1024
+	RECORD_HEADER_SIZE        = 4 + 32 + 4
+	RECORD_SUM_SIZE           = 32
+	BLOCK_FILE_PREFIX         = "blk"
+	UNDO_FILE_PREFIX          = "rev"
+	FLAT_FILE_DIR             = "blocks"
+)
+
+// FilePos locates a record: the file number, the record's offset in it and
+// the size of its data.
+type FilePos struct {
+	File   uint32
+	Offset uint32
+	Size   uint32
+}
+
+func (pos FilePos) Bytes() []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint32(b, pos.File)
+	binary.BigEndian.PutUint32(b[4:], pos.Offset)
+	binary.BigEndian.PutUint32(b[8:], pos.Size)
+	return b
+}
+
+func DecodeFilePos(b []byte) (FilePos, error) {
+	if len(b) != 12 {
+		return FilePos{}, CorruptBlockErr{}
+	}
+	return FilePos{
+		File:   binary.BigEndian.Uint32(b),
+		Offset: binary.BigEndian.Uint32(b[4:]),
+		Size:   binary.BigEndian.Uint32(b[8:]),
+	}, nil
+}
+
+// FlatFiles is one sequence of append only files, all named prefix
+// followed by their number.
+type FlatFiles struct {
+	dir    string
+	prefix string
+	mu     sync.Mutex
+	last   uint32 // number of the file being appended to
+	size   int64  // size of the file being appended to
+}
+
+func NewFlatFiles(dir, prefix string) (*FlatFiles, error) {
+	files := new(FlatFiles)
+	files.dir = dir
+	files.prefix = prefix
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	numbers, err := files.Numbers()
+	if err != nil {
+		return nil, err
+	}
+	if len(numbers) > 0 {
+		files.last = numbers[len(numbers)-1]
+		info, err := os.Stat(files.Path(files.last))
+		if err != nil {
+			return nil, err
+		}
+		files.size = info.Size()
+	}
+	return files, nil
+}
+
+func (files *FlatFiles) Path(n uint32) string {
+	return path.Join(files.dir, fmt.Sprintf("%s%05d.dat", files.prefix, n))
+}
+
+// Numbers lists the numbers of the existing files in order.
+func (files *FlatFiles) Numbers() ([]uint32, error) {
+	entries, err := os.ReadDir(files.dir)
+	if err != nil {
+		return nil, err
+	}
+	numbers := []uint32{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, files.prefix) || !strings.HasSuffix(name, ".dat") {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, files.prefix), ".dat"), 10, 32)
+		if err != nil {
+			continue
+		}
+		numbers = append(numbers, uint32(n))
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers, nil
+}
+
+// Append writes data as a record of hash to the end of the current file,
+// moving on to a new file once the current one is full.
+func (files *FlatFiles) Append(hash, data []byte) (FilePos, error) {
+	files.mu.Lock()
+	defer files.mu.Unlock()
+
+	record := encodeRecord(hash, data)
+	if files.size > 0 && files.size+int64(len(record)) > MAX_FLAT_FILE_SIZE {
+		files.last++
+		files.size = 0
+	}
+	f, err := os.OpenFile(files.Path(files.last), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return FilePos{}, err
+	}
+	defer f.Close()
+	if _, err := f.Write(record); err != nil {
+		return FilePos{}, err
+	}
+	if err := f.Sync(); err != nil {
+		return FilePos{}, err
+	}
+	pos := FilePos{File: files.last, Offset: uint32(files.size), Size: uint32(len(data))}
+	files.size += int64(len(record))
+	return pos, nil
+}
+
+// Read returns the data of the record at pos after checking its checksum
+// and that it belongs to hash. An index entry left pointing at another
+// block's record reads as corrupt, so Repair relinks it.
+func (files *FlatFiles) Read(hash []byte, pos FilePos) ([]byte, error) {
+	f, err := os.Open(files.Path(pos.File))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if int64(pos.Size) > MAX_FLAT_FILE_SIZE {
+		return nil, CorruptBlockErr{}
+	}
+	record := make([]byte, RECORD_HEADER_SIZE+int(pos.Size)+RECORD_SUM_SIZE)
+	if _, err := f.ReadAt(record, int64(pos.Offset)); err != nil {
+		return nil, CorruptBlockErr{}
+	}
+	recordHash, data, err := decodeRecord(record)
+	if err != nil || len(data) != int(pos.Size) || !bytes.Equal(recordHash, hash) {
+		return nil, CorruptBlockErr{}
+	}
+	return data, nil
+}
+
+// Scan reads file n from the start and calls fn with every intact record.
+// It stops at the first damaged or partial record and returns the offset
+// where the intact records end.
+func (files *FlatFiles) Scan(n uint32, fn func(hash []byte, pos FilePos, data []byte)) (int64, error) {
+	f, err := os.Open(files.Path(n))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var offset int64
+	header := make([]byte, RECORD_HEADER_SIZE)
+	for {
+		if _, err := f.ReadAt(header, offset); err != nil {
+			return offset, nil
+		}
+		if binary.BigEndian.Uint32(header) != FLAT_FILE_MAGIC {
+			return offset, nil
+		}
+		size := binary.BigEndian.Uint32(header[4+32:])
+		if int64(size) > MAX_FLAT_FILE_SIZE {
+			return offset, nil
+		}
+		record := make([]byte, RECORD_HEADER_SIZE+int(size)+RECORD_SUM_SIZE)
+		if _, err := f.ReadAt(record, offset); err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			return offset, err
+		}
+		hash, data, err := decodeRecord(record)
+		if err != nil {
+			return offset, nil
+		}
+		fn(hash, FilePos{File: n, Offset: uint32(offset), Size: size}, data)
+		offset += int64(len(record))
+	}
+}
+
+// Truncate cuts file n at size, dropping a partly written last record.
+func (files *FlatFiles) Truncate(n uint32, size int64) error {
+	files.mu.Lock()
+	defer files.mu.Unlock()
+	if err := os.Truncate(files.Path(n), size); err != nil {
+		return err
+	}
+	if n == files.last {
+		files.size = size
+	}
+	return nil
+}
+
+func encodeRecord(hash, data []byte) []byte {
+	record := bytes.NewBuffer(make([]byte, 0, RECORD_HEADER_SIZE+len(data)+RECORD_SUM_SIZE))
+	binary.Write(record, binary.BigEndian, FLAT_FILE_MAGIC)
+	record.Write(hash)
+	binary.Write(record, binary.BigEndian, uint32(len(data)))
+	record.Write(data)
+	sum := sha256.Sum256(data)
+	record.Write(sum[:])
+	return record.Bytes()
+}
+
+func decodeRecord(record []byte) ([]byte, []byte, error) {
+	if len(record) < RECORD_HEADER_SIZE+RECORD_SUM_SIZE {
+		return nil, nil, CorruptBlockErr{}
+	}
+	if binary.BigEndian.Uint32(record) != FLAT_FILE_MAGIC {
+		return nil, nil, CorruptBlockErr{}
+	}
+	hash := record[4 : 4+32]
+	size := binary.BigEndian.Uint32(record[4+32:])
+	if len(record) != RECORD_HEADER_SIZE+int(size)+RECORD_SUM_SIZE {
+		return nil, nil, CorruptBlockErr{}
+	}
+	data := record[RECORD_HEADER_SIZE : RECORD_HEADER_SIZE+int(size)]
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(sum[:], record[RECORD_HEADER_SIZE+int(size):]) {
+		return nil, nil, CorruptBlockErr{}
+	}
+	return hash, data, nil
+}
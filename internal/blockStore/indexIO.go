@@ -2,6 +2,7 @@ package blockStore
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"math/big"
@@ -13,9 +14,24 @@ import (
 	"github.com/dgraph-io/badger/v4"
 )
 
+// main chain blocks are also indexed by height, under HEIGHT_PREFIX followed
+// by the big endian height, so that a key range is a height range
+const HEIGHT_PREFIX = "height/"
+
+// where a block and its undo data are stored in the flat files, under the
+// prefix followed by the block hash
+const (
+	BLOCK_POS_PREFIX = "blockPos/"
+	UNDO_POS_PREFIX  = "undoPos/"
+)
+
 type __metadata__ struct {
-	Nonce  uint32
-	Height big.Int
+	PrevHash  []byte
+	Nonce     uint32
+	TimeStamp uint32
+	Bits      uint32
+	Height    big.Int
+	ChainWork big.Int
 }
 type IndexIO struct {
 	db  *badger.DB
@@ -56,20 +72,27 @@ func (store *IndexIO) ReadLast() (*BlockMetaData, error) {
 		return nil, err
 	}
 	meta := store.Read(hash)
-	return &BlockMetaData{Hash: hash, Nonce: meta.Nonce, Height: meta.Height}, nil
+	return store.MetaData(hash, meta), nil
 }
 
 func (store *IndexIO) Write(meta *BlockMetaData) {
 	hash := meta.Hash
 	__meta := __metadata__{
-		Nonce:  meta.Nonce,
-		Height: meta.Height,
+		PrevHash:  meta.PrevHash,
+		Nonce:     meta.Nonce,
+		TimeStamp: meta.TimeStamp,
+		Bits:      meta.Bits,
+		Height:    meta.Height,
+		ChainWork: meta.ChainWork,
 	}
 	err := store.db.Update(func(txn *badger.Txn) error {
 
 		buffer := bytes.Buffer{}
 		enc := gob.NewEncoder(&buffer)
-		enc.Encode(__meta)
+		// gob can only call GobEncode on the big.Int fields through a pointer
+		if err := enc.Encode(&__meta); err != nil {
+			return err
+		}
 		err := txn.Set(hash, buffer.Bytes())
 		if err != nil {
 			return err
@@ -77,7 +100,6 @@ func (store *IndexIO) Write(meta *BlockMetaData) {
 		return nil
 	})
 	t_error.LogErr(err)
-	store.WriteLastHash(hash)
 }
 
 func (store *IndexIO) WriteLastHash(hash []byte) {
@@ -134,9 +156,182 @@ func (store *IndexIO) Close() {
 
 func (store *IndexIO) MetaData(hash []byte, metadata *__metadata__) *BlockMetaData {
 	_metadata := BlockMetaData{
-		Hash:   hash,
-		Nonce:  metadata.Nonce,
-		Height: metadata.Height,
+		Hash:      hash,
+		PrevHash:  metadata.PrevHash,
+		Nonce:     metadata.Nonce,
+		TimeStamp: metadata.TimeStamp,
+		Bits:      metadata.Bits,
+		Height:    metadata.Height,
+		ChainWork: metadata.ChainWork,
 	}
 	return &_metadata
 }
+
+// ForEach calls fn with the metadata of every indexed block, in key order.
+func (store *IndexIO) ForEach(fn func(meta *BlockMetaData)) {
+	err := store.db.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			hash := item.KeyCopy(nil)
+			if len(hash) != 32 {
+				continue
+			}
+			metadata := new(__metadata__)
+			err := item.Value(func(val []byte) error {
+				buffer := bytes.Buffer{}
+				buffer.Write(val)
+				dec := gob.NewDecoder(&buffer)
+				return dec.Decode(metadata)
+			})
+			if err != nil {
+				return err
+			}
+			fn(store.MetaData(hash, metadata))
+		}
+		return nil
+	})
+	t_error.LogErr(err)
+}
+
+func heightKey(height int64) []byte {
+	key := make([]byte, len(HEIGHT_PREFIX)+8)
+	copy(key, HEIGHT_PREFIX)
+	binary.BigEndian.PutUint64(key[len(HEIGHT_PREFIX):], uint64(height))
+	return key
+}
+
+// WriteHeight records hash as the main chain block at height.
+func (store *IndexIO) WriteHeight(height int64, hash []byte) {
+	err := store.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(heightKey(height), hash)
+	})
+	t_error.LogErr(err)
+}
+
+func (store *IndexIO) DeleteHeight(height int64) {
+	err := store.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(heightKey(height))
+	})
+	t_error.LogErr(err)
+}
+
+// ReadHeight returns the hash of the main chain block at height.
+func (store *IndexIO) ReadHeight(height int64) ([]byte, bool) {
+	var hash []byte
+	err := store.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(heightKey(height))
+		if err != nil {
+			return err
+		}
+		hash, err = item.ValueCopy(nil)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, false
+	}
+	t_error.LogErr(err)
+	return hash, true
+}
+
+// ForEachHeight calls fn with the main chain hashes from height from up to
+// and including to, in order, until fn returns false.
+func (store *IndexIO) ForEachHeight(from, to int64, fn func(height int64, hash []byte) bool) {
+	err := store.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(HEIGHT_PREFIX)
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Seek(heightKey(from)); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			height := int64(binary.BigEndian.Uint64(item.Key()[len(HEIGHT_PREFIX):]))
+			if height > to {
+				return nil
+			}
+			hash, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if !fn(height, hash) {
+				return nil
+			}
+		}
+		return nil
+	})
+	t_error.LogErr(err)
+}
+
+// WritePos records where the record of hash under prefix is stored.
+func (store *IndexIO) WritePos(prefix string, hash []byte, pos FilePos) {
+	err := store.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(append([]byte(prefix), hash...), pos.Bytes())
+	})
+	t_error.LogErr(err)
+}
+
+func (store *IndexIO) ReadPos(prefix string, hash []byte) (FilePos, bool) {
+	var pos FilePos
+	err := store.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append([]byte(prefix), hash...))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			pos, err = DecodeFilePos(val)
+			return err
+		})
+	})
+	if err == badger.ErrKeyNotFound {
+		return pos, false
+	}
+	t_error.LogErr(err)
+	return pos, true
+}
+
+func (store *IndexIO) DeletePos(prefix string, hash []byte) {
+	err := store.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(append([]byte(prefix), hash...))
+	})
+	t_error.LogErr(err)
+}
+
+// ForEachPos calls fn with every hash and position stored under prefix.
+func (store *IndexIO) ForEachPos(prefix string, fn func(hash []byte, pos FilePos)) {
+	err := store.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(prefix)
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			hash := item.KeyCopy(nil)[len(prefix):]
+			err := item.Value(func(val []byte) error {
+				pos, err := DecodeFilePos(val)
+				if err != nil {
+					return err
+				}
+				fn(hash, pos)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	t_error.LogErr(err)
+}
+
+// Has reports whether metadata for hash is indexed.
+func (store *IndexIO) Has(hash []byte) bool {
+	err := store.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(hash)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return false
+	}
+	t_error.LogErr(err)
+	return true
+}
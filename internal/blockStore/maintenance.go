@@ -0,0 +1,202 @@
+package blockStore
+
+import (
+	"encoding/hex"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/tiereum/trmnode/internal/t_error"
+)
+
+// RepairReport counts what Repair changed.
+type RepairReport struct {
+	Relinked  int // index entries pointed at a readable copy of their record
+	Missing   int // index entries left without a readable record
+	Truncated int // files cut short at a damaged record
+}
+
+// CompactReport gives the size of the flat files before and after Compact.
+type CompactReport struct {
+	Records int
+	Before  int64
+	After   int64
+}
+
+type sequence struct {
+	prefix string
+	files  func(b *BlockIO) *FlatFiles
+}
+
+var sequences = []sequence{
+	{BLOCK_POS_PREFIX, func(b *BlockIO) *FlatFiles { return b.blocks }},
+	{UNDO_POS_PREFIX, func(b *BlockIO) *FlatFiles { return b.undo }},
+}
+
+// Repair brings the index back in line with the flat files. It scans every
+// file for intact records, points index entries whose record is unreadable
+// or belongs to another block at an intact copy, and truncates files after
+// their last intact record.
+// It must not run while a node is using the store.
+func (store *BlockStore) Repair() RepairReport {
+	report := RepairReport{}
+
+	for _, seq := range sequences {
+		files := seq.files(store.blockIO)
+		numbers, err := files.Numbers()
+		t_error.LogErr(err)
+
+		found := map[string]FilePos{}
+		for _, n := range numbers {
+			end, err := files.Scan(n, func(hash []byte, pos FilePos, data []byte) {
+				found[string(hash)] = pos
+			})
+			t_error.LogErr(err)
+			info, err := os.Stat(files.Path(n))
+			t_error.LogErr(err)
+			if end < info.Size() {
+				t_error.LogErr(files.Truncate(n, end))
+				report.Truncated++
+			}
+		}
+
+		broken := [][]byte{}
+		store.indexIO.ForEachPos(seq.prefix, func(hash []byte, pos FilePos) {
+			if _, err := files.Read(hash, pos); err != nil {
+				broken = append(broken, hash)
+			}
+		})
+		for _, hash := range broken {
+			if pos, ok := found[string(hash)]; ok {
+				store.indexIO.WritePos(seq.prefix, hash, pos)
+				report.Relinked++
+			} else {
+				store.indexIO.DeletePos(seq.prefix, hash)
+				report.Missing++
+			}
+		}
+
+		// records the index lost track of, for blocks it still knows
+		for hash, pos := range found {
+			if _, ok := store.indexIO.ReadPos(seq.prefix, []byte(hash)); !ok && store.indexIO.Has([]byte(hash)) {
+				store.indexIO.WritePos(seq.prefix, []byte(hash), pos)
+				report.Relinked++
+			}
+		}
+	}
+	return report
+}
+
+// importLegacy appends blocks stored as .data/<hash> and undo data stored
+// as .data/<hash>.undo, the layout before the flat files, to the flat files
+// and removes the old files.
+func (store *BlockStore) importLegacy() int {
+	dir := store.blockIO.ctx.DataDir
+	entries, err := os.ReadDir(dir)
+	t_error.LogErr(err)
+
+	imported := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		prefix, files := BLOCK_POS_PREFIX, store.blockIO.blocks
+		if strings.HasSuffix(name, ".undo") {
+			prefix, files = UNDO_POS_PREFIX, store.blockIO.undo
+			name = strings.TrimSuffix(name, ".undo")
+		}
+		hash, err := hex.DecodeString(name)
+		if entry.IsDir() || err != nil || len(hash) != 32 {
+			continue
+		}
+
+		p := path.Join(dir, entry.Name())
+		allBytes, err := os.ReadFile(p)
+		t_error.LogErr(err)
+		if len(allBytes) < 32 || !store.blockIO.Check(allBytes[:len(allBytes)-32], allBytes[len(allBytes)-32:]) {
+			t_error.LogWarn(CorruptBlockErr{})
+			continue
+		}
+		pos, err := files.Append(hash, allBytes[:len(allBytes)-32])
+		t_error.LogErr(err)
+		store.indexIO.WritePos(prefix, hash, pos)
+		t_error.LogErr(os.Remove(p))
+		imported++
+	}
+	return imported
+}
+
+// Compact rewrites the flat files with only the records the index points
+// at, dropping deleted blocks and duplicates. It must not run while a node
+// is using the store. If it is interrupted after the files are swapped,
+// Repair restores the index.
+func (store *BlockStore) Compact() CompactReport {
+	report := CompactReport{}
+	dir := path.Join(store.blockIO.ctx.DataDir, FLAT_FILE_DIR)
+	tmpDir := dir + ".compact"
+	oldDir := dir + ".old"
+	t_error.LogErr(os.RemoveAll(tmpDir))
+	report.Before = dirSize(dir)
+
+	compacted := new(BlockIO)
+	compacted.ctx = store.blockIO.ctx
+	compacted.open(tmpDir)
+
+	type entry struct {
+		hash []byte
+		pos  FilePos
+	}
+	moved := map[string][]entry{}
+	for _, seq := range sequences {
+		entries := []entry{}
+		store.indexIO.ForEachPos(seq.prefix, func(hash []byte, pos FilePos) {
+			entries = append(entries, entry{hash, pos})
+		})
+		// copy in file order so the new files keep the old ordering
+		sort.Slice(entries, func(i, j int) bool {
+			if entries[i].pos.File != entries[j].pos.File {
+				return entries[i].pos.File < entries[j].pos.File
+			}
+			return entries[i].pos.Offset < entries[j].pos.Offset
+		})
+
+		from, to := seq.files(store.blockIO), seq.files(compacted)
+		for i := range entries {
+			data, err := from.Read(entries[i].hash, entries[i].pos)
+			if err != nil {
+				t_error.LogWarn(err)
+				continue
+			}
+			entries[i].pos, err = to.Append(entries[i].hash, data)
+			t_error.LogErr(err)
+			moved[seq.prefix] = append(moved[seq.prefix], entries[i])
+			report.Records++
+		}
+	}
+
+	t_error.LogErr(os.Rename(dir, oldDir))
+	t_error.LogErr(os.Rename(tmpDir, dir))
+	for prefix, entries := range moved {
+		for _, e := range entries {
+			store.indexIO.WritePos(prefix, e.hash, e.pos)
+		}
+	}
+	t_error.LogErr(os.RemoveAll(oldDir))
+	store.blockIO.open(dir)
+
+	report.After = dirSize(dir)
+	return report
+}
+
+func dirSize(dir string) int64 {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
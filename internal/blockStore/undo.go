@@ -0,0 +1,100 @@
+package blockStore
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/tiereum/trmnode/internal/transaction"
+)
+
+type BAD_UNDO_ERR struct{}
+
+func (e BAD_UNDO_ERR) Error() string {
+	return "Incorrect block undo format."
+}
+
+// BlockUndo holds what is needed to disconnect a block from the UTXO set:
+// every output its transactions spent, in input order.
+type BlockUndo struct {
+	SpentCount uint32
+	Spent      []transaction.Utxo
+}
+
+// BlockUndo codec ================================== //
+
+// **** DECODER **** //
+type UndoDecoder struct {
+	undo *BlockUndo
+}
+
+func NewUndoDecoder(undo *BlockUndo) *UndoDecoder {
+	dec := new(UndoDecoder)
+	if undo == nil {
+		dec.undo = new(BlockUndo)
+	} else {
+		dec.undo = undo
+	}
+	return dec
+}
+
+func (d *UndoDecoder) Clear() {
+	d.undo = new(BlockUndo)
+}
+
+func (d *UndoDecoder) Decode(buffer *bytes.Buffer) error {
+	if buffer.Len() < 4 {
+		return BAD_UNDO_ERR{}
+	}
+	d.undo.SpentCount = binary.BigEndian.Uint32(buffer.Next(4))
+	d.undo.Spent = make([]transaction.Utxo, 0, d.undo.SpentCount)
+
+	utxoDec := transaction.NewUtxoDecoder(nil)
+	var i uint32 = 0
+	for i < d.undo.SpentCount {
+		utxoDec.Clear()
+		if err := utxoDec.Decode(buffer); err != nil {
+			return BAD_UNDO_ERR{}
+		}
+		d.undo.Spent = append(d.undo.Spent, *utxoDec.Out())
+		i++
+	}
+	return nil
+}
+
+func (d *UndoDecoder) Out() *BlockUndo {
+	return d.undo
+}
+
+// **** ENCODER **** //
+
+type UndoEncoder struct {
+	buffer *bytes.Buffer
+}
+
+func NewUndoEncoder(buffer *bytes.Buffer) *UndoEncoder {
+	enc := new(UndoEncoder)
+	if buffer == nil {
+		enc.buffer = new(bytes.Buffer)
+	} else {
+		enc.buffer = buffer
+	}
+	return enc
+}
+
+func (e *UndoEncoder) Clear() {
+	e.buffer = new(bytes.Buffer)
+}
+
+func (e *UndoEncoder) Encode(undo *BlockUndo) {
+	binary.Write(e.buffer, binary.BigEndian, uint32(len(undo.Spent)))
+	utxoEnc := transaction.NewUtxoEncoder(e.buffer)
+	for _, utxo := range undo.Spent {
+		utxoEnc.Encode(&utxo)
+	}
+}
+
+func (e *UndoEncoder) Bytes() []byte {
+	return e.buffer.Bytes()
+}
+
+// BlockUndo codec ================================== //
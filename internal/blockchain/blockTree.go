@@ -0,0 +1,150 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"math/big"
+	"slices"
+
+	"github.com/tiereum/trmnode/internal/blockStore"
+	"github.com/tiereum/trmnode/internal/t_config"
+)
+
+// BlockNode is an entry in the in-memory block tree. Every stored block has
+// one, whether it is on the main chain or on a side branch.
+type BlockNode struct {
+	Meta    *blockStore.BlockMetaData
+	Parent  *BlockNode
+	Invalid bool // failed to connect, so neither it nor its children can be the tip
+}
+
+func (node *BlockNode) Hash() []byte {
+	return node.Meta.Hash
+}
+
+func (node *BlockNode) Height() int64 {
+	return node.Meta.Height.Int64()
+}
+
+func (node *BlockNode) ChainWork() *big.Int {
+	return &node.Meta.ChainWork
+}
+
+// Ancestor walks back from node to the block at the given height.
+func (node *BlockNode) Ancestor(height int64) *BlockNode {
+	if height < 0 || height > node.Height() {
+		return nil
+	}
+	curr := node
+	for curr != nil && curr.Height() > height {
+		curr = curr.Parent
+	}
+	return curr
+}
+
+// MedianTimePast is the median timestamp of node and the blocks before it,
+// MEDIAN_TIME_SPAN blocks in total or fewer near genesis.
+func (node *BlockNode) MedianTimePast() uint32 {
+	times := make([]uint32, 0, t_config.MEDIAN_TIME_SPAN)
+	for curr := node; curr != nil && len(times) < t_config.MEDIAN_TIME_SPAN; curr = curr.Parent {
+		times = append(times, curr.Meta.TimeStamp)
+	}
+	slices.Sort(times)
+	return times[len(times)/2]
+}
+
+type BlockTree struct {
+	nodes map[string]*BlockNode
+	tips  map[string]*BlockNode // candidate tips, nodes without valid children
+}
+
+func NewBlockTree() *BlockTree {
+	return &BlockTree{
+		nodes: make(map[string]*BlockNode),
+		tips:  make(map[string]*BlockNode),
+	}
+}
+
+// Load rebuilds the tree from the block index.
+func (tree *BlockTree) Load(store *blockStore.BlockStore) {
+	store.ForEachMeta(func(meta *blockStore.BlockMetaData) {
+		tree.nodes[hex.EncodeToString(meta.Hash)] = &BlockNode{Meta: meta}
+	})
+	for key, node := range tree.nodes {
+		tree.tips[key] = node
+	}
+	for _, node := range tree.nodes {
+		if len(node.Meta.PrevHash) > 0 {
+			node.Parent = tree.Find(node.Meta.PrevHash)
+		}
+		if node.Parent != nil {
+			delete(tree.tips, hex.EncodeToString(node.Parent.Hash()))
+		}
+	}
+}
+
+func (tree *BlockTree) Find(hash []byte) *BlockNode {
+	return tree.nodes[hex.EncodeToString(hash)]
+}
+
+func (tree *BlockTree) Insert(meta *blockStore.BlockMetaData) *BlockNode {
+	node := &BlockNode{Meta: meta, Parent: tree.Find(meta.PrevHash)}
+	tree.nodes[hex.EncodeToString(meta.Hash)] = node
+	tree.tips[hex.EncodeToString(meta.Hash)] = node
+	if node.Parent != nil {
+		delete(tree.tips, hex.EncodeToString(node.Parent.Hash()))
+	}
+	return node
+}
+
+// MarkInvalid excludes node and its descendants from tip selection. Its
+// parent becomes a candidate tip again.
+func (tree *BlockTree) MarkInvalid(node *BlockNode) {
+	node.Invalid = true
+	if node.Parent != nil && !node.Parent.Invalid {
+		tree.tips[hex.EncodeToString(node.Parent.Hash())] = node.Parent
+	}
+}
+
+// BestTip returns the valid candidate tip with the most cumulative work.
+// mainTip wins ties, so the chain never moves to a branch with no more
+// work. Branches are only walked back as far as the current main chain,
+// whose blocks are known to be valid.
+func (tree *BlockTree) BestTip(mainTip *BlockNode) *BlockNode {
+	var best *BlockNode
+	if mainTip != nil && !mainTip.Invalid {
+		best = mainTip
+	}
+	for _, tip := range tree.tips {
+		if best != nil && tip.ChainWork().Cmp(best.ChainWork()) != 1 {
+			continue
+		}
+		valid := true
+		for curr := tip; curr != nil; curr = curr.Parent {
+			if curr.Invalid {
+				valid = false
+				break
+			}
+			if mainTip != nil && mainTip.Ancestor(curr.Height()) == curr {
+				break
+			}
+		}
+		if valid {
+			best = tip
+		}
+	}
+	return best
+}
+
+// FindFork returns the last block shared by the branches ending at a and b.
+func FindFork(a, b *BlockNode) *BlockNode {
+	if a.Height() > b.Height() {
+		a = a.Ancestor(b.Height())
+	} else {
+		b = b.Ancestor(a.Height())
+	}
+	for a != nil && b != nil && a != b {
+		a = a.Parent
+		b = b.Parent
+	}
+	return a
+}
@@ -0,0 +1,57 @@
+package blockchain
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/tiereum/trmnode/internal/blockStore"
+)
+
+// insert adds a block named name on top of parent, with work added to the
+// parent's chainwork.
+func insert(tree *BlockTree, name string, parent *BlockNode, work int64) *BlockNode {
+	meta := &blockStore.BlockMetaData{Hash: []byte(name)}
+	meta.ChainWork.SetInt64(work)
+	if parent != nil {
+		meta.PrevHash = parent.Hash()
+		meta.Height.Add(&parent.Meta.Height, big.NewInt(1))
+		meta.ChainWork.Add(&meta.ChainWork, parent.ChainWork())
+	}
+	return tree.Insert(meta)
+}
+
+func TestBestTipPicksMostWork(t *testing.T) {
+	tree := NewBlockTree()
+	genesis := insert(tree, "g", nil, 1)
+	a1 := insert(tree, "a1", genesis, 1)
+	b1 := insert(tree, "b1", genesis, 1)
+	b2 := insert(tree, "b2", b1, 1)
+
+	if best := tree.BestTip(a1); best != b2 {
+		t.Errorf("got %s, want b2", best.Hash())
+	}
+	tree.MarkInvalid(b2)
+	if best := tree.BestTip(a1); best != a1 {
+		t.Errorf("got %s after b2 is invalid, want a1", best.Hash())
+	}
+}
+
+// Between branches with equal work the current tip stays, whatever order
+// the tips map is walked in.
+func TestBestTipKeepsTipOnEqualWork(t *testing.T) {
+	tree := NewBlockTree()
+	genesis := insert(tree, "g", nil, 1)
+	a1 := insert(tree, "a1", genesis, 1)
+	b1 := insert(tree, "b1", genesis, 1)
+	a2 := insert(tree, "a2", a1, 2)
+	b2 := insert(tree, "b2", b1, 2)
+
+	for i := 0; i < 20; i++ {
+		if best := tree.BestTip(a2); best != a2 {
+			t.Fatalf("got %s with a2 as tip, want a2", best.Hash())
+		}
+		if best := tree.BestTip(b2); best != b2 {
+			t.Fatalf("got %s with b2 as tip, want b2", best.Hash())
+		}
+	}
+}
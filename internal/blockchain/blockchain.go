@@ -1,72 +1,130 @@
 package blockchain
 
 import (
-	"errors"
 	"math/big"
 
 	"github.com/tiereum/trmnode/internal/block"
 	"github.com/tiereum/trmnode/internal/blockStore"
+	"github.com/tiereum/trmnode/internal/blockchain/proof"
+	"github.com/tiereum/trmnode/internal/mempool"
 	"github.com/tiereum/trmnode/internal/t_config"
 	"github.com/tiereum/trmnode/internal/t_error"
 	"github.com/tiereum/trmnode/internal/transaction"
 	"github.com/tiereum/trmnode/internal/utxoSet"
 )
 
+type ERR_ORPHAN_BLOCK struct{}
+
+func (err ERR_ORPHAN_BLOCK) Error() string {
+	return "Parent block is unknown."
+}
+
+var ErrOrphanBlock ERR_ORPHAN_BLOCK = ERR_ORPHAN_BLOCK{}
+
 type Blockchain struct {
 	ctx        *t_config.Context
 	blockStore *blockStore.BlockStore
-	lastMeta   *blockStore.BlockMetaData
-	iter       *BlockchainIterator
-}
-
-func NewBlockchain(ctx *t_config.Context, store *blockStore.BlockStore) *Blockchain {
+	utxoStore  *utxoSet.UtxoStore
+	txIndex    *transaction.TxIndexIO
+	mempool    *mempool.MempoolIO
+	tree       *BlockTree
+	tip        *BlockNode
+	checker    BlockChecker // nil while recovering, see SetBlockChecker
+}
+
+func NewBlockchain(
+	ctx *t_config.Context,
+	store *blockStore.BlockStore,
+	utxoStore *utxoSet.UtxoStore,
+	txIndex *transaction.TxIndexIO,
+	mempool *mempool.MempoolIO,
+) *Blockchain {
 
 	b := new(Blockchain)
 	b.ctx = ctx
 	b.blockStore = store
+	b.utxoStore = utxoStore
+	b.txIndex = txIndex
+	b.mempool = mempool
+	b.tree = NewBlockTree()
+	b.tree.Load(store)
 	_, meta, err := b.blockStore.ReadLast()
 	if err == blockStore.ErrNoBlocksRemaining {
-		b.lastMeta = nil
+		b.tip = nil
 	} else {
-		b.lastMeta = meta
+		b.tip = b.tree.Find(meta.Hash)
+		b.indexHeights()
+		t_error.LogErr(b.recoverUtxoSet())
 	}
-	b.iter = NewBlockchainIterator(b.blockStore)
 	return b
 }
 
+// Iterator walks the main chain from the tip back to genesis.
 func (blockchain *Blockchain) Iterator() *BlockchainIterator {
-	return blockchain.iter
+	return NewBlockchainIterator(blockchain.blockStore)
 }
 
 func (blockchain *Blockchain) AddGenesis(block *block.Block) {
 
 	metadata := blockStore.BlockMetaData{
-		Hash:   block.Hash(),
-		Height: *big.NewInt(0),
-		Nonce:  block.Header.Nonce,
+		Hash:      block.Hash(),
+		Height:    *big.NewInt(0),
+		Nonce:     block.Header.Nonce,
+		TimeStamp: block.Header.TimeStamp,
+		Bits:      block.Header.Bits,
+		ChainWork: *proof.Work(block.Header.Bits),
 	}
 	blockchain.blockStore.Write(block, &metadata)
-	blockchain.lastMeta = &metadata
+	node := blockchain.tree.Insert(&metadata)
+	t_error.LogErr(blockchain.connectBlock(node))
+	blockchain.setTip(node)
+}
+
+// AddBlock stores block as a child of its parent in the block tree. The
+// block only becomes the tip if its branch carries more work than the
+// current main chain, in which case the chain is reorganized onto it.
+func (blockchain *Blockchain) AddBlock(block *block.Block) error {
+	hash := block.Hash()
+	if blockchain.tree.Find(hash) != nil {
+		return nil
+	}
+	parent := blockchain.tree.Find(block.Header.PrevHash)
+	if parent == nil {
+		return ErrOrphanBlock
+	}
+
+	metadata := headerMeta(&block.Header, parent)
+	blockchain.blockStore.Write(block, metadata)
+	blockchain.tree.Insert(metadata)
+
+	return blockchain.activateBestChain()
 }
 
-func (blockchain *Blockchain) AddBlock(block *block.Block) {
-	var currHeight *big.Int
-	if blockchain.lastMeta == nil {
-		currHeight = big.NewInt(0)
-	} else {
-		currHeight = &blockchain.lastMeta.Height
+func headerMeta(header *block.Header, parent *BlockNode) *blockStore.BlockMetaData {
+	height := new(big.Int).Add(&parent.Meta.Height, big.NewInt(1))
+	work := new(big.Int).Add(parent.ChainWork(), proof.Work(header.Bits))
+
+	return &blockStore.BlockMetaData{
+		Hash:      header.Hash(),
+		PrevHash:  header.PrevHash,
+		Height:    *height,
+		Nonce:     header.Nonce,
+		TimeStamp: header.TimeStamp,
+		Bits:      header.Bits,
+		ChainWork: *work,
 	}
+}
 
-	sum := big.Int{}
-	sum.Add(currHeight, big.NewInt(1))
+// NewHeaderNode returns a node for header that is not part of the block
+// tree. It lets a chain of headers be validated before any of their
+// blocks are downloaded.
+func NewHeaderNode(header *block.Header, parent *BlockNode) *BlockNode {
+	return &BlockNode{Meta: headerMeta(header, parent), Parent: parent}
+}
 
-	metadata := blockStore.BlockMetaData{
-		Hash:   block.Hash(),
-		Height: sum,
-		Nonce:  block.Header.Nonce,
-	}
-	blockchain.blockStore.Write(block, &metadata)
-	blockchain.lastMeta = &metadata
+func (blockchain *Blockchain) setTip(node *BlockNode) {
+	blockchain.blockStore.WriteLast(node.Hash())
+	blockchain.tip = node
 }
 
 func (blockchain *Blockchain) Block(hash []byte) (*block.Block, *blockStore.BlockMetaData) {
@@ -74,27 +132,64 @@ func (blockchain *Blockchain) Block(hash []byte) (*block.Block, *blockStore.Bloc
 }
 
 func (blockchain *Blockchain) LastMeta() *blockStore.BlockMetaData {
-	return blockchain.lastMeta
+	if blockchain.tip == nil {
+		return nil
+	}
+	return blockchain.tip.Meta
+}
+
+// Tip returns the last block of the chain with the most cumulative work.
+func (blockchain *Blockchain) Tip() *BlockNode {
+	return blockchain.tip
+}
+
+func (blockchain *Blockchain) Node(hash []byte) *BlockNode {
+	return blockchain.tree.Find(hash)
+}
+
+func (blockchain *Blockchain) IsOnMainChain(hash []byte) bool {
+	node := blockchain.tree.Find(hash)
+	if node == nil || blockchain.tip == nil {
+		return false
+	}
+	return blockchain.tip.Ancestor(node.Height()) == node
+}
+
+// Ancestor returns the block at height on the branch ending at hash.
+func (blockchain *Blockchain) Ancestor(hash []byte, height int64) *BlockNode {
+	node := blockchain.tree.Find(hash)
+	if node == nil {
+		return nil
+	}
+	return node.Ancestor(height)
+}
+
+// View returns a UtxoView on the UTXO set, for staging txs without writing
+// them.
+func (blockchain *Blockchain) View() *utxoSet.UtxoView {
+	return utxoSet.NewUtxoView(blockchain.utxoStore)
 }
 
 func (blockchain *Blockchain) FindUTXO(outpt *transaction.OutPoint) (*transaction.Utxo, error) {
 
-	store := utxoSet.NewUtxoStore(blockchain.ctx)
-	defer store.Close()
-	utxo, ok := store.Read(outpt) // handle error
+	utxo, ok := blockchain.utxoStore.Read(outpt)
 	if !ok {
-		return nil, errors.New("key doesn't exit")
+		return nil, ErrMissingInput
 	}
 	return utxo, nil
 }
 
-func (blockchain *Blockchain) GetFee(tx *transaction.Tx) int64 {
+// GetFee is what tx's inputs hold beyond its outputs. It fails with
+// ErrMissingInput if an input is not in the UTXO set.
+func (blockchain *Blockchain) GetFee(tx *transaction.Tx) (int64, error) {
 	var sumIn int64 = 0
 	var sumOut int64 = 0
 
 	for _, in := range tx.Inputs {
 		utxo, err := blockchain.FindUTXO(&in.PrevOutpt)
-		t_error.LogErr(err)
+		if err != nil {
+			return 0, err
+		}
 		sumIn += utxo.Value
 	}
 
@@ -102,7 +197,7 @@ func (blockchain *Blockchain) GetFee(tx *transaction.Tx) int64 {
 		sumOut += out.Value
 	}
 
-	return sumOut - sumIn
+	return sumIn - sumOut, nil
 }
 
 type BlockchainIterator struct {
@@ -137,7 +232,7 @@ func (iter *BlockchainIterator) Next() {
 		iter.valid = true
 		return
 	} else if iter.valid {
-		if len(iter.block.Header.PrevHash) > 0 {
+		if iter.metadata.Height.Sign() > 0 {
 			iter.block, iter.metadata = iter.store.Read(iter.block.Header.PrevHash)
 		} else {
 			iter.valid = false
@@ -156,5 +251,5 @@ func (iter *BlockchainIterator) Metadata() *blockStore.BlockMetaData {
 }
 
 func (blockchain *Blockchain) Height() big.Int {
-	return blockchain.lastMeta.Height
+	return blockchain.tip.Meta.Height
 }
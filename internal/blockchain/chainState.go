@@ -0,0 +1,223 @@
+package blockchain
+
+import (
+	"errors"
+
+	"github.com/tiereum/trmnode/internal/block"
+	"github.com/tiereum/trmnode/internal/blockStore"
+	"github.com/tiereum/trmnode/internal/t_error"
+	"github.com/tiereum/trmnode/internal/transaction"
+	"github.com/tiereum/trmnode/internal/utxoSet"
+)
+
+type ERR_MISSING_INPUT struct{}
+
+func (err ERR_MISSING_INPUT) Error() string {
+	return "Block spends an output that is not in the UTXO set."
+}
+
+var ErrMissingInput ERR_MISSING_INPUT = ERR_MISSING_INPUT{}
+
+type ERR_NO_FORK struct{}
+
+func (err ERR_NO_FORK) Error() string {
+	return "Branch does not share a block with the main chain."
+}
+
+// ERR_DISCONNECT means a main chain block could not be undone, so the tip
+// cannot move off it.
+type ERR_DISCONNECT struct {
+	Cause error
+}
+
+func (err ERR_DISCONNECT) Error() string {
+	return "Cannot disconnect the tip: " + err.Cause.Error()
+}
+
+func (err ERR_DISCONNECT) Unwrap() error {
+	return err.Cause
+}
+
+// BlockChecker checks the rules a block's transactions are held to against
+// the UTXO set. connectBlock calls it while the set is at the block's
+// parent, so a block is judged by the state it actually builds on.
+type BlockChecker func(b *block.Block) error
+
+// SetBlockChecker makes every block connected from now on pass check.
+func (blockchain *Blockchain) SetBlockChecker(check BlockChecker) {
+	blockchain.checker = check
+}
+
+// ActivateBestChain moves the tip to the best valid branch. The node calls
+// it at startup once a BlockChecker is set, so stored branches are only
+// activated after full validation.
+func (blockchain *Blockchain) ActivateBestChain() error {
+	if blockchain.tip == nil {
+		return nil
+	}
+	return blockchain.activateBestChain()
+}
+
+// activateBestChain moves the tip to the valid branch with the most work,
+// disconnecting and connecting blocks as needed. Branches that fail to
+// connect are marked invalid and the next best one is tried.
+func (blockchain *Blockchain) activateBestChain() error {
+	var lastErr error
+	for {
+		best := blockchain.tree.BestTip(blockchain.tip)
+		if best == nil || best == blockchain.tip {
+			return lastErr
+		}
+		if err := blockchain.reorganize(best); err != nil {
+			t_error.LogWarn(err)
+			if errors.As(err, &ERR_DISCONNECT{}) {
+				return err
+			}
+			lastErr = err
+		}
+	}
+}
+
+func (blockchain *Blockchain) reorganize(target *BlockNode) error {
+	fork := FindFork(blockchain.tip, target)
+	if fork == nil {
+		blockchain.tree.MarkInvalid(target)
+		return ERR_NO_FORK{}
+	}
+
+	disconnected := []*block.Block{}
+	for blockchain.tip != fork {
+		b, err := blockchain.disconnectBlock(blockchain.tip)
+		if err != nil {
+			blockchain.returnToMempool(disconnected)
+			return ERR_DISCONNECT{err}
+		}
+		disconnected = append(disconnected, b)
+		blockchain.setTip(blockchain.tip.Parent)
+	}
+
+	path := []*BlockNode{}
+	for curr := target; curr != fork; curr = curr.Parent {
+		path = append(path, curr)
+	}
+	var err error
+	for i := len(path) - 1; i >= 0; i-- {
+		// BestTip skips every branch through an invalid block, so this
+		// rules out the block's descendants too
+		if err = blockchain.connectBlock(path[i]); err != nil {
+			blockchain.tree.MarkInvalid(path[i])
+			break
+		}
+		blockchain.setTip(path[i])
+	}
+
+	blockchain.returnToMempool(disconnected)
+	return err
+}
+
+// connectBlock checks the block with the BlockChecker, then spends its
+// inputs, adds its outputs and indexes its transactions. The spent outputs
+// are saved as undo data first. The UTXO
+// set is updated in one transaction that also moves its best block marker,
+// which is the point the block counts as connected; everything written
+// after it is redone by recoverUtxoSet if the node stops in between.
+func (blockchain *Blockchain) connectBlock(node *BlockNode) error {
+	b, _ := blockchain.blockStore.Read(node.Hash())
+	if b == nil {
+		return blockStore.ErrBlockNotStored
+	}
+	if blockchain.checker != nil && node.Parent != nil {
+		if err := blockchain.checker(b); err != nil {
+			return err
+		}
+	}
+	view := utxoSet.NewUtxoView(blockchain.utxoStore)
+	undo := blockStore.BlockUndo{}
+
+	for i := range b.Transactions {
+		spent, ok := view.ConnectTx(&b.Transactions[i], node.Height())
+		if !ok {
+			return ErrMissingInput
+		}
+		undo.Spent = append(undo.Spent, spent...)
+	}
+
+	undo.SpentCount = uint32(len(undo.Spent))
+	if err := blockchain.blockStore.WriteUndo(&undo, node.Hash()); err != nil {
+		return err
+	}
+	if err := view.Flush(node.Hash()); err != nil {
+		return err
+	}
+
+	for i, tx := range b.Transactions {
+		txHash := tx.Hash()
+		blockchain.txIndex.Create(txHash, &transaction.TxMetadata{
+			BlockHash:   node.Hash(),
+			BlockHeight: node.Meta.Height,
+			Index:       uint8(i),
+		})
+		if blockchain.mempool.Exists(txHash) {
+			blockchain.mempool.Delete(txHash)
+		}
+	}
+	blockchain.blockStore.WriteHeight(node.Height(), node.Hash())
+	return nil
+}
+
+// disconnectBlock reverts connectBlock using the block's undo data.
+func (blockchain *Blockchain) disconnectBlock(node *BlockNode) (*block.Block, error) {
+	b, _ := blockchain.blockStore.Read(node.Hash())
+	if b == nil {
+		return nil, blockStore.ErrBlockNotStored
+	}
+	undo, err := blockchain.blockStore.ReadUndo(node.Hash())
+	if err != nil {
+		return nil, err
+	}
+	view := utxoSet.NewUtxoView(blockchain.utxoStore)
+
+	spentIdx := len(undo.Spent)
+	for i := len(b.Transactions) - 1; i >= 0; i-- {
+		tx := b.Transactions[i]
+		txHash := tx.Hash()
+		for idx := range tx.Outputs {
+			view.Spend(&transaction.OutPoint{TxId: txHash, Idx: int32(idx)})
+		}
+		if !tx.IsCoinbase() {
+			for range tx.Inputs {
+				spentIdx--
+				view.Add(&undo.Spent[spentIdx])
+			}
+		}
+	}
+	if err := view.Flush(node.Parent.Hash()); err != nil {
+		return nil, err
+	}
+
+	for _, tx := range b.Transactions {
+		blockchain.txIndex.Delete(tx.Hash())
+	}
+	blockchain.blockStore.DeleteHeight(node.Height())
+	return b, nil
+}
+
+// returnToMempool puts transactions from disconnected blocks back into the
+// mempool unless the new branch included them or spent their inputs.
+func (blockchain *Blockchain) returnToMempool(disconnected []*block.Block) {
+	for _, b := range disconnected {
+		for _, tx := range b.Transactions {
+			if tx.IsCoinbase() {
+				continue
+			}
+			txHash := tx.Hash()
+			if blockchain.txIndex.Has(txHash) || blockchain.mempool.Exists(txHash) {
+				continue
+			}
+			// an input missing from the UTXO set was spent by the new branch
+			if fee, err := blockchain.GetFee(&tx); err == nil {
+				blockchain.mempool.Write(txHash, &tx, fee)
+			}
+		}
+	}
+}
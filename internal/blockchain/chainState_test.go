@@ -0,0 +1,223 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/tiereum/trmnode/internal/block"
+	"github.com/tiereum/trmnode/internal/blockStore"
+	"github.com/tiereum/trmnode/internal/mempool"
+	"github.com/tiereum/trmnode/internal/t_config"
+	"github.com/tiereum/trmnode/internal/transaction"
+	"github.com/tiereum/trmnode/internal/utxoSet"
+)
+
+// testChain is a Blockchain on stores in a temporary TERIUM_ROOT.
+type testChain struct {
+	*Blockchain
+	ctx *t_config.Context
+}
+
+func newTestChain(t *testing.T) *testChain {
+	t.Setenv("TERIUM_ROOT", t.TempDir())
+	chain := &testChain{ctx: t_config.NewContext()}
+	// the mempool schema is read relative to the repository root
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("../.."); err != nil {
+		t.Fatal(err)
+	}
+	pool := mempool.NewMempoolIO(chain.ctx)
+	if err := os.Chdir(wd); err != nil {
+		t.Fatal(err)
+	}
+	chain.open(pool)
+	t.Cleanup(chain.close)
+	return chain
+}
+
+// open loads the chain from the stores, recovering the UTXO set as the
+// node does on start.
+func (chain *testChain) open(pool *mempool.MempoolIO) {
+	chain.Blockchain = NewBlockchain(
+		chain.ctx,
+		blockStore.NewBlockStore(chain.ctx),
+		utxoSet.NewUtxoStore(chain.ctx),
+		transaction.NewTxIndexIO(chain.ctx),
+		pool,
+	)
+}
+
+func (chain *testChain) close() {
+	chain.blockStore.Close()
+	chain.utxoStore.Close()
+	chain.txIndex.Close()
+}
+
+// reopen closes the stores and loads the chain from them again.
+func (chain *testChain) reopen() {
+	chain.close()
+	chain.open(chain.mempool)
+}
+
+// coinbaseTx pays the subsidy at height. tag tells apart coinbases of
+// sibling blocks.
+func coinbaseTx(height int64, tag byte) transaction.Tx {
+	script := transaction.CoinbaseScript(height, []byte{tag})
+	return transaction.Tx{
+		Version:    t_config.Version,
+		NumInputs:  1,
+		Inputs:     []transaction.TxIn{transaction.Coinbase(transaction.NewCompactSize(int64(len(script))), script)},
+		NumOutputs: 1,
+		Outputs:    []transaction.TxOut{lockedOut(Subsidy(height))},
+	}
+}
+
+func lockedOut(value int64) transaction.TxOut {
+	script := []byte{byte(transaction.OP_1)}
+	return transaction.TxOut{
+		Value:             value,
+		LockingScriptSize: transaction.NewCompactSize(int64(len(script))),
+		LockingScript:     script,
+	}
+}
+
+// spendTx spends output 0 of prev, paying fee.
+func spendTx(prev *transaction.Tx, fee int64) transaction.Tx {
+	return transaction.Tx{
+		Version:   t_config.Version,
+		NumInputs: 1,
+		Inputs: []transaction.TxIn{{
+			PrevOutpt:           transaction.OutPoint{TxId: prev.Hash(), Idx: 0},
+			UnlockingScriptSize: transaction.NewCompactSize(0),
+			Sequence:            transaction.SEQUENCE_FINAL,
+		}},
+		NumOutputs: 1,
+		Outputs:    []transaction.TxOut{lockedOut(prev.Outputs[0].Value - fee)},
+	}
+}
+
+// addBlock adds a block on parent holding a coinbase tagged tag and txs.
+// Blocks are not checked, so their headers need no proof of work.
+func (chain *testChain) addBlock(t *testing.T, parent *BlockNode, tag byte, txs ...transaction.Tx) (*BlockNode, error) {
+	t.Helper()
+	b := &block.Block{
+		Header: block.Header{
+			Version:   t_config.Version,
+			TimeStamp: parent.Meta.TimeStamp + 60,
+			Bits:      t_config.NBits,
+		},
+		Transactions: append([]transaction.Tx{coinbaseTx(parent.Height()+1, tag)}, txs...),
+	}
+	b.TXCount = uint32(len(b.Transactions))
+	b.Header.PrevHash = parent.Hash()
+	b.Header.MerkleRootHash = b.MerkelRoot()
+	err := chain.AddBlock(b)
+	node := chain.tree.Find(b.Hash())
+	if node == nil {
+		t.Fatalf("block %c was not stored", tag)
+	}
+	return node, err
+}
+
+func (chain *testChain) genesis() *BlockNode {
+	b := &block.Block{
+		Header:       block.Header{Version: t_config.Version, PrevHash: make([]byte, 32), TimeStamp: 1_700_000_000, Bits: t_config.NBits},
+		TXCount:      1,
+		Transactions: []transaction.Tx{coinbaseTx(0, 'g')},
+	}
+	b.Header.MerkleRootHash = b.MerkelRoot()
+	chain.AddGenesis(b)
+	return chain.tip
+}
+
+// assertCoinbases checks which of the blocks' coinbase outputs are in the
+// UTXO set.
+func (chain *testChain) assertCoinbases(t *testing.T, unspent bool, nodes ...*BlockNode) {
+	t.Helper()
+	for _, node := range nodes {
+		b, _ := chain.blockStore.Read(node.Hash())
+		pt := transaction.OutPoint{TxId: b.Transactions[0].Hash(), Idx: 0}
+		if _, ok := chain.utxoStore.Read(&pt); ok != unspent {
+			t.Errorf("coinbase of %x unspent is %v, want %v", node.Hash(), ok, unspent)
+		}
+	}
+}
+
+func (chain *testChain) assertTip(t *testing.T, want *BlockNode) {
+	t.Helper()
+	if chain.tip != want {
+		t.Fatalf("tip is %x, want %x", chain.tip.Hash(), want.Hash())
+	}
+	if best, _ := chain.utxoStore.BestBlock(); !bytes.Equal(best, want.Hash()) {
+		t.Errorf("UTXO set is at %x, want %x", best, want.Hash())
+	}
+	for curr := want; curr != nil; curr = curr.Parent {
+		if hash, _ := chain.blockStore.HashAtHeight(curr.Height()); !bytes.Equal(hash, curr.Hash()) {
+			t.Errorf("height %d indexes %x, want %x", curr.Height(), hash, curr.Hash())
+		}
+	}
+}
+
+func TestReorgToHeavierBranch(t *testing.T) {
+	chain := newTestChain(t)
+	genesis := chain.genesis()
+	gb, _ := chain.blockStore.Read(genesis.Hash())
+	spend := spendTx(&gb.Transactions[0], 10)
+
+	a1, _ := chain.addBlock(t, genesis, 'a', spend)
+	chain.assertTip(t, a1)
+	b1, _ := chain.addBlock(t, genesis, 'b')
+	chain.assertTip(t, a1)
+
+	b2, err := chain.addBlock(t, b1, 'b')
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.assertTip(t, b2)
+	chain.assertCoinbases(t, false, a1)
+	chain.assertCoinbases(t, true, genesis, b1, b2)
+	if chain.txIndex.Has(spend.Hash()) {
+		t.Error("tx of the disconnected block is still indexed")
+	}
+	if !chain.mempool.Exists(spend.Hash()) {
+		t.Error("tx of the disconnected block was not returned to the mempool")
+	}
+}
+
+// A branch that fails to connect part way is marked invalid and the chain
+// goes back to the heaviest valid branch.
+func TestReorgRollsBackFailedConnect(t *testing.T) {
+	chain := newTestChain(t)
+	genesis := chain.genesis()
+	a1, _ := chain.addBlock(t, genesis, 'a')
+	a2, _ := chain.addBlock(t, a1, 'a')
+	a3, _ := chain.addBlock(t, a2, 'a')
+
+	// b2 spends an output that never existed, which is only found when
+	// b4 makes the branch heavier and it is connected
+	b1, _ := chain.addBlock(t, genesis, 'b')
+	missing := transaction.Tx{Outputs: []transaction.TxOut{lockedOut(1)}}
+	b2, _ := chain.addBlock(t, b1, 'b', spendTx(&missing, 0))
+	b3, _ := chain.addBlock(t, b2, 'b')
+	chain.assertTip(t, a3)
+	b4, err := chain.addBlock(t, b3, 'b')
+	if !errors.Is(err, ErrMissingInput) {
+		t.Fatalf("got %v, want %v", err, ErrMissingInput)
+	}
+
+	if !b2.Invalid {
+		t.Error("failed block is not marked invalid")
+	}
+	chain.assertTip(t, a3)
+	chain.assertCoinbases(t, true, genesis, a1, a2, a3)
+	chain.assertCoinbases(t, false, b1)
+
+	// the branch stays out however much work is built on it
+	chain.addBlock(t, b4, 'b')
+	chain.assertTip(t, a3)
+}
@@ -0,0 +1,39 @@
+package blockchain
+
+import (
+	"math/big"
+
+	"github.com/tiereum/trmnode/internal/blockchain/proof"
+	"github.com/tiereum/trmnode/internal/t_config"
+)
+
+// NextBits returns the target a block built on parent must carry. The
+// target only changes on multiples of RETARGET_INTERVAL, where it is scaled
+// by how long the previous window actually took compared to the expected
+// TARGET_BLOCK_TIME per block. A single step is limited to a factor of four
+// and the target never exceeds the genesis target.
+func (blockchain *Blockchain) NextBits(parent *BlockNode) uint32 {
+	if parent == nil {
+		return t_config.NBits
+	}
+	nextHeight := parent.Height() + 1
+	if nextHeight%t_config.RETARGET_INTERVAL != 0 {
+		return parent.Meta.Bits
+	}
+
+	first := parent.Ancestor(max(0, nextHeight-1-t_config.RETARGET_INTERVAL))
+	gaps := parent.Height() - first.Height()
+	expected := gaps * t_config.TARGET_BLOCK_TIME
+	actual := int64(parent.Meta.TimeStamp) - int64(first.Meta.TimeStamp)
+	actual = min(max(actual, expected/4), expected*4)
+
+	target := proof.CompactToBig(parent.Meta.Bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+
+	limit := proof.CompactToBig(t_config.NBits)
+	if target.Cmp(limit) == 1 {
+		target = limit
+	}
+	return proof.BigToCompact(target)
+}
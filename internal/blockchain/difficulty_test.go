@@ -0,0 +1,58 @@
+package blockchain
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/tiereum/trmnode/internal/blockStore"
+	"github.com/tiereum/trmnode/internal/t_config"
+)
+
+// retargetWindow links count blocks carrying bits, spacing seconds apart,
+// and returns the last.
+func retargetWindow(count int64, bits uint32, spacing uint32) *BlockNode {
+	var node *BlockNode
+	for i := int64(0); i < count; i++ {
+		meta := &blockStore.BlockMetaData{
+			Height:    *big.NewInt(i),
+			Bits:      bits,
+			TimeStamp: 1_700_000_000 + uint32(i)*spacing,
+		}
+		node = &BlockNode{Meta: meta, Parent: node}
+	}
+	return node
+}
+
+func TestNextBits(t *testing.T) {
+	const bits uint32 = 0x1d00ffff
+	spacing := uint32(t_config.TARGET_BLOCK_TIME)
+	tests := []struct {
+		name    string
+		count   int64
+		bits    uint32
+		spacing uint32
+		want    uint32
+	}{
+		{"between retargets", t_config.RETARGET_INTERVAL - 5, bits, 1, bits},
+		{"on schedule", t_config.RETARGET_INTERVAL, bits, spacing, bits},
+		{"twice as fast", t_config.RETARGET_INTERVAL, bits, spacing / 2, 0x1c7fff80},
+		{"slower", t_config.RETARGET_INTERVAL, bits, spacing * 3 / 2, 0x1d017ffe},
+		{"at quarter", t_config.RETARGET_INTERVAL, bits, spacing / 4, 0x1c3fffc0},
+		{"clamped to quarter", t_config.RETARGET_INTERVAL, bits, 1, 0x1c3fffc0},
+		{"at four times", t_config.RETARGET_INTERVAL, bits, spacing * 4, 0x1d03fffc},
+		{"clamped to four times", t_config.RETARGET_INTERVAL, bits, spacing * 100, 0x1d03fffc},
+		// the target never gets easier than the genesis target
+		{"capped at genesis", t_config.RETARGET_INTERVAL, t_config.NBits, spacing * 4, t_config.NBits},
+	}
+	chain := new(Blockchain)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := chain.NextBits(retargetWindow(tc.count, tc.bits, tc.spacing)); got != tc.want {
+				t.Errorf("got %08x, want %08x", got, tc.want)
+			}
+		})
+	}
+	if got := chain.NextBits(nil); got != t_config.NBits {
+		t.Errorf("genesis gets %08x, want %08x", got, t_config.NBits)
+	}
+}
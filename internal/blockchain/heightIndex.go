@@ -0,0 +1,102 @@
+package blockchain
+
+import (
+	"bytes"
+
+	"github.com/tiereum/trmnode/internal/block"
+	"github.com/tiereum/trmnode/internal/blockStore"
+)
+
+// indexHeights fills in the height index from the block tree for main
+// chain blocks that are missing from it, as in a data dir written before
+// the index existed.
+func (blockchain *Blockchain) indexHeights() {
+	for node := blockchain.tip; node != nil; node = node.Parent {
+		hash, ok := blockchain.blockStore.HashAtHeight(node.Height())
+		if ok && bytes.Equal(hash, node.Hash()) {
+			return
+		}
+		blockchain.blockStore.WriteHeight(node.Height(), node.Hash())
+	}
+}
+
+// HashAtHeight returns the hash of the main chain block at height.
+func (blockchain *Blockchain) HashAtHeight(height int64) ([]byte, bool) {
+	if blockchain.tip == nil || height < 0 || height > blockchain.tip.Height() {
+		return nil, false
+	}
+	return blockchain.blockStore.HashAtHeight(height)
+}
+
+// BlockAtHeight reads the main chain block at height, or returns nil when
+// the chain is shorter.
+func (blockchain *Blockchain) BlockAtHeight(height int64) (*block.Block, *blockStore.BlockMetaData) {
+	hash, ok := blockchain.HashAtHeight(height)
+	if !ok {
+		return nil, nil
+	}
+	return blockchain.blockStore.Read(hash)
+}
+
+// HashRange returns the main chain hashes from height from up to and
+// including to, clamped to the chain.
+func (blockchain *Blockchain) HashRange(from, to int64) [][]byte {
+	hashes := [][]byte{}
+	if blockchain.tip == nil {
+		return hashes
+	}
+	from = max(from, 0)
+	to = min(to, blockchain.tip.Height())
+	blockchain.blockStore.ForEachHeight(from, to, func(height int64, hash []byte) bool {
+		hashes = append(hashes, hash)
+		return true
+	})
+	return hashes
+}
+
+// ForwardIterator walks the main chain from height towards the tip.
+func (blockchain *Blockchain) ForwardIterator(height int64) *BlockchainForwardIterator {
+	return NewBlockchainForwardIterator(blockchain, height)
+}
+
+type BlockchainForwardIterator struct {
+	valid      bool
+	height     int64
+	block      *block.Block
+	metadata   *blockStore.BlockMetaData
+	blockchain *Blockchain
+	start      bool
+}
+
+func NewBlockchainForwardIterator(blockchain *Blockchain, height int64) *BlockchainForwardIterator {
+	iter := BlockchainForwardIterator{}
+	iter.valid = false
+	iter.height = height
+	iter.blockchain = blockchain
+	iter.start = true
+	return &iter
+}
+
+func (iter *BlockchainForwardIterator) Valid() bool {
+	return iter.valid
+}
+
+func (iter *BlockchainForwardIterator) Next() {
+	if iter.start {
+		iter.start = false
+	} else if iter.valid {
+		iter.height++
+	} else {
+		return
+	}
+	iter.block, iter.metadata = iter.blockchain.BlockAtHeight(iter.height)
+	iter.valid = iter.block != nil
+}
+
+func (iter *BlockchainForwardIterator) Block() *block.Block {
+	return iter.block
+}
+
+func (iter *BlockchainForwardIterator) Metadata() *blockStore.BlockMetaData {
+	return iter.metadata
+}
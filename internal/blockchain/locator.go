@@ -0,0 +1,59 @@
+package blockchain
+
+import (
+	"bytes"
+	"slices"
+)
+
+// Locator lists hashes from node back to genesis, one per block for the
+// last ten blocks and then doubling the step each time. A peer finds the
+// fork with its own chain from the first hash it knows.
+func Locator(node *BlockNode) [][]byte {
+	hashes := make([][]byte, 0, 32)
+	var step int64 = 1
+	for node != nil {
+		hashes = append(hashes, node.Hash())
+		if node.Height() == 0 {
+			break
+		}
+		if len(hashes) >= 10 {
+			step *= 2
+		}
+		node = node.Ancestor(max(node.Height()-step, 0))
+	}
+	return hashes
+}
+
+// LocatorFork returns the first block of hashes that is on the main chain,
+// or genesis if there is none.
+func (blockchain *Blockchain) LocatorFork(hashes [][]byte) *BlockNode {
+	if blockchain.tip == nil {
+		return nil
+	}
+	for _, hash := range hashes {
+		if blockchain.IsOnMainChain(hash) {
+			return blockchain.tree.Find(hash)
+		}
+	}
+	return blockchain.tip.Ancestor(0)
+}
+
+// MainChainAfter returns up to limit main chain blocks following fork,
+// ending early at the block with hash stop.
+func (blockchain *Blockchain) MainChainAfter(fork *BlockNode, stop []byte, limit int) []*BlockNode {
+	if fork == nil || blockchain.tip == nil {
+		return nil
+	}
+	last := min(fork.Height()+int64(limit), blockchain.tip.Height())
+	nodes := make([]*BlockNode, 0, max(last-fork.Height(), 0))
+	for curr := blockchain.tip.Ancestor(last); curr != nil && curr.Height() > fork.Height(); curr = curr.Parent {
+		nodes = append(nodes, curr)
+	}
+	slices.Reverse(nodes)
+	for i, node := range nodes {
+		if bytes.Equal(node.Hash(), stop) {
+			return nodes[:i+1]
+		}
+	}
+	return nodes
+}
@@ -41,7 +41,7 @@ func (pow *PoW) Solve(block *block.Block, restart chan byte) bool {
 			block.Header.Nonce = state.Nonce
 			state.Hash = block.Hash()
 
-			if pow.Validate(block.Header.Target, state.Hash) {
+			if pow.Validate(block.Header.Bits, state.Hash) {
 				state.Solved = true
 				pow.Notifier <- state
 				return true
@@ -55,9 +55,59 @@ func (pow *PoW) Solve(block *block.Block, restart chan byte) bool {
 	return false
 }
 
-func (pow *PoW) Validate(target uint8, hash []byte) bool {
-	targetVal := new(big.Int).Lsh(big.NewInt(1), uint(255-target+1))
-	return targetVal.Cmp(new(big.Int).SetBytes(hash)) == 1
+func (pow *PoW) Validate(bits uint32, hash []byte) bool {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return false
+	}
+	return new(big.Int).SetBytes(hash).Cmp(target) <= 0
+}
+
+// CompactToBig expands a compact target. The high byte is the length of
+// the target in bytes and the low three bytes are its most significant
+// digits. Targets with the sign bit set are treated as zero.
+func CompactToBig(bits uint32) *big.Int {
+	exponent := uint(bits >> 24)
+	mantissa := int64(bits & 0x007fffff)
+	if bits&0x00800000 != 0 {
+		return new(big.Int)
+	}
+	target := big.NewInt(mantissa)
+	if exponent <= 3 {
+		return target.Rsh(target, 8*(3-exponent))
+	}
+	return target.Lsh(target, 8*(exponent-3))
+}
+
+// BigToCompact is the inverse of CompactToBig, dropping any precision
+// beyond the three most significant bytes.
+func BigToCompact(target *big.Int) uint32 {
+	if target.Sign() <= 0 {
+		return 0
+	}
+	size := uint32(len(target.Bytes()))
+	var mantissa uint32
+	if size <= 3 {
+		mantissa = uint32(target.Uint64()) << (8 * (3 - size))
+	} else {
+		mantissa = uint32(new(big.Int).Rsh(target, uint(8*(size-3))).Uint64())
+	}
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		size++
+	}
+	return size<<24 | mantissa
+}
+
+// Work returns the expected number of hashes needed to solve a header
+// with the given target, used to compare competing chains.
+func Work(bits uint32) *big.Int {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return new(big.Int)
+	}
+	space := new(big.Int).Lsh(big.NewInt(1), 256)
+	return space.Div(space, target.Add(target, big.NewInt(1)))
 }
 
 func (pow *PoW) Close() {
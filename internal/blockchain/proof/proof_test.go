@@ -0,0 +1,92 @@
+package proof
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func hexInt(s string) *big.Int {
+	n, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic(s)
+	}
+	return n
+}
+
+func TestCompactToBig(t *testing.T) {
+	tests := []struct {
+		name   string
+		bits   uint32
+		target string
+	}{
+		{"zero", 0x00000000, "0"},
+		{"genesis", 0x1f020000, "20000" + strings.Repeat("0", 56)},
+		{"short exponent", 0x01123456, "12"},
+		{"exponent three", 0x03123456, "123456"},
+		{"exponent four", 0x04123456, "12345600"},
+		// the sign bit makes the target negative, which is never met
+		{"negative", 0x04923456, "0"},
+		{"negative zero mantissa", 0x01800000, "0"},
+		// a length past 32 bytes gives a target above any hash
+		{"overflow", 0x21010000, "1" + strings.Repeat("0", 64)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := CompactToBig(tc.bits); got.Cmp(hexInt(tc.target)) != 0 {
+				t.Errorf("got %x, want %s", got, tc.target)
+			}
+		})
+	}
+}
+
+func TestBigToCompact(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		bits   uint32
+	}{
+		{"zero", "0", 0x00000000},
+		{"one byte", "12", 0x01120000},
+		{"three bytes", "123456", 0x03123456},
+		// a mantissa with its top bit set would read back as negative
+		{"sign bit", "80", 0x02008000},
+		{"sign bit long", "800000" + strings.Repeat("0", 20), 0x0e008000},
+		{"truncated", "123456789a", 0x05123456},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := BigToCompact(hexInt(tc.target)); got != tc.bits {
+				t.Errorf("got %08x, want %08x", got, tc.bits)
+			}
+		})
+	}
+	if got := BigToCompact(big.NewInt(-1)); got != 0 {
+		t.Errorf("negative target encodes to %08x, want 0", got)
+	}
+}
+
+// Every normalized encoding survives a round trip through its target.
+func TestCompactRoundTrip(t *testing.T) {
+	for _, bits := range []uint32{0x01120000, 0x02008000, 0x03123456, 0x1d00ffff, 0x1f020000, 0x207fffff} {
+		if got := BigToCompact(CompactToBig(bits)); got != bits {
+			t.Errorf("%08x round trips to %08x", bits, got)
+		}
+	}
+}
+
+func TestWork(t *testing.T) {
+	easy := Work(0x1f020000)
+	if easy.Sign() <= 0 {
+		t.Fatalf("genesis work is %v", easy)
+	}
+	// half the target takes twice the hashes
+	if hard := Work(0x1f010000); hard.Cmp(new(big.Int).Mul(easy, big.NewInt(2))) < 0 {
+		t.Errorf("half the target gives work %v, want at least %v", hard, 2*easy.Int64())
+	}
+	for _, bits := range []uint32{0x00000000, 0x04923456, 0x21010000} {
+		if work := Work(bits); work.Sign() != 0 {
+			t.Errorf("bits %08x give work %v, want 0", bits, work)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+
+	"github.com/tiereum/trmnode/internal/t_error"
+)
+
+type ERR_UNKNOWN_UTXO_BEST struct{}
+
+func (err ERR_UNKNOWN_UTXO_BEST) Error() string {
+	return "The UTXO set was written for a block that is not in the block index."
+}
+
+// recoverUtxoSet brings the UTXO set and the tx and height indexes back in
+// line with the chain tip after the node stopped part way through
+// connecting or disconnecting a block. The UTXO set's best block marker
+// says which block its state belongs to: blocks it has but the tip does not
+// are disconnected, and blocks the tip has but it does not are connected
+// again. An empty set without a marker is rebuilt from genesis.
+func (blockchain *Blockchain) recoverUtxoSet() error {
+	tip := blockchain.tip
+	if tip == nil {
+		return nil
+	}
+	best, ok := blockchain.utxoStore.BestBlock()
+	var applied *BlockNode
+	switch {
+	case ok && bytes.Equal(best, tip.Hash()):
+		return nil
+	case ok:
+		applied = blockchain.tree.Find(best)
+		if applied == nil {
+			return ERR_UNKNOWN_UTXO_BEST{}
+		}
+	case !blockchain.utxoStore.Empty():
+		// written before the marker existed, trust it to match the tip
+		blockchain.utxoStore.SetBestBlock(tip.Hash())
+		return nil
+	}
+
+	fork := (*BlockNode)(nil)
+	if applied != nil {
+		// without a shared block the disconnects would run past genesis
+		if fork = FindFork(applied, tip); fork == nil {
+			return ERR_NO_FORK{}
+		}
+		t_error.LogInfo("UTXO set is at %s, chain tip at %s, recovering", hex.EncodeToString(best), hex.EncodeToString(tip.Hash()))
+	} else {
+		t_error.LogInfo("UTXO set is empty, rebuilding it from genesis")
+	}
+	for curr := applied; curr != fork; curr = curr.Parent {
+		if _, err := blockchain.disconnectBlock(curr); err != nil {
+			return err
+		}
+	}
+	path := []*BlockNode{}
+	for curr := tip; curr != fork; curr = curr.Parent {
+		path = append(path, curr)
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		if err := blockchain.connectBlock(path[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
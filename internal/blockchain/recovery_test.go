@@ -0,0 +1,72 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tiereum/trmnode/internal/blockStore"
+)
+
+// Each case stops the node with the UTXO set and the tip marker out of
+// step, as a crash between the two writes would, and checks that the set
+// is brought back to the tip on the next start.
+func TestRecoverUtxoSet(t *testing.T) {
+	tests := []struct {
+		name string
+		// interrupt builds a chain, leaves it out of step and returns the
+		// tip the node stopped at
+		interrupt func(t *testing.T, chain *testChain) *BlockNode
+	}{
+		{"set behind tip", func(t *testing.T, chain *testChain) *BlockNode {
+			a1, _ := chain.addBlock(t, chain.genesis(), 'a')
+			a2, _ := chain.addBlock(t, a1, 'a')
+			// the tip marker stays at a2 while the set goes back to a1
+			if _, err := chain.disconnectBlock(a2); err != nil {
+				t.Fatal(err)
+			}
+			return a2
+		}},
+		{"set ahead of tip", func(t *testing.T, chain *testChain) *BlockNode {
+			a1, _ := chain.addBlock(t, chain.genesis(), 'a')
+			chain.addBlock(t, a1, 'a')
+			chain.blockStore.WriteLast(a1.Hash())
+			return a1
+		}},
+		{"set on another branch", func(t *testing.T, chain *testChain) *BlockNode {
+			genesis := chain.genesis()
+			a1, _ := chain.addBlock(t, genesis, 'a')
+			b1, _ := chain.addBlock(t, genesis, 'b')
+			chain.addBlock(t, b1, 'b')
+			chain.blockStore.WriteLast(a1.Hash())
+			return a1
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			chain := newTestChain(t)
+			tip := tc.interrupt(t, chain)
+
+			chain.reopen()
+			if !bytes.Equal(chain.tip.Hash(), tip.Hash()) {
+				t.Fatalf("tip is %x, want %x", chain.tip.Hash(), tip.Hash())
+			}
+			chain.assertTip(t, chain.tip)
+			for _, node := range chain.tree.nodes {
+				chain.assertCoinbases(t, chain.IsOnMainChain(node.Hash()), node)
+			}
+		})
+	}
+}
+
+// A set written for a block that shares no history with the tip cannot be
+// undone block by block.
+func TestRecoverRejectsUnrelatedUtxoSet(t *testing.T) {
+	chain := newTestChain(t)
+	chain.genesis()
+	other := chain.tree.Insert(&blockStore.BlockMetaData{Hash: []byte("other genesis")})
+	chain.utxoStore.SetBestBlock(other.Hash())
+
+	if err := chain.recoverUtxoSet(); err != (ERR_NO_FORK{}) {
+		t.Errorf("got %v, want %v", err, ERR_NO_FORK{})
+	}
+}
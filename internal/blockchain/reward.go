@@ -0,0 +1,14 @@
+package blockchain
+
+import "github.com/tiereum/trmnode/internal/t_config"
+
+// Subsidy returns the newly created coins a coinbase at height may claim.
+// It starts at BLOCK_REWARD and halves every HALVING_INTERVAL blocks until
+// it reaches zero.
+func Subsidy(height int64) int64 {
+	halvings := height / t_config.HALVING_INTERVAL
+	if halvings >= 63 {
+		return 0
+	}
+	return t_config.BLOCK_REWARD >> halvings
+}
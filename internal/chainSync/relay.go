@@ -0,0 +1,71 @@
+package chainSync
+
+import (
+	"encoding/hex"
+
+	"github.com/tiereum/trmnode/internal/network"
+	"github.com/tiereum/trmnode/internal/server"
+)
+
+const MAX_KNOWN_INV = 10000 // per peer, oldest forgotten first
+
+// knownInv is the inventory a peer is known to have, because it sent or
+// announced it to us or we announced it to the peer.
+type knownInv struct {
+	set   map[string]bool
+	order []string
+}
+
+func newKnownInv() *knownInv {
+	return &knownInv{set: make(map[string]bool)}
+}
+
+func (known *knownInv) Has(hash []byte) bool {
+	return known.set[hex.EncodeToString(hash)]
+}
+
+func (known *knownInv) Add(hash []byte) {
+	key := hex.EncodeToString(hash)
+	if known.set[key] {
+		return
+	}
+	if len(known.order) >= MAX_KNOWN_INV {
+		delete(known.set, known.order[0])
+		known.order = known.order[1:]
+	}
+	known.set[key] = true
+	known.order = append(known.order, key)
+}
+
+// Relay announces a validated tx or block to every peer that has finished
+// the handshake and doesn't already know it. from is the peer it came
+// from, nil if it is our own.
+func (s *Syncer) Relay(invType uint8, hash []byte, from *network.Peer) {
+	if from != nil {
+		s.markKnown(from, hash)
+	}
+	msg := server.InvMsg{Inv: []server.InvVect{{Type: invType, Hash: hash}}}
+	payload := msg.Serialize()
+	for peer, state := range s.peers {
+		if state.version == nil || state.known.Has(hash) {
+			continue
+		}
+		state.known.Add(hash)
+		s.send(peer, server.INV_MESSAGE, payload)
+	}
+}
+
+// TxReceived records that peer has the tx, so it isn't announced back.
+func (s *Syncer) TxReceived(msg *server.TxMsg) {
+	key := hex.EncodeToString(msg.Tx.Hash())
+	delete(s.txRequested, key)
+	if msg.Peer != nil {
+		s.markKnown(msg.Peer, msg.Tx.Hash())
+	}
+}
+
+func (s *Syncer) markKnown(peer *network.Peer, hash []byte) {
+	if state, ok := s.peers[peer]; ok {
+		state.known.Add(hash)
+	}
+}
@@ -0,0 +1,525 @@
+package chainSync
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/tiereum/trmnode/internal/blockchain"
+	"github.com/tiereum/trmnode/internal/mempool"
+	"github.com/tiereum/trmnode/internal/network"
+	"github.com/tiereum/trmnode/internal/server"
+	"github.com/tiereum/trmnode/internal/t_config"
+	"github.com/tiereum/trmnode/internal/t_error"
+	"github.com/tiereum/trmnode/internal/validator"
+)
+
+const (
+	PROTOCOL_VERSION int32 = 1
+	MAX_HEADERS            = 2000 // per headers message
+	MAX_INV                = 500  // per inv message
+	MAX_IN_FLIGHT          = 16   // block requests outstanding per peer
+	DOWNLOAD_WINDOW        = 1024 // blocks ahead of the tip that may be requested
+	MAX_ORPHANS            = 1024
+	BLOCK_TIMEOUT          = 30 * time.Second
+	TX_TIMEOUT             = 30 * time.Second
+	TICK_INTERVAL          = 5 * time.Second
+)
+
+type peerState struct {
+	version  *server.VersionMsg // nil until the peer's version arrives
+	height   int64              // best block the peer is known to have, -1 if none
+	inFlight int
+	known    *knownInv
+}
+
+func newPeerState() *peerState {
+	return &peerState{height: -1, known: newKnownInv()}
+}
+
+// sawBlock records that the peer has the block of node and so every block
+// before it.
+func (state *peerState) sawBlock(node *blockchain.BlockNode) {
+	if node != nil {
+		state.height = max(state.height, node.Height())
+	}
+}
+
+type request struct {
+	peer *network.Peer
+	at   time.Time
+}
+
+// Syncer downloads the chain from peers headers first: headers are fetched
+// and validated ahead of the blocks, which are then requested in parallel
+// from every peer that has them. It also answers the sync requests of
+// other nodes.
+//
+// Syncer is not safe for concurrent use. Node.Run drives it from its
+// select loop, the same goroutine that adds blocks to the chain.
+type Syncer struct {
+	ctx        *t_config.Context
+	server     *server.Server
+	blockchain *blockchain.Blockchain
+	validator  *validator.BlockValidator
+	mempool    *mempool.MempoolIO
+
+	peers       map[*network.Peer]*peerState
+	headers     map[string]*blockchain.BlockNode // validated headers whose blocks are not in the tree
+	bestHeader  *blockchain.BlockNode            // nil when no header beats the tip
+	requested   map[string]*request
+	txRequested map[string]time.Time
+	orphans     map[string][]*server.BlockMsg // received blocks by the hash of their missing parent
+	numOrphans  int
+	ticker      *time.Ticker
+}
+
+func NewSyncer(ctx *t_config.Context, srv *server.Server, chain *blockchain.Blockchain, blockValidator *validator.BlockValidator, pool *mempool.MempoolIO) *Syncer {
+	s := new(Syncer)
+	s.ctx = ctx
+	s.server = srv
+	s.blockchain = chain
+	s.validator = blockValidator
+	s.mempool = pool
+	s.peers = make(map[*network.Peer]*peerState)
+	s.headers = make(map[string]*blockchain.BlockNode)
+	s.requested = make(map[string]*request)
+	s.txRequested = make(map[string]time.Time)
+	s.orphans = make(map[string][]*server.BlockMsg)
+	s.ticker = time.NewTicker(TICK_INTERVAL)
+	return s
+}
+
+// Ticks fires every TICK_INTERVAL; the receiver should call OnTick.
+func (s *Syncer) Ticks() <-chan time.Time {
+	return s.ticker.C
+}
+
+// Progress returns the height of the tip and of the best validated header.
+func (s *Syncer) Progress() (int64, int64) {
+	var tip int64 = -1
+	if s.blockchain.Tip() != nil {
+		tip = s.blockchain.Tip().Height()
+	}
+	best := tip
+	if s.bestHeader != nil {
+		best = s.bestHeader.Height()
+	}
+	return tip, best
+}
+
+// PeerSync returns the protocol version the peer sent in its handshake,
+// the height of the best block it is known to have, -1 before the
+// handshake, and its blocks in flight.
+func (s *Syncer) PeerSync(peer *network.Peer) (int32, int64, int) {
+	state, ok := s.peers[peer]
+	if !ok || state.version == nil {
+		return 0, -1, 0
+	}
+	return state.version.Version, state.height, state.inFlight
+}
+
+// PeerConnected starts the version handshake with a new peer.
+func (s *Syncer) PeerConnected(peer *network.Peer) {
+	s.peers[peer] = newPeerState()
+	tip := s.blockchain.Tip()
+	msg := server.VersionMsg{Version: PROTOCOL_VERSION, Height: -1, BestHash: make([]byte, 32)}
+	if tip != nil {
+		msg.Height = tip.Height()
+		msg.BestHash = tip.Hash()
+	}
+	s.send(peer, server.VERSION_MESSAGE, msg.Serialize())
+}
+
+func (s *Syncer) HandleMessage(msg *server.Message) {
+	state, ok := s.peers[msg.Peer]
+	if !ok {
+		state = newPeerState()
+		s.peers[msg.Peer] = state
+	}
+	buffer := bytes.NewBuffer(msg.Payload)
+
+	var err error
+	switch msg.Command {
+	case server.VERSION_MESSAGE:
+		err = s.onVersion(msg.Peer, state, buffer)
+	case server.VERACK_MESSAGE:
+	case server.GETHEADERS_MESSAGE:
+		err = s.onGetHeaders(msg.Peer, buffer)
+	case server.HEADERS_MESSAGE:
+		err = s.onHeaders(msg.Peer, state, buffer)
+	case server.GETBLOCKS_MESSAGE:
+		err = s.onGetBlocks(msg.Peer, buffer)
+	case server.INV_MESSAGE:
+		err = s.onInv(msg.Peer, state, buffer)
+	case server.GETDATA_MESSAGE:
+		err = s.onGetData(msg.Peer, buffer)
+	}
+	if err != nil {
+		score := validator.BanScore(err)
+		if validator.Code(err) == 0 {
+			score = network.MALFORMED_BAN_SCORE
+		}
+		if score == 0 {
+			t_error.LogWarn(fmt.Errorf("%s message from %s: %w", msg.Command, msg.Peer.Addr, err))
+		}
+		s.server.Misbehaving(msg.Peer, score, fmt.Sprintf("%s: %s", msg.Command, err))
+	}
+}
+
+func (s *Syncer) onVersion(peer *network.Peer, state *peerState, buffer *bytes.Buffer) error {
+	msg := new(server.VersionMsg)
+	if err := msg.Decode(buffer); err != nil {
+		return err
+	}
+	state.version = msg
+	state.height = max(state.height, msg.Height)
+	s.send(peer, server.VERACK_MESSAGE, nil)
+
+	if msg.Height > s.bestHeight() {
+		s.getHeaders(peer)
+	}
+	return nil
+}
+
+func (s *Syncer) onGetHeaders(peer *network.Peer, buffer *bytes.Buffer) error {
+	msg := new(server.LocatorMsg)
+	if err := msg.Decode(buffer); err != nil {
+		return err
+	}
+	fork := s.blockchain.LocatorFork(msg.Hashes)
+	reply := server.HeadersMsg{}
+	for _, node := range s.blockchain.MainChainAfter(fork, msg.StopHash, MAX_HEADERS) {
+		b, _ := s.blockchain.Block(node.Hash())
+		if b == nil {
+			break
+		}
+		reply.Headers = append(reply.Headers, b.Header)
+	}
+	s.send(peer, server.HEADERS_MESSAGE, reply.Serialize())
+	return nil
+}
+
+// onHeaders validates each header against its parent and adds it to the
+// header chain. Headers are expected to connect in order; the first one
+// that does not ends the batch. The peer is taken to have every block
+// whose header it sent.
+func (s *Syncer) onHeaders(peer *network.Peer, state *peerState, buffer *bytes.Buffer) error {
+	msg := new(server.HeadersMsg)
+	if err := msg.Decode(buffer); err != nil {
+		return err
+	}
+	for i := range msg.Headers {
+		header := &msg.Headers[i]
+		hash := header.Hash()
+		if known := s.node(hash); known != nil {
+			state.sawBlock(known)
+			continue
+		}
+		parent := s.node(header.PrevHash)
+		if err := s.validator.ValidateHeader(header, parent); err != nil {
+			return err
+		}
+		node := blockchain.NewHeaderNode(header, parent)
+		s.headers[hex.EncodeToString(hash)] = node
+		state.sawBlock(node)
+		if node.ChainWork().Cmp(s.bestWork()) == 1 {
+			s.bestHeader = node
+		}
+	}
+	if len(msg.Headers) == MAX_HEADERS {
+		s.getHeaders(peer)
+	}
+	s.requestBlocks()
+	return nil
+}
+
+func (s *Syncer) onGetBlocks(peer *network.Peer, buffer *bytes.Buffer) error {
+	msg := new(server.LocatorMsg)
+	if err := msg.Decode(buffer); err != nil {
+		return err
+	}
+	fork := s.blockchain.LocatorFork(msg.Hashes)
+	reply := server.InvMsg{}
+	for _, node := range s.blockchain.MainChainAfter(fork, msg.StopHash, MAX_INV) {
+		reply.Inv = append(reply.Inv, server.InvVect{Type: server.INV_BLOCK, Hash: node.Hash()})
+	}
+	s.send(peer, server.INV_MESSAGE, reply.Serialize())
+	return nil
+}
+
+// onInv asks for the headers of any announced block we don't have. The
+// blocks themselves are requested once their headers check out. Unknown
+// txs are requested directly, from the first peer to announce them.
+func (s *Syncer) onInv(peer *network.Peer, state *peerState, buffer *bytes.Buffer) error {
+	msg := new(server.InvMsg)
+	if err := msg.Decode(buffer); err != nil {
+		return err
+	}
+	getHeaders := false
+	getData := server.InvMsg{}
+	for _, inv := range msg.Inv {
+		s.markKnown(peer, inv.Hash)
+		switch inv.Type {
+		case server.INV_BLOCK:
+			known := s.node(inv.Hash)
+			state.sawBlock(known)
+			getHeaders = getHeaders || known == nil
+		case server.INV_TX:
+			key := hex.EncodeToString(inv.Hash)
+			if _, ok := s.txRequested[key]; ok || s.mempool.Exists(inv.Hash) {
+				continue
+			}
+			s.txRequested[key] = time.Now()
+			getData.Inv = append(getData.Inv, inv)
+		}
+	}
+	if getHeaders {
+		s.getHeaders(peer)
+	}
+	if len(getData.Inv) > 0 {
+		s.send(peer, server.GETDATA_MESSAGE, getData.Serialize())
+	}
+	return nil
+}
+
+func (s *Syncer) onGetData(peer *network.Peer, buffer *bytes.Buffer) error {
+	msg := new(server.InvMsg)
+	if err := msg.Decode(buffer); err != nil {
+		return err
+	}
+	for _, inv := range msg.Inv {
+		var err error
+		switch inv.Type {
+		case server.INV_BLOCK:
+			if s.blockchain.Node(inv.Hash) == nil {
+				continue
+			}
+			if b, _ := s.blockchain.Block(inv.Hash); b != nil {
+				err = s.server.SendBlock(peer, b)
+			}
+		case server.INV_TX:
+			if tx, _, ok := s.mempool.Read(inv.Hash); ok {
+				err = s.server.SendTx(peer, tx)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		s.markKnown(peer, inv.Hash)
+	}
+	return nil
+}
+
+// BlockReceived records the arrival of a block and returns the blocks that
+// are now ready to be validated, parents before children. A block whose
+// parent is unknown is held back until the parent is returned.
+func (s *Syncer) BlockReceived(msg *server.BlockMsg) []*server.BlockMsg {
+	hash := msg.Block.Hash()
+	key := hex.EncodeToString(hash)
+	if msg.Peer != nil {
+		s.markKnown(msg.Peer, hash)
+		if state, ok := s.peers[msg.Peer]; ok {
+			state.sawBlock(s.node(hash))
+		}
+	}
+	if req, ok := s.requested[key]; ok {
+		if state, ok := s.peers[req.peer]; ok {
+			state.inFlight--
+		}
+		delete(s.requested, key)
+	}
+
+	if s.blockchain.Node(msg.Block.Header.PrevHash) == nil {
+		if s.numOrphans < MAX_ORPHANS {
+			prevKey := hex.EncodeToString(msg.Block.Header.PrevHash)
+			s.orphans[prevKey] = append(s.orphans[prevKey], msg)
+			s.numOrphans++
+		}
+		if s.node(msg.Block.Header.PrevHash) == nil && msg.Peer != nil {
+			s.getHeaders(msg.Peer)
+		}
+		return nil
+	}
+
+	ready := []*server.BlockMsg{msg}
+	for i := 0; i < len(ready); i++ {
+		childKey := hex.EncodeToString(ready[i].Block.Hash())
+		ready = append(ready, s.orphans[childKey]...)
+		s.numOrphans -= len(s.orphans[childKey])
+		delete(s.orphans, childKey)
+	}
+	return ready
+}
+
+// BlockRejected drops the header of a block that failed validation,
+// together with every header built on it, so they are not requested again.
+func (s *Syncer) BlockRejected(hash []byte) {
+	node, ok := s.headers[hex.EncodeToString(hash)]
+	if !ok {
+		return
+	}
+	for key, header := range s.headers {
+		if header.Ancestor(node.Height()) == node {
+			delete(s.headers, key)
+			s.numOrphans -= len(s.orphans[key])
+			delete(s.orphans, key)
+		}
+	}
+	s.bestHeader = nil
+	for _, header := range s.headers {
+		if header.ChainWork().Cmp(s.bestWork()) == 1 {
+			s.bestHeader = header
+		}
+	}
+}
+
+// OnTick expires block requests that timed out, forgets disconnected
+// peers, requests more blocks and reports progress while catching up.
+func (s *Syncer) OnTick() {
+	now := time.Now()
+	for peer := range s.peers {
+		if peer.Closed() {
+			delete(s.peers, peer)
+		}
+	}
+	for key, req := range s.requested {
+		_, connected := s.peers[req.peer]
+		if connected && now.Sub(req.at) < BLOCK_TIMEOUT {
+			continue
+		}
+		if connected {
+			s.peers[req.peer].inFlight--
+		}
+		delete(s.requested, key)
+	}
+	for key, at := range s.txRequested {
+		if now.Sub(at) >= TX_TIMEOUT {
+			delete(s.txRequested, key)
+		}
+	}
+	for key, node := range s.headers {
+		if s.blockchain.Node(node.Hash()) != nil {
+			delete(s.headers, key)
+		}
+	}
+	if s.bestHeader != nil && s.bestHeader.ChainWork().Cmp(s.tipWork()) != 1 {
+		s.bestHeader = nil
+	}
+	s.requestBlocks()
+
+	if s.bestHeader != nil {
+		tip, best := s.Progress()
+		fmt.Printf("Syncing: block %d of %d (%.1f%%), %d in flight from %d peers\n",
+			tip, best, 100*float64(tip)/float64(max(best, 1)), len(s.requested), len(s.peers))
+	}
+}
+
+// requestBlocks spreads getdata requests for the blocks between the tip
+// and the best header over the peers that have them.
+func (s *Syncer) requestBlocks() {
+	if s.bestHeader == nil {
+		return
+	}
+	missing := make([]*blockchain.BlockNode, 0)
+	for curr := s.bestHeader; curr != nil && s.blockchain.Node(curr.Hash()) == nil; curr = curr.Parent {
+		missing = append(missing, curr)
+	}
+	if len(missing) > DOWNLOAD_WINDOW {
+		missing = missing[len(missing)-DOWNLOAD_WINDOW:]
+	}
+
+	batches := make(map[*network.Peer]*server.InvMsg)
+	for i := len(missing) - 1; i >= 0; i-- {
+		node := missing[i]
+		key := hex.EncodeToString(node.Hash())
+		if _, ok := s.requested[key]; ok {
+			continue
+		}
+		if s.buffered(node) {
+			continue
+		}
+		peer := s.pickPeer(node.Height())
+		if peer == nil {
+			break
+		}
+		if batches[peer] == nil {
+			batches[peer] = &server.InvMsg{}
+		}
+		batches[peer].Inv = append(batches[peer].Inv, server.InvVect{Type: server.INV_BLOCK, Hash: node.Hash()})
+		s.requested[key] = &request{peer: peer, at: time.Now()}
+		s.peers[peer].inFlight++
+	}
+	for peer, msg := range batches {
+		s.send(peer, server.GETDATA_MESSAGE, msg.Serialize())
+	}
+}
+
+// pickPeer returns the least busy peer known to have a block at height.
+func (s *Syncer) pickPeer(height int64) *network.Peer {
+	var best *network.Peer
+	for peer, state := range s.peers {
+		if state.version == nil || state.height < height || state.inFlight >= MAX_IN_FLIGHT {
+			continue
+		}
+		if best == nil || state.inFlight < s.peers[best].inFlight {
+			best = peer
+		}
+	}
+	return best
+}
+
+// buffered reports whether the block of node has arrived and is waiting
+// for its parent.
+func (s *Syncer) buffered(node *blockchain.BlockNode) bool {
+	for _, msg := range s.orphans[hex.EncodeToString(node.Meta.PrevHash)] {
+		if bytes.Equal(msg.Block.Hash(), node.Hash()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Syncer) getHeaders(peer *network.Peer) {
+	from := s.bestHeader
+	if from == nil {
+		from = s.blockchain.Tip()
+	}
+	msg := server.LocatorMsg{Hashes: blockchain.Locator(from), StopHash: make([]byte, 32)}
+	s.send(peer, server.GETHEADERS_MESSAGE, msg.Serialize())
+}
+
+func (s *Syncer) send(peer *network.Peer, command string, payload []byte) {
+	if err := s.server.Send(peer, command, payload); err != nil {
+		t_error.LogWarn(err)
+	}
+}
+
+// node finds hash in the block tree or among the validated headers.
+func (s *Syncer) node(hash []byte) *blockchain.BlockNode {
+	if node := s.blockchain.Node(hash); node != nil {
+		return node
+	}
+	return s.headers[hex.EncodeToString(hash)]
+}
+
+func (s *Syncer) bestHeight() int64 {
+	_, best := s.Progress()
+	return best
+}
+
+func (s *Syncer) bestWork() *big.Int {
+	if s.bestHeader != nil {
+		return s.bestHeader.ChainWork()
+	}
+	return s.tipWork()
+}
+
+func (s *Syncer) tipWork() *big.Int {
+	if s.blockchain.Tip() == nil {
+		return new(big.Int)
+	}
+	return s.blockchain.Tip().ChainWork()
+}
@@ -19,7 +19,7 @@ func NewClientId() *ClientId {
 	a.PrivateKey = MakePrivateKey()
 	a.PublicKey = GetPublicKey(a.PrivateKey)
 	a.PubKeyHash = HashPublicKey(a.PublicKey)
-	a.Address = MakeAddress(a.PubKeyHash)
+	a.Address = MakeAddress(PUBKEY_HASH_ADDR, a.PubKeyHash)
 	return &a
 }
 
@@ -32,7 +32,7 @@ func GetClientId(priv []byte, pub []byte) *ClientId {
 		a.PublicKey = UnMarshalPubKey(pub)
 	}
 	a.PubKeyHash = HashPublicKey(a.PublicKey)
-	a.Address = MakeAddress(a.PubKeyHash)
+	a.Address = MakeAddress(PUBKEY_HASH_ADDR, a.PubKeyHash)
 	return a
 }
 
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -34,10 +35,16 @@ func HashPublicKey(pk *ecdsa.PublicKey) []byte {
 	return ripemdHash
 }
 
-func MakeAddress(pkhash []byte) string {
-	address := append([]byte{0x00}, pkhash...) // 1 byte version
-	hash := t_util.Hash256(address)            // double sha256 hash
-	checksum := hash[:4]
+// The version byte an address starts with says what its hash is of, and
+// so which locking script pays to it.
+const (
+	PUBKEY_HASH_ADDR byte = 0x00 // hash160 of a public key, paid by P2PKH
+	SCRIPT_HASH_ADDR byte = 0x05 // hash160 of a redeem script, paid by P2SH
+)
+
+func MakeAddress(version byte, hash []byte) string {
+	address := append([]byte{version}, hash...) // 1 byte version
+	checksum := t_util.Hash256(address)[:4]     // double sha256 hash
 	address = append(address, checksum...)
 	addressString := hex.EncodeToString(address)
 	return addressString
@@ -63,6 +70,26 @@ func UnMarshalPubKey(b []byte) *ecdsa.PublicKey {
 	return key
 }
 
+type BAD_PUBKEY_ERR struct{}
+
+func (e BAD_PUBKEY_ERR) Error() string {
+	return "Not an ECDSA public key."
+}
+
+// ParsePubKey is UnMarshalPubKey for keys that come from scripts or peers,
+// where a bad key is an error rather than a bug.
+func ParsePubKey(b []byte) (*ecdsa.PublicKey, error) {
+	r, err := x509.ParsePKIXPublicKey(b)
+	if err != nil {
+		return nil, BAD_PUBKEY_ERR{}
+	}
+	key, ok := r.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, BAD_PUBKEY_ERR{}
+	}
+	return key, nil
+}
+
 func MarshalPrivKey(pk *ecdsa.PrivateKey) []byte {
 	r, err := x509.MarshalECPrivateKey(pk)
 	t_error.LogErr(err)
@@ -74,3 +101,34 @@ func UnMarshalPrivKey(b []byte) *ecdsa.PrivateKey {
 	t_error.LogErr(err)
 	return r
 }
+
+type BAD_ADDRESS_ERR struct{}
+
+func (e BAD_ADDRESS_ERR) Error() string {
+	return "Invalid address."
+}
+
+// DecodeAddress returns the version and hash encoded in a hex address,
+// checking its length, checksum and version.
+func DecodeAddress(address string) (byte, []byte, error) {
+	b, err := hex.DecodeString(address)
+	if err != nil || len(b) != 25 {
+		return 0, nil, BAD_ADDRESS_ERR{}
+	}
+	if !bytes.Equal(t_util.Hash256(b[:21])[:4], b[21:]) {
+		return 0, nil, BAD_ADDRESS_ERR{}
+	}
+	if b[0] != PUBKEY_HASH_ADDR && b[0] != SCRIPT_HASH_ADDR {
+		return 0, nil, BAD_ADDRESS_ERR{}
+	}
+	return b[0], b[1:21], nil
+}
+
+// AddressPubKeyHash returns the public key hash encoded in a key address.
+func AddressPubKeyHash(address string) ([]byte, error) {
+	version, hash, err := DecodeAddress(address)
+	if err != nil || version != PUBKEY_HASH_ADDR {
+		return nil, BAD_ADDRESS_ERR{}
+	}
+	return hash, nil
+}
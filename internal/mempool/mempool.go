@@ -31,6 +31,8 @@ func NewMempoolIO(ctx *t_config.Context) *MempoolIO {
 
 	store.db, err = sql.Open("sqlite3", ":memory:")
 	t_error.LogErr(err)
+	// every connection to :memory: is a separate database
+	store.db.SetMaxOpenConns(1)
 	bytes, err := os.ReadFile("./internal/mempool/mempool.sql")
 	t_error.LogErr(err)
 	sqlCommand := string(bytes)
@@ -40,7 +42,7 @@ func NewMempoolIO(ctx *t_config.Context) *MempoolIO {
 }
 
 func (store *MempoolIO) Exists(hash []byte) bool {
-	query := fmt.Sprintf("SELECT EXISTS(SELECT txid FROM tierium.mempool WHERE txid='%s') AS row_exists;", hex.EncodeToString(hash))
+	query := fmt.Sprintf("SELECT EXISTS(SELECT txid FROM mempool WHERE txid='%s') AS row_exists;", hex.EncodeToString(hash))
 	row := store.db.QueryRow(query)
 	var v int
 	row.Scan(&v)
@@ -49,7 +51,7 @@ func (store *MempoolIO) Exists(hash []byte) bool {
 
 func (store *MempoolIO) Read(hash []byte) (*transaction.Tx, int64, bool) {
 
-	query := fmt.Sprintf("SELECT tx, fee FROM tierium.mempool WHERE txid='%s';", hex.EncodeToString(hash))
+	query := fmt.Sprintf("SELECT tx, fee FROM mempool WHERE txid='%s';", hex.EncodeToString(hash))
 	row := store.db.QueryRow(query)
 
 	if row.Err() != nil {
@@ -59,6 +61,9 @@ func (store *MempoolIO) Read(hash []byte) (*transaction.Tx, int64, bool) {
 	var tx string
 	var fee int64
 	err := row.Scan(&tx, &fee)
+	if err == sql.ErrNoRows {
+		return nil, 0, false
+	}
 	t_error.LogErr(err)
 	txBytes, err := hex.DecodeString(tx)
 	t_error.LogErr(err)
@@ -73,7 +78,7 @@ func (store *MempoolIO) Read(hash []byte) (*transaction.Tx, int64, bool) {
 }
 
 func (store *MempoolIO) Write(hash []byte, tx *transaction.Tx, fee int64) {
-	cmd := "INSERT INTO tierium.mempool (txid, tx, fee) VALUES (?, ?, ?);"
+	cmd := "INSERT INTO mempool (txid, tx, fee) VALUES (?, ?, ?);"
 	buffer := new(bytes.Buffer)
 	enc := transaction.NewTxEncoder(buffer)
 	enc.Encode(tx)
@@ -82,7 +87,7 @@ func (store *MempoolIO) Write(hash []byte, tx *transaction.Tx, fee int64) {
 }
 
 func (store *MempoolIO) Delete(hash []byte) {
-	cmd := "DELETE FROM tierium.mempool WHERE txid = ?;"
+	cmd := "DELETE FROM mempool WHERE txid = ?;"
 	_, err := store.db.Exec(cmd, hex.EncodeToString(hash))
 	t_error.LogErr(err)
 }
@@ -93,31 +98,27 @@ func (store *MempoolIO) Close() {
 
 func (store *MempoolIO) GetTxByPriority(required int64) []transaction.Tx {
 	var count int64
-	err := store.db.QueryRow("SELECT COUNT(*) FROM tierium.mempool;").Scan(&count)
+	err := store.db.QueryRow("SELECT COUNT(*) FROM mempool;").Scan(&count)
 	t_error.LogErr(err)
-	txs := make([]transaction.Tx, count)
 	if count < required {
 		return []transaction.Tx{}
 	}
 
-	cmd := "SELECT txid,tx FROM tierium.mempool ORDER BY fee DESC LIMIT ?;"
+	cmd := "SELECT tx FROM mempool ORDER BY fee DESC LIMIT ?;"
 	rows, err := store.db.Query(cmd, required)
 	t_error.LogErr(err)
-	txids := make([]string, count)
-	buffer := new(bytes.Buffer)
-	dec := transaction.NewTxDecoder(nil)
+	defer rows.Close()
+	txs := make([]transaction.Tx, 0, required)
 
-	i := 0
 	for rows.Next() {
 		var currTxHex string
-		rows.Scan(&txids[i], &currTxHex)
+		t_error.LogErr(rows.Scan(&currTxHex))
 		b, err := hex.DecodeString(currTxHex)
 		t_error.LogErr(err)
-		buffer.Write(b)
-		err = dec.Decode(buffer)
-		t_error.LogErr(err)
-		txs[i] = *dec.Out()
-		i++
+		// a decoded tx points into its buffer, so each needs its own
+		dec := transaction.NewTxDecoder(nil)
+		t_error.LogErr(dec.Decode(bytes.NewBuffer(b)))
+		txs = append(txs, *dec.Out())
 	}
 
 	return txs
@@ -126,7 +127,32 @@ func (store *MempoolIO) GetTxByPriority(required int64) []transaction.Tx {
 
 func (store *MempoolIO) GetTxWithLargestFee() string {
 	var txid string
-	err := store.db.QueryRow("SELECT txid FROM tierium.mempool ORDER BY fee DESC LIMIT 1;").Scan(&txid)
+	err := store.db.QueryRow("SELECT txid FROM mempool ORDER BY fee DESC LIMIT 1;").Scan(&txid)
 	t_error.LogErr(err)
 	return txid
 }
+
+// TxIds returns the ids of all txs in the mempool, highest fee first.
+func (store *MempoolIO) TxIds() [][]byte {
+	rows, err := store.db.Query("SELECT txid FROM mempool ORDER BY fee DESC;")
+	t_error.LogErr(err)
+	defer rows.Close()
+	txids := make([][]byte, 0)
+	for rows.Next() {
+		var txid string
+		t_error.LogErr(rows.Scan(&txid))
+		b, err := hex.DecodeString(txid)
+		t_error.LogErr(err)
+		txids = append(txids, b)
+	}
+	return txids
+}
+
+// Stats returns the number of txs in the mempool, their total serialized
+// size and their total fee.
+func (store *MempoolIO) Stats() (int64, int64, int64) {
+	var count, size, fees int64
+	row := store.db.QueryRow("SELECT COUNT(*), COALESCE(SUM(LENGTH(tx)) / 2, 0), COALESCE(SUM(fee), 0) FROM mempool;")
+	t_error.LogErr(row.Scan(&count, &size, &fees))
+	return count, size, fees
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"time"
 	"github.com/tiereum/trmnode/internal/block"
 	"github.com/tiereum/trmnode/internal/blockchain"
@@ -13,6 +14,7 @@ import (
 	"github.com/tiereum/trmnode/internal/t_config"
 	"github.com/tiereum/trmnode/internal/t_error"
 	"github.com/tiereum/trmnode/internal/transaction"
+	"github.com/tiereum/trmnode/internal/utxoSet"
 )
 
 type Miner struct {
@@ -21,6 +23,28 @@ type Miner struct {
 	blockchain *blockchain.Blockchain
 	pow        *proof.PoW
 	Signal     *MinerSignal
+	templates  chan *Template // newest template for MineFromMempool
+}
+
+// Template is a block for MineFromMempool to fill and solve, with what it
+// needs to know about the block's parent. CreateBlock resolves these on
+// the node loop, so the mining goroutine never reads the block tree.
+type Template struct {
+	Block      *block.Block
+	Height     int64
+	MedianTime uint32 // of the parent
+}
+
+// attempt copies the template's block, which holds only the coinbase, so
+// that the txs and fees of one mining attempt do not carry over into the
+// next.
+func (tmpl *Template) attempt() *block.Block {
+	b := *tmpl.Block
+	coinbase := tmpl.Block.Transactions[0]
+	coinbase.Outputs = slices.Clone(coinbase.Outputs)
+	b.Transactions = []transaction.Tx{coinbase}
+	b.TXCount = 1
+	return &b
 }
 
 func NewMiner(ctx *t_config.Context, blockchain *blockchain.Blockchain, mempool *mempool.MempoolIO) *Miner {
@@ -30,6 +54,7 @@ func NewMiner(ctx *t_config.Context, blockchain *blockchain.Blockchain, mempool
 	miner.mempool = mempool
 	miner.Signal = NewMinerSignal()
 	miner.blockchain = blockchain
+	miner.templates = make(chan *Template, 1)
 
 	return miner
 }
@@ -46,10 +71,10 @@ func (miner *Miner) Genesis() *block.Block {
 			Version:   t_config.Version,
 			PrevHash:  make([]byte, 32),
 			TimeStamp: uint32(time.Now().Unix()),
-			Target:    t_config.NBits,
+			Bits:      t_config.NBits,
 		},
 		TXCount:      1,
-		Transactions: []transaction.Tx{miner.CoinbaseTx(uint32(t_config.Version), transaction.NewCompactSize(0), make([]byte, 0))},
+		Transactions: []transaction.Tx{miner.CoinbaseTx(uint32(t_config.Version), blockchain.Subsidy(0), transaction.CoinbaseScript(0, nil))},
 	}
 
 	miner.Mine(nil, &genesis)
@@ -59,22 +84,33 @@ func (miner *Miner) Genesis() *block.Block {
 
 func (miner *Miner) CreateBlock(coinbaseSript []byte) *block.Block {
 
-	coinbaseScriptSz := transaction.NewCompactSize(int64(len(coinbaseSript)))
-	coinbaseTx := miner.CoinbaseTx(uint32(t_config.Version), coinbaseScriptSz, coinbaseSript)
+	parent := miner.blockchain.Tip()
+	height := parent.Height() + 1
+	medianTime := parent.MedianTimePast()
+	coinbaseTx := miner.CoinbaseTx(uint32(t_config.Version), blockchain.Subsidy(height), transaction.CoinbaseScript(height, coinbaseSript))
 
 	header := block.Header{
-		Version:        t_config.Version,
-		PrevHash:       miner.blockchain.LastMeta().Hash,
-		Target:         t_config.NBits,
-		TimeStamp:      uint32(time.Now().Unix()),
+		Version:  t_config.Version,
+		PrevHash: parent.Hash(),
+		Bits:     miner.blockchain.NextBits(parent),
+		// a clock behind the network would produce an invalid timestamp
+		TimeStamp:      max(uint32(time.Now().Unix()), medianTime+1),
 		MerkleRootHash: make([]byte, 32),
 	}
 
-	return &block.Block{
+	b := &block.Block{
 		Header:       header,
 		TXCount:      1,
 		Transactions: []transaction.Tx{coinbaseTx},
 	}
+
+	// replace a template the mining goroutine has not picked up yet
+	select {
+	case <-miner.templates:
+	default:
+	}
+	miner.templates <- &Template{Block: b, Height: height, MedianTime: medianTime}
+	return b
 }
 
 type MineSignal struct {
@@ -91,16 +127,22 @@ func (s *MineSignal) SignalResume() {
 }
 
 type SolveSignal struct {
-	Ready chan byte
+	Ready chan *block.Block // the solved block
 	Reset chan byte
 }
 
-func (s *SolveSignal) SignalReady() {
-	s.Ready <- 0x00
+func (s *SolveSignal) SignalReady(b *block.Block) {
+	s.Ready <- b
 }
 
+// SignalReset stops a solve in progress. Only Mine reads Reset, so while
+// the miner is idle a reset is already pending and another is dropped
+// rather than blocking the caller.
 func (s *SolveSignal) SignalReset() {
-	s.Reset <- 0x00
+	select {
+	case s.Reset <- 0x00:
+	default:
+	}
 }
 
 type MinerSignal struct {
@@ -115,7 +157,7 @@ func NewMinerSignal() *MinerSignal {
 			Stop:   make(chan byte, 1),
 			Resume: make(chan byte, 1)},
 		SolveSignal: SolveSignal{
-			Ready: make(chan byte, 1),
+			Ready: make(chan *block.Block, 1),
 			Reset: make(chan byte, 1)},
 	}
 	return m
@@ -129,43 +171,87 @@ func (s *MinerSignal) Resume() {
 	s.MineSignal.SignalResume()
 }
 
-func (miner *Miner) MineFromMempool(block *block.Block) {
+// MineFromMempool mines the newest template from CreateBlock once the
+// mempool holds enough txs, moving on to a newer template when one comes.
+func (miner *Miner) MineFromMempool() {
 
+	tmpl := <-miner.templates
 	for {
 		select {
 		case <-miner.Signal.MineSignal.Stop:
 			<-miner.Signal.MineSignal.Resume
+		case tmpl = <-miner.templates:
 		default:
 			time.Sleep(time.Millisecond * 10)
-			txs := miner.mempool.GetTxByPriority(int64(*miner.ctx.NodeConfig.NumTxInBlock))
-			if len(txs) == int(*miner.ctx.NodeConfig.NumTxInBlock) {
-				for _, tx := range txs {
-					miner.AddTxToBlock(&tx, block)
+			numTx := int(*miner.ctx.NodeConfig.NumTxInBlock)
+			txs := miner.mempool.GetTxByPriority(int64(numTx))
+			if len(txs) < numTx {
+				continue
+			}
+			b := tmpl.attempt()
+			view := miner.blockchain.View()
+			for _, tx := range txs {
+				// the pool is kept final for the newest tip, which this
+				// template may be behind
+				if !tx.IsFinal(tmpl.Height, tmpl.MedianTime) {
+					continue
 				}
+				// a tx conflicting with one already added waits for the
+				// node to evict it once the other is mined
+				miner.AddTxToBlock(&tx, b, view, tmpl.Height)
+			}
+			if int(b.TXCount)-1 < numTx {
+				continue
+			}
 
-				// where this node attempts to mine the block
-				if miner.Mine(miner.Signal.SolveSignal.Reset, block) {
-					miner.Signal.SolveSignal.SignalReady()
-				}
+			// where this node attempts to mine the block
+			if miner.Mine(miner.Signal.SolveSignal.Reset, b) {
+				miner.Signal.SolveSignal.SignalReady(b)
+				// the node answers with a template on top of it
+				tmpl = <-miner.templates
 			}
 		}
 	}
 }
 
-func (miner *Miner) AddTxToBlock(tx *transaction.Tx, block *block.Block) {
+// AddTxToBlock appends tx to block, which is to be at height, and claims
+// its fee in the coinbase. view holds the UTXO set as the txs already in
+// block leave it and is updated with tx. A tx spending an output that is
+// not in view, such as one an earlier tx in block spent, is left out.
+func (miner *Miner) AddTxToBlock(tx *transaction.Tx, block *block.Block, view *utxoSet.UtxoView, height int64) error {
+	for _, in := range tx.Inputs {
+		if _, ok := view.Read(&in.PrevOutpt); !ok {
+			return blockchain.ErrMissingInput
+		}
+	}
+	spent, ok := view.ConnectTx(tx, height)
+	if !ok {
+		// tx spends one output twice
+		return blockchain.ErrMissingInput
+	}
+	var fee int64
+	for _, utxo := range spent {
+		fee += utxo.Value
+	}
+	for _, out := range tx.Outputs {
+		fee -= out.Value
+	}
 	block.Transactions = append(block.Transactions, *tx)
 	block.TXCount++
+	block.Transactions[0].Outputs[0].Value += fee
+	return nil
 }
 
 // adds block to blockchain, updates UTXO set
-func (miner *Miner) AddBlock(block *block.Block) {
-	miner.blockchain.AddBlock(block)
+func (miner *Miner) AddBlock(block *block.Block) error {
+	return miner.blockchain.AddBlock(block)
 }
 
 func (miner *Miner) Mine(quit chan byte, block *block.Block) bool {
 	miner.pow = proof.NewPoW()
 	defer miner.pow.Close()
-	block.Header.TimeStamp = uint32(time.Now().Unix())
+	// CreateBlock already kept the timestamp after the median time past
+	block.Header.TimeStamp = max(uint32(time.Now().Unix()), block.Header.TimeStamp)
 	block.Header.MerkleRootHash = block.MerkelRoot()
 	go func() {
 		for state := range miner.pow.Notifier {
@@ -184,11 +270,11 @@ func (miner *Miner) Mine(quit chan byte, block *block.Block) bool {
 
 func (miner *Miner) CoinbaseTx(
 	version uint32,
-	inScriptSz transaction.CompactSize,
+	value int64,
 	inSript []byte) transaction.Tx {
 
 	output := transaction.TxOut{
-		Value:             t_config.BLOCK_REWARD,
+		Value:             value,
 		LockingScriptSize: transaction.NewCompactSize(transaction.P2PKH_LOCK_SCRIPT_SZ),
 		LockingScript:     transaction.P2PKH_LockScript(*miner.ctx.NodeConfig.ClientAddress),
 	}
@@ -196,9 +282,9 @@ func (miner *Miner) CoinbaseTx(
 	return transaction.Tx{
 		Version:    t_config.Version,
 		NumInputs:  1,
-		Inputs:     []transaction.TxIn{transaction.Coinbase(inScriptSz, inSript)},
+		Inputs:     []transaction.TxIn{transaction.Coinbase(transaction.NewCompactSize(int64(len(inSript))), inSript)},
 		NumOutputs: 1,
 		Outputs:    []transaction.TxOut{output},
-		LockTime:   100,
+		LockTime:   0,
 	}
 }
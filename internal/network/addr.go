@@ -0,0 +1,52 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+type BAD_ADDR_ERR struct{}
+
+func (e BAD_ADDR_ERR) Error() string {
+	return "Incorrect addr message format."
+}
+
+// AddrMsg gossips peer addresses, as host:port, with the unix time each
+// was last seen. A host left empty means the sender's own host.
+type AddrMsg struct {
+	Addrs []KnownPeer
+}
+
+func (m *AddrMsg) Serialize() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, uint32(len(m.Addrs)))
+	for _, addr := range m.Addrs {
+		binary.Write(buffer, binary.BigEndian, uint16(len(addr.Addr)))
+		buffer.WriteString(addr.Addr)
+		binary.Write(buffer, binary.BigEndian, addr.LastSeen)
+	}
+	return buffer.Bytes()
+}
+
+func (m *AddrMsg) Decode(buffer *bytes.Buffer) error {
+	if buffer.Len() < 4 {
+		return BAD_ADDR_ERR{}
+	}
+	n := binary.BigEndian.Uint32(buffer.Next(4))
+	if n > MAX_ADDRS {
+		return BAD_ADDR_ERR{}
+	}
+	m.Addrs = make([]KnownPeer, n)
+	for i := range m.Addrs {
+		if buffer.Len() < 2 {
+			return BAD_ADDR_ERR{}
+		}
+		size := int(binary.BigEndian.Uint16(buffer.Next(2)))
+		if buffer.Len() < size+8 {
+			return BAD_ADDR_ERR{}
+		}
+		m.Addrs[i].Addr = string(buffer.Next(size))
+		m.Addrs[i].LastSeen = int64(binary.BigEndian.Uint64(buffer.Next(8)))
+	}
+	return nil
+}
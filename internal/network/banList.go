@@ -0,0 +1,143 @@
+package network
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tiereum/trmnode/internal/t_config"
+	"github.com/tiereum/trmnode/internal/t_error"
+)
+
+const (
+	BAN_THRESHOLD       = 100 // ban score at which a peer is banned
+	MALFORMED_BAN_SCORE = 50  // payload that fails to decode
+	DEFAULT_BAN_TIME    = 24 * time.Hour
+)
+
+// Ban keeps a host from connecting in either direction. A ban with Until
+// zero is persistent; otherwise it expires at unix time Until.
+type Ban struct {
+	Host   string `json:"host"`
+	Until  int64  `json:"until"`
+	Reason string `json:"reason"`
+}
+
+func (ban *Ban) Expired(now time.Time) bool {
+	return ban.Until != 0 && now.Unix() >= ban.Until
+}
+
+// BanList persists bans to banlist.json in the data dir. The file is
+// reloaded when another process, such as the CLI, changes it.
+type BanList struct {
+	path    string
+	mu      sync.Mutex
+	bans    map[string]*Ban
+	modTime time.Time
+}
+
+func NewBanList(ctx *t_config.Context) *BanList {
+	list := new(BanList)
+	list.path = path.Join(ctx.DataDir, "banlist.json")
+	list.bans = make(map[string]*Ban)
+	list.reload()
+	return list
+}
+
+// reload reads the file if it changed since it was last read or written.
+// Callers hold mu, except the constructor.
+func (list *BanList) reload() {
+	info, err := os.Stat(list.path)
+	if os.IsNotExist(err) || (err == nil && !info.ModTime().After(list.modTime)) {
+		return
+	}
+	t_error.LogErr(err)
+	b, err := os.ReadFile(list.path)
+	t_error.LogErr(err)
+	bans := make([]*Ban, 0)
+	if err := json.Unmarshal(b, &bans); err != nil {
+		t_error.LogWarn(err)
+		return
+	}
+	list.bans = make(map[string]*Ban, len(bans))
+	for _, ban := range bans {
+		list.bans[ban.Host] = ban
+	}
+	list.modTime = info.ModTime()
+}
+
+func (list *BanList) save() {
+	now := time.Now()
+	bans := make([]*Ban, 0, len(list.bans))
+	for host, ban := range list.bans {
+		if ban.Expired(now) {
+			delete(list.bans, host)
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	b, err := json.Marshal(bans)
+	t_error.LogErr(err)
+	tmp := list.path + ".tmp"
+	t_error.LogErr(os.WriteFile(tmp, b, 0600))
+	t_error.LogErr(os.Rename(tmp, list.path))
+	if info, err := os.Stat(list.path); err == nil {
+		list.modTime = info.ModTime()
+	}
+}
+
+// Add bans host for duration, or persistently if duration is zero.
+func (list *BanList) Add(host string, duration time.Duration, reason string) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	list.reload()
+	ban := &Ban{Host: host, Reason: reason}
+	if duration > 0 {
+		ban.Until = time.Now().Add(duration).Unix()
+	}
+	list.bans[host] = ban
+	list.save()
+}
+
+// Remove lifts the ban on host, returning false if it wasn't banned.
+func (list *BanList) Remove(host string) bool {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	list.reload()
+	if _, ok := list.bans[host]; !ok {
+		return false
+	}
+	delete(list.bans, host)
+	list.save()
+	return true
+}
+
+func (list *BanList) IsBanned(host string) bool {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	list.reload()
+	ban, ok := list.bans[host]
+	return ok && !ban.Expired(time.Now())
+}
+
+// List returns the bans in effect, ordered by host.
+func (list *BanList) List() []Ban {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	list.reload()
+	now := time.Now()
+	bans := make([]Ban, 0, len(list.bans))
+	for _, ban := range list.bans {
+		if !ban.Expired(now) {
+			bans = append(bans, *ban)
+		}
+	}
+	slices.SortFunc(bans, func(a, b Ban) int {
+		return strings.Compare(a.Host, b.Host)
+	})
+	return bans
+}
@@ -2,96 +2,404 @@ package network
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/rand"
 	"fmt"
+	"io"
 	"net"
-	"os"
-	"path"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/tiereum/trmnode/internal/t_config"
 	"github.com/tiereum/trmnode/internal/t_error"
 )
 
+const (
+	MAX_INBOUND   = 32
+	MAX_OUTBOUND  = 8
+	MAX_ADDRS     = 1000 // per addr message
+	DIAL_INTERVAL = 10 * time.Second
+	DIAL_TIMEOUT  = 5 * time.Second
+	WRITE_TIMEOUT = 30 * time.Second
+	PING_INTERVAL = time.Minute
+	PEER_TIMEOUT  = 3 * PING_INTERVAL // silence after which a peer is dropped
+
+	// network level commands, answered here and not passed to the server
+	PING_MESSAGE    = "ping"
+	PONG_MESSAGE    = "pong"
+	ADDR_MESSAGE    = "addr"
+	GETADDR_MESSAGE = "getaddr"
+)
+
+// Peer is an open connection to another node, either accepted by Listen
+// or dialed by Connect. Replies to requests are sent back on the same
+// connection.
+type Peer struct {
+	conn     net.Conn
+	Addr     string
+	Inbound  bool
+	DialAddr string // address in the peer database, outbound only
+	writeMu  sync.Mutex
+	mu       sync.Mutex
+	closed   bool
+	lastRecv time.Time
+	banScore int
+}
+
+func newPeer(conn net.Conn, inbound bool) *Peer {
+	return &Peer{conn: conn, Addr: conn.RemoteAddr().String(), Inbound: inbound, lastRecv: time.Now()}
+}
+
+func (peer *Peer) Send(command string, payload []byte) error {
+	peer.writeMu.Lock()
+	defer peer.writeMu.Unlock()
+	peer.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	return WriteMessage(peer.conn, command, payload)
+}
+
+func (peer *Peer) Close() {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	peer.closed = true
+	peer.conn.Close()
+}
+
+func (peer *Peer) Closed() bool {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	return peer.closed
+}
+
+func (peer *Peer) BanScore() int {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	return peer.banScore
+}
+
+// Host is the peer's address without the port, the unit bans apply to.
+func (peer *Peer) Host() string {
+	host, _, err := net.SplitHostPort(peer.Addr)
+	if err != nil {
+		return peer.Addr
+	}
+	return host
+}
+
+func (peer *Peer) received() {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	peer.lastRecv = time.Now()
+}
+
+func (peer *Peer) silence() time.Duration {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	return time.Since(peer.lastRecv)
+}
+
+// Packet is a message read from a peer's connection, or queued for
+// broadcast with a nil Peer.
+type Packet struct {
+	Peer    *Peer
+	Command string
+	Payload []byte
+}
+
+// Network is the peer manager. It accepts inbound connections up to
+// MAX_INBOUND, keeps MAX_OUTBOUND outbound connections open to addresses
+// from the peer database, learns new addresses by gossip and drops peers
+// that stop answering pings.
 type Network struct {
-	ctx     *t_config.Context
-	istream chan []byte
-	ostream chan []byte
+	ctx       *t_config.Context
+	db        *PeerDB
+	bans      *BanList
+	istream   chan *Packet
+	ostream   chan *Packet
+	connected chan *Peer
+	peers     map[*Peer]bool
+	mu        sync.Mutex
 }
 
 func NewNetwork(ctx *t_config.Context) *Network {
 
 	network := new(Network)
 	network.ctx = ctx
-	network.istream = make(chan []byte)
-	network.ostream = make(chan []byte)
-
-	tablePath := path.Join(ctx.TmpDir, "nodeTable.txt")
-
-	f, err := os.OpenFile(tablePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
-	t_error.LogErr(err)
-	defer f.Close()
-	f.WriteString(fmt.Sprintf("%d\n", *ctx.NodeConfig.RpcEndpointPort))
+	network.db = NewPeerDB(ctx)
+	network.bans = NewBanList(ctx)
+	network.istream = make(chan *Packet)
+	network.ostream = make(chan *Packet)
+	network.connected = make(chan *Peer, 64)
+	network.peers = make(map[*Peer]bool)
 
 	return network
 }
 
-// to replaced by P2P module
+func (network *Network) listenAddr() string {
+	return net.JoinHostPort(*network.ctx.NodeConfig.BindHost, strconv.Itoa(int(*network.ctx.NodeConfig.P2PPort)))
+}
+
 func (network *Network) Listen() {
 
-	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", *network.ctx.NodeConfig.RpcEndpointPort))
+	listener, err := net.Listen("tcp", network.listenAddr())
 	t_error.LogErr(err)
 
 	defer listener.Close()
-	fmt.Println("Server listening on port " + fmt.Sprint(network.ctx.NodeConfig.RpcEndpointPort) + "\n")
+	fmt.Println("Server listening on " + network.listenAddr() + "\n")
 
 	for {
 		conn, err := listener.Accept()
-		t_error.LogErr(err)
-		go network.handleConn(conn)
+		if err != nil {
+			t_error.LogWarn(err)
+			continue
+		}
+		peer := newPeer(conn, true)
+		if network.count(true) >= MAX_INBOUND || network.bans.IsBanned(peer.Host()) {
+			conn.Close()
+			continue
+		}
+		network.addPeer(peer)
 	}
 
 }
 
-func (network *Network) handleConn(conn net.Conn) {
+// Connect keeps up to MAX_OUTBOUND outbound connections open. Addresses
+// from the config are added to the peer database first; an address that
+// fails is retried with exponential backoff. It does not return.
+func (network *Network) Connect() {
 
-	fmt.Println("New client connected: ", conn.RemoteAddr().String())
+	now := time.Now().Unix()
+	for _, addr := range network.ctx.NodeConfig.Peers {
+		network.db.Add(addr, now)
+	}
 
 	for {
-		var b []byte = make([]byte, 1024)
-		n, err := conn.Read(b)
+		network.dropBanned()
+		network.dialMore()
+		network.db.Save()
+		time.Sleep(DIAL_INTERVAL)
+	}
+}
+
+// dropBanned disconnects peers banned since they connected, including by
+// the CLI.
+func (network *Network) dropBanned() {
+	for _, peer := range network.Peers() {
+		if network.bans.IsBanned(peer.Host()) {
+			peer.Close()
+		}
+	}
+}
+
+// Misbehaving adds score to the peer's ban score. Once it reaches
+// BAN_THRESHOLD the peer's host is banned for DEFAULT_BAN_TIME and the peer
+// disconnected.
+func (network *Network) Misbehaving(peer *Peer, score int, reason string) {
+	if peer == nil || score <= 0 {
+		return
+	}
+	peer.mu.Lock()
+	peer.banScore += score
+	total := peer.banScore
+	peer.mu.Unlock()
+
+	t_error.LogWarn(fmt.Errorf("peer %s misbehaving (+%d, %d): %s", peer.Addr, score, total, reason))
+	if total >= BAN_THRESHOLD {
+		network.bans.Add(peer.Host(), DEFAULT_BAN_TIME, reason)
+		peer.Close()
+	}
+}
+
+func (network *Network) dialMore() {
+	connected := make(map[string]bool)
+	for _, peer := range network.Peers() {
+		if !peer.Inbound {
+			connected[peer.DialAddr] = true
+		}
+	}
+	skip := func(addr string) bool {
+		host, _, _ := net.SplitHostPort(addr)
+		return connected[addr] || network.isSelf(addr) || network.bans.IsBanned(host)
+	}
+	for _, addr := range network.db.Candidates(skip) {
+		if len(connected) >= MAX_OUTBOUND {
+			return
+		}
+		network.db.Attempt(addr)
+		conn, err := net.DialTimeout("tcp", addr, DIAL_TIMEOUT)
+		if err != nil {
+			network.db.Failed(addr)
+			continue
+		}
+		network.db.Good(addr)
+		connected[addr] = true
+
+		peer := newPeer(conn, false)
+		peer.DialAddr = addr
+		network.addPeer(peer)
+		peer.Send(GETADDR_MESSAGE, nil)
+	}
+}
+
+// isSelf reports whether addr is our own listening address.
+func (network *Network) isSelf(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port != strconv.Itoa(int(*network.ctx.NodeConfig.P2PPort)) {
+		return false
+	}
+	if host == *network.ctx.NodeConfig.BindHost || host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsUnspecified())
+}
+
+func (network *Network) count(inbound bool) int {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	n := 0
+	for peer := range network.peers {
+		if peer.Inbound == inbound {
+			n++
+		}
+	}
+	return n
+}
+
+func (network *Network) addPeer(peer *Peer) {
+	network.mu.Lock()
+	network.peers[peer] = true
+	network.mu.Unlock()
+
+	// announce our own address, the receiver fills in the host
+	self := AddrMsg{Addrs: []KnownPeer{{
+		Addr:     net.JoinHostPort("", strconv.Itoa(int(*network.ctx.NodeConfig.P2PPort))),
+		LastSeen: time.Now().Unix(),
+	}}}
+	peer.Send(ADDR_MESSAGE, self.Serialize())
+
+	select {
+	case network.connected <- peer:
+	default:
+		t_error.LogWarn(fmt.Errorf("no one is waiting on new peer %s", peer.Addr))
+	}
+	go network.handleConn(peer)
+	go network.keepAlive(peer)
+}
+
+func (network *Network) handleConn(peer *Peer) {
+
+	fmt.Println("New client connected: ", peer.Addr)
+	defer network.removePeer(peer)
+
+	reader := bufio.NewReader(peer.conn)
+	for {
+		command, payload, err := ReadMessage(reader)
 		if err != nil {
+			if isProtocolErr(err) {
+				network.Misbehaving(peer, BAN_THRESHOLD, err.Error())
+			} else if err != io.EOF && !peer.Closed() {
+				t_error.LogWarn(fmt.Errorf("dropping %s: %w", peer.Addr, err))
+			}
 			return
 		}
-		network.istream <- b[:n]
+		peer.received()
+
+		switch command {
+		case PING_MESSAGE:
+			peer.Send(PONG_MESSAGE, payload)
+		case PONG_MESSAGE:
+		case GETADDR_MESSAGE:
+			msg := AddrMsg{Addrs: network.db.Recent(MAX_ADDRS)}
+			peer.Send(ADDR_MESSAGE, msg.Serialize())
+		case ADDR_MESSAGE:
+			network.onAddr(peer, payload)
+		default:
+			network.istream <- &Packet{Peer: peer, Command: command, Payload: payload}
+		}
 	}
 
 }
 
-// to replaced by P2P module
-func (network *Network) Broadcast() {
+func (network *Network) onAddr(peer *Peer, payload []byte) {
+	msg := new(AddrMsg)
+	if err := msg.Decode(bytes.NewBuffer(payload)); err != nil {
+		network.Misbehaving(peer, MALFORMED_BAN_SCORE, err.Error())
+		return
+	}
+	peerHost, _, _ := net.SplitHostPort(peer.Addr)
+	now := time.Now().Unix()
+	for _, known := range msg.Addrs {
+		host, port, err := net.SplitHostPort(known.Addr)
+		if err != nil || port == "0" {
+			continue
+		}
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = peerHost
+		}
+		network.db.Add(net.JoinHostPort(host, port), min(known.LastSeen, now))
+	}
+}
 
-	portPath := path.Join(network.ctx.TmpDir, "nodeTable.txt")
-	f, err := os.Open(portPath)
-	t_error.LogErr(err)
-	defer f.Close()
-	t_error.LogErr(err)
-	scanner := bufio.NewScanner(f)
+// keepAlive pings peer every PING_INTERVAL and drops it once nothing has
+// been received from it for PEER_TIMEOUT.
+func (network *Network) keepAlive(peer *Peer) {
+	ticker := time.NewTicker(PING_INTERVAL)
+	defer ticker.Stop()
+	for range ticker.C {
+		if peer.Closed() {
+			return
+		}
+		if peer.silence() > PEER_TIMEOUT {
+			t_error.LogWarn(fmt.Errorf("peer %s timed out", peer.Addr))
+			peer.Close()
+			return
+		}
+		nonce := make([]byte, 8)
+		rand.Read(nonce)
+		peer.Send(PING_MESSAGE, nonce)
+	}
+}
+
+func (network *Network) removePeer(peer *Peer) {
+	peer.Close()
+	network.mu.Lock()
+	delete(network.peers, peer)
+	network.mu.Unlock()
+	if peer.DialAddr != "" {
+		network.db.Add(peer.DialAddr, time.Now().Unix())
+	}
+}
 
-	for scanner.Scan() {
-		port := scanner.Text()
-		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%s", port))
-		t_error.LogErr(err)
-		defer conn.Close()
+// Peers returns the currently open connections.
+func (network *Network) Peers() []*Peer {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	peers := make([]*Peer, 0, len(network.peers))
+	for peer := range network.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
 
-		data := <-network.ostream
-		_, err = conn.Write(data)
-		t_error.LogErr(err)
+// Broadcast sends every packet queued on OStream to all connected peers.
+func (network *Network) Broadcast() {
+	for packet := range network.ostream {
+		for _, peer := range network.Peers() {
+			t_error.LogWarn(peer.Send(packet.Command, packet.Payload))
+		}
 	}
 }
 
-func (network *Network) IStream() <-chan []byte {
+func (network *Network) IStream() <-chan *Packet {
 	return network.istream
 }
 
-func (network *Network) OStream() chan<- []byte {
+func (network *Network) OStream() chan<- *Packet {
 	return network.ostream
 }
+
+// Connected delivers peers as their connections are opened.
+func (network *Network) Connected() <-chan *Peer {
+	return network.connected
+}
@@ -0,0 +1,179 @@
+package network
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tiereum/trmnode/internal/t_config"
+	"github.com/tiereum/trmnode/internal/t_error"
+)
+
+const (
+	MAX_KNOWN_PEERS = 2000
+	MAX_FAILURES    = 10 // after which a peer not seen for PEER_HORIZON is forgotten
+	PEER_HORIZON    = 7 * 24 * time.Hour
+	BASE_BACKOFF    = 5 * time.Second
+	MAX_BACKOFF     = 30 * time.Minute
+)
+
+// KnownPeer is an address we have connected to or heard about.
+type KnownPeer struct {
+	Addr        string `json:"addr"`
+	LastSeen    int64  `json:"lastSeen"` // unix time it was last connected to or gossiped
+	LastAttempt int64  `json:"lastAttempt"`
+	Failures    int    `json:"failures"` // connection attempts failed in a row
+}
+
+// Backoff is how long to wait after the last attempt before dialing again.
+func (peer *KnownPeer) Backoff() time.Duration {
+	if peer.Failures == 0 {
+		return BASE_BACKOFF
+	}
+	backoff := BASE_BACKOFF << min(peer.Failures, 16)
+	return min(backoff, MAX_BACKOFF)
+}
+
+// PeerDB persists known peer addresses to peers.json in the data dir.
+type PeerDB struct {
+	path  string
+	mu    sync.Mutex
+	peers map[string]*KnownPeer
+	dirty bool
+}
+
+func NewPeerDB(ctx *t_config.Context) *PeerDB {
+	db := new(PeerDB)
+	db.path = path.Join(ctx.DataDir, "peers.json")
+	db.peers = make(map[string]*KnownPeer)
+
+	b, err := os.ReadFile(db.path)
+	if os.IsNotExist(err) {
+		return db
+	}
+	t_error.LogErr(err)
+	peers := make([]*KnownPeer, 0)
+	if err := json.Unmarshal(b, &peers); err != nil {
+		t_error.LogWarn(err)
+		return db
+	}
+	for _, peer := range peers {
+		db.peers[peer.Addr] = peer
+	}
+	return db
+}
+
+// Save writes the database if it changed since the last save.
+func (db *PeerDB) Save() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.dirty {
+		return
+	}
+	peers := make([]*KnownPeer, 0, len(db.peers))
+	for _, peer := range db.peers {
+		peers = append(peers, peer)
+	}
+	b, err := json.Marshal(peers)
+	t_error.LogErr(err)
+	tmp := db.path + ".tmp"
+	t_error.LogErr(os.WriteFile(tmp, b, 0600))
+	t_error.LogErr(os.Rename(tmp, db.path))
+	db.dirty = false
+}
+
+// Add records addr, seen at unix time seen. Nothing is evicted to make
+// room; once the database is full new addresses are ignored.
+func (db *PeerDB) Add(addr string, seen int64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	peer, ok := db.peers[addr]
+	if !ok {
+		if len(db.peers) >= MAX_KNOWN_PEERS {
+			return
+		}
+		db.peers[addr] = &KnownPeer{Addr: addr, LastSeen: seen}
+		db.dirty = true
+		return
+	}
+	if seen > peer.LastSeen {
+		peer.LastSeen = seen
+		db.dirty = true
+	}
+}
+
+func (db *PeerDB) Attempt(addr string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if peer, ok := db.peers[addr]; ok {
+		peer.LastAttempt = time.Now().Unix()
+		db.dirty = true
+	}
+}
+
+func (db *PeerDB) Good(addr string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	peer, ok := db.peers[addr]
+	if !ok {
+		peer = &KnownPeer{Addr: addr}
+		db.peers[addr] = peer
+	}
+	peer.LastSeen = time.Now().Unix()
+	peer.Failures = 0
+	db.dirty = true
+}
+
+func (db *PeerDB) Failed(addr string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	peer, ok := db.peers[addr]
+	if !ok {
+		return
+	}
+	peer.Failures++
+	if peer.Failures > MAX_FAILURES && time.Since(time.Unix(peer.LastSeen, 0)) > PEER_HORIZON {
+		delete(db.peers, addr)
+	}
+	db.dirty = true
+}
+
+// Candidates returns the addresses that may be dialed now, most recently
+// seen first.
+func (db *PeerDB) Candidates(skip func(addr string) bool) []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	now := time.Now()
+	ready := make([]*KnownPeer, 0)
+	for addr, peer := range db.peers {
+		if skip(addr) || now.Sub(time.Unix(peer.LastAttempt, 0)) < peer.Backoff() {
+			continue
+		}
+		ready = append(ready, peer)
+	}
+	slices.SortFunc(ready, func(a, b *KnownPeer) int {
+		return int(b.LastSeen - a.LastSeen)
+	})
+	addrs := make([]string, len(ready))
+	for i, peer := range ready {
+		addrs[i] = peer.Addr
+	}
+	return addrs
+}
+
+// Recent returns up to n of the most recently seen addresses, for getaddr.
+func (db *PeerDB) Recent(n int) []KnownPeer {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	peers := make([]KnownPeer, 0, len(db.peers))
+	for _, peer := range db.peers {
+		peers = append(peers, *peer)
+	}
+	slices.SortFunc(peers, func(a, b KnownPeer) int {
+		return int(b.LastSeen - a.LastSeen)
+	})
+	return peers[:min(n, len(peers))]
+}
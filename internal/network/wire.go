@@ -0,0 +1,112 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/tiereum/trmnode/internal/t_util"
+)
+
+// Every message on the wire is a fixed size header followed by its payload:
+//
+//	magic    4 bytes
+//	command 12 bytes, ASCII, zero padded
+//	length   4 bytes, payload size
+//	checksum 4 bytes, first bytes of Hash256(payload)
+const (
+	MAGIC            uint32 = 0x74726d31 // "trm1"
+	COMMAND_SIZE            = 12
+	HEADER_SIZE             = 4 + COMMAND_SIZE + 4 + 4
+	MAX_MESSAGE_SIZE uint32 = 4 * 1024 * 1024
+)
+
+type BAD_MAGIC_ERR struct{}
+
+func (e BAD_MAGIC_ERR) Error() string {
+	return "Message does not start with the network magic."
+}
+
+type BAD_COMMAND_ERR struct{}
+
+func (e BAD_COMMAND_ERR) Error() string {
+	return "Incorrect message command."
+}
+
+type BAD_CHECKSUM_ERR struct{}
+
+func (e BAD_CHECKSUM_ERR) Error() string {
+	return "Message checksum does not match its payload."
+}
+
+type MESSAGE_TOO_LARGE_ERR struct {
+	Size uint32
+}
+
+func (e MESSAGE_TOO_LARGE_ERR) Error() string {
+	return fmt.Sprintf("Message of %d bytes exceeds the maximum of %d.", e.Size, MAX_MESSAGE_SIZE)
+}
+
+func checksum(payload []byte) []byte {
+	return t_util.Hash256(payload)[:4]
+}
+
+// WriteMessage frames payload under command and writes it to w in a single
+// call.
+func WriteMessage(w io.Writer, command string, payload []byte) error {
+	if len(command) == 0 || len(command) > COMMAND_SIZE {
+		return BAD_COMMAND_ERR{}
+	}
+	if uint32(len(payload)) > MAX_MESSAGE_SIZE {
+		return MESSAGE_TOO_LARGE_ERR{Size: uint32(len(payload))}
+	}
+	buffer := bytes.NewBuffer(make([]byte, 0, HEADER_SIZE+len(payload)))
+	binary.Write(buffer, binary.BigEndian, MAGIC)
+	cmd := [COMMAND_SIZE]byte{}
+	copy(cmd[:], command)
+	buffer.Write(cmd[:])
+	binary.Write(buffer, binary.BigEndian, uint32(len(payload)))
+	buffer.Write(checksum(payload))
+	buffer.Write(payload)
+	_, err := w.Write(buffer.Bytes())
+	return err
+}
+
+// ReadMessage reads the next framed message from r, blocking until all of
+// it has arrived. Any error leaves the stream unusable.
+func ReadMessage(r io.Reader) (string, []byte, error) {
+	header := make([]byte, HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", nil, err
+	}
+	if binary.BigEndian.Uint32(header[:4]) != MAGIC {
+		return "", nil, BAD_MAGIC_ERR{}
+	}
+	cmd := bytes.TrimRight(header[4:4+COMMAND_SIZE], "\x00")
+	if len(cmd) == 0 || bytes.IndexByte(cmd, 0) != -1 {
+		return "", nil, BAD_COMMAND_ERR{}
+	}
+	size := binary.BigEndian.Uint32(header[4+COMMAND_SIZE:])
+	if size > MAX_MESSAGE_SIZE {
+		return "", nil, MESSAGE_TOO_LARGE_ERR{Size: size}
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", nil, err
+	}
+	if !bytes.Equal(checksum(payload), header[4+COMMAND_SIZE+4:]) {
+		return "", nil, BAD_CHECKSUM_ERR{}
+	}
+	return string(cmd), payload, nil
+}
+
+// isProtocolErr reports whether err came from a peer breaking the framing
+// rather than from the connection.
+func isProtocolErr(err error) bool {
+	switch err.(type) {
+	case BAD_MAGIC_ERR, BAD_COMMAND_ERR, BAD_CHECKSUM_ERR, MESSAGE_TOO_LARGE_ERR:
+		return true
+	}
+	return false
+}
@@ -3,17 +3,17 @@ package node
 import (
 	"bytes"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"os"
 	"path"
-	"sync"
 
 	"github.com/tiereum/trmnode/internal/block"
 	"github.com/tiereum/trmnode/internal/blockStore"
 	"github.com/tiereum/trmnode/internal/blockchain"
+	"github.com/tiereum/trmnode/internal/chainSync"
 	"github.com/tiereum/trmnode/internal/mempool"
 	"github.com/tiereum/trmnode/internal/miner"
+	"github.com/tiereum/trmnode/internal/rpc"
 	"github.com/tiereum/trmnode/internal/server"
 	"github.com/tiereum/trmnode/internal/t_config"
 	"github.com/tiereum/trmnode/internal/t_error"
@@ -29,6 +29,9 @@ type Node struct {
 	server         *server.Server
 	txValidator    *validator.TxValidator
 	blockValidator *validator.BlockValidator
+	syncer         *chainSync.Syncer
+	rpc            *rpc.Server
+	requests       chan func() // work from other goroutines, run by Run
 	blockchain     *blockchain.Blockchain
 	blockStore     *blockStore.BlockStore
 	txIndex        *transaction.TxIndexIO
@@ -43,47 +46,68 @@ func NewNode(ctx *t_config.Context, newConf *t_config.Config) *Node {
 	node := new(Node)
 	node.ctx = ctx
 
-	if node.ctx.NodeConfig.ClientAddress == nil {
-		if *newConf.ClientAddress == "" {
-			fmt.Println("Enter name for new wallet for node: ")
-			var name string
-			fmt.Scan(&name)
-			wallet := wallet.NewWallet(ctx, name)
-			wallet.Create()
-			node.ctx.NodeConfig.ClientAddress = &wallet.ClientId.Address
-		} else {
-			valid := wallet.ValidateAddress(*newConf.ClientAddress)
-			if !valid {
-				panic("Invalid address for node.")
-			}
-			node.ctx.NodeConfig.ClientAddress = newConf.ClientAddress
+	// flags given on the command line override the config file
+	if newConf.ClientAddress != nil && *newConf.ClientAddress != "" {
+		valid := wallet.ValidateAddress(*newConf.ClientAddress)
+		if !valid {
+			panic("Invalid address for node.")
 		}
+		node.ctx.NodeConfig.ClientAddress = newConf.ClientAddress
+	} else if node.ctx.NodeConfig.ClientAddress == nil {
+		fmt.Println("Enter name for new wallet for node: ")
+		var name string
+		fmt.Scan(&name)
+		wallet := wallet.NewWallet(ctx, name)
+		wallet.Create()
+		node.ctx.NodeConfig.ClientAddress = &wallet.ClientId.Address
 	}
-	if node.ctx.NodeConfig.NumTxInBlock == nil {
+	if newConf.NumTxInBlock != nil {
 		node.ctx.NodeConfig.NumTxInBlock = newConf.NumTxInBlock
 	}
-	if node.ctx.NodeConfig.RpcEndpointPort == nil {
-		node.ctx.NodeConfig.RpcEndpointPort = newConf.RpcEndpointPort
+	if newConf.P2PPort != nil {
+		node.ctx.NodeConfig.P2PPort = newConf.P2PPort
+	}
+	if newConf.RpcPort != nil {
+		node.ctx.NodeConfig.RpcPort = newConf.RpcPort
+	}
+	if newConf.BindHost != nil {
+		node.ctx.NodeConfig.BindHost = newConf.BindHost
 	}
+	node.ctx.NodeConfig.Peers = append(node.ctx.NodeConfig.Peers, newConf.Peers...)
 	node.blockStore = blockStore.NewBlockStore(node.ctx)
 	node.txIndex = transaction.NewTxIndexIO(node.ctx)
 	node.mempool = mempool.NewMempoolIO(node.ctx)
 	node.utxoStore = utxoSet.NewUtxoStore(node.ctx)
 	node.server = server.NewServer(node.ctx)
 
-	node.blockchain = blockchain.NewBlockchain(node.ctx, node.blockStore)
-	node.txValidator = validator.NewTxValidator(
+	node.blockchain = blockchain.NewBlockchain(
 		node.ctx,
-		node.txIndex,
 		node.blockStore,
+		node.utxoStore,
+		node.txIndex,
+		node.mempool)
+	node.txValidator = validator.NewTxValidator(
+		node.ctx,
+		node.blockchain,
 		node.mempool,
 		node.utxoStore)
 	node.blockValidator = validator.NewBlockValidator(
 		ctx,
 		node.blockchain,
 		node.txValidator)
+	node.blockchain.SetBlockChecker(node.blockValidator.ConnectBlock)
+	t_error.LogWarn(node.blockchain.ActivateBestChain())
+
+	node.syncer = chainSync.NewSyncer(
+		node.ctx,
+		node.server,
+		node.blockchain,
+		node.blockValidator,
+		node.mempool)
 
 	node.miner = miner.NewMiner(node.ctx, node.blockchain, node.mempool)
+	node.rpc = rpc.NewServer(node.ctx, node)
+	node.requests = make(chan func())
 
 	return node
 }
@@ -177,44 +201,82 @@ func (node *Node) DeleteTmpTx(hash string) {
 func (node *Node) Run() {
 
 	node.server.Run()
+	go node.rpc.Run()
 	node.CreateBlock(make([]byte, 0))
 	node.StartMiner()
 
 	for {
 		select {
 
-		case <-node.miner.Signal.SolveSignal.Ready:
+		case node.block = <-node.miner.Signal.SolveSignal.Ready:
 			// node has mined a block and added it to the blockchain
-			node.server.Block().InStream <- node.block
-			node.UpdateUtxoSet()
-			node.UpdateTxIndex()
-			node.AddBlock()
+			if err := node.AddBlock(); err != nil {
+				t_error.LogWarn(err)
+			} else {
+				node.syncer.Relay(server.INV_BLOCK, node.block.Hash(), nil)
+			}
 			node.CreateBlock(make([]byte, 0))
 
-		case tx := <-node.server.Tx().OutStream:
-			// incoming tx from network
-			node.tx = tx
-			if !node.ValidateTx() {
-				fmt.Println("Invalid tx")
+		case msg := <-node.server.Tx().OutStream:
+			// incoming tx from network, relayed once it is in the mempool
+			node.syncer.TxReceived(msg)
+			node.tx = msg.Tx
+			if err := node.AddTxToPool(); err != nil {
+				fmt.Println("Invalid tx:", err)
+				node.server.Misbehaving(msg.Peer, validator.BanScore(err), err.Error())
 			} else {
-				node.AddTxToPool()
+				node.syncer.Relay(server.INV_TX, msg.Tx.Hash(), msg.Peer)
 			}
 
-		case block := <-node.server.Block().OutStream:
-			// incoming block from network
-			if node.ValidateBlock() {
-				node.block = block
-				node.PauseMiner()
-				node.AddBlock()
-				node.CreateBlock(make([]byte, 0))
-				node.ResumeMiner()
+		case msg := <-node.server.Block().OutStream:
+			// incoming block from network, may extend a side branch
+			for _, ready := range node.syncer.BlockReceived(msg) {
+				if node.processBlock(ready) {
+					node.syncer.Relay(server.INV_BLOCK, ready.Block.Hash(), ready.Peer)
+				}
 			}
+
+		case peer := <-node.server.Connected():
+			node.syncer.PeerConnected(peer)
+
+		case msg := <-node.server.Sync():
+			node.syncer.HandleMessage(msg)
+
+		case <-node.syncer.Ticks():
+			node.syncer.OnTick()
+
+		case fn := <-node.requests:
+			// RPC call
+			fn()
+		}
+	}
+}
+
+// processBlock validates a block from the network and adds it to the
+// block tree, returning whether it was accepted. The peer that sent an
+// invalid block is penalized.
+func (node *Node) processBlock(msg *server.BlockMsg) bool {
+	if err := node.blockValidator.Validate(msg.Block); err != nil {
+		fmt.Println("Invalid block:", err)
+		if score := validator.BanScore(err); score > 0 {
+			node.syncer.BlockRejected(msg.Block.Hash())
+			node.server.Misbehaving(msg.Peer, score, err.Error())
 		}
+		return false
+	}
+	node.PauseMiner()
+	defer node.ResumeMiner()
+	err := node.miner.AddBlock(msg.Block)
+	node.CreateBlock(make([]byte, 0))
+	if err != nil {
+		t_error.LogWarn(err)
+		return false
 	}
+	return true
 }
 
 func (node *Node) StartMiner() {
-	go node.miner.MineFromMempool(node.block)
+	go node.miner.MineFromMempool()
 }
 
 func (node *Node) PauseMiner() {
@@ -229,51 +291,76 @@ func (node *Node) StartInteractive() {
 
 	for {
 		select {
-		case <-node.miner.Signal.SolveSignal.Ready:
+		case node.block = <-node.miner.Signal.SolveSignal.Ready:
 			os.WriteFile(path.Join(node.ctx.TmpDir, "blocks", hex.EncodeToString(node.block.Hash())), node.block.Serialize(), 0666)
 
-		case tx := <-node.server.Tx().OutStream:
-			os.WriteFile(path.Join(node.ctx.TmpDir, "txs", hex.EncodeToString(tx.Hash())), tx.Serialize(), 0666)
+		case msg := <-node.server.Tx().OutStream:
+			os.WriteFile(path.Join(node.ctx.TmpDir, "txs", hex.EncodeToString(msg.Tx.Hash())), msg.Tx.Serialize(), 0666)
 
-		case block := <-node.server.Block().OutStream:
-			os.WriteFile(path.Join(node.ctx.TmpDir, "blocks", hex.EncodeToString(block.Hash())), block.Serialize(), 0666)
+		case msg := <-node.server.Block().OutStream:
+			os.WriteFile(path.Join(node.ctx.TmpDir, "blocks", hex.EncodeToString(msg.Block.Hash())), msg.Block.Serialize(), 0666)
+
+		case <-node.server.Sync():
+			// interactive nodes don't serve or follow sync requests
 		}
 	}
 }
 
+// CreateBlock makes a template on the tip, after dropping pool txs the
+// tip no longer lets into it.
 func (node *Node) CreateBlock(coinbaseScript []byte) {
+	node.evictLockedTxs()
 	node.block = node.miner.CreateBlock(coinbaseScript)
 }
 
+func (node *Node) evictLockedTxs() {
+	for _, txid := range node.mempool.TxIds() {
+		tx, _, ok := node.mempool.Read(txid)
+		if ok && node.txValidator.CheckLocks(tx) != nil {
+			node.mempool.Delete(txid)
+		}
+	}
+}
+
 func (node *Node) Mine() {
 	node.miner.Mine(nil, node.block)
 }
 
 // Adds block to blockchain, updates UTXO set
-func (node *Node) AddBlock() {
-	node.miner.AddBlock(node.block)
+func (node *Node) AddBlock() error {
+	return node.miner.AddBlock(node.block)
 }
 
-func (node *Node) ValidateBlock() bool {
-	if node.block != nil {
-		return node.blockValidator.Validate(node.block)
-	}
+func (node *Node) ValidateBlock() error {
 	return node.blockValidator.Validate(node.block)
 }
 
-func (node *Node) AddTxToBlock() {
-	node.miner.AddTxToBlock(node.tx, node.block)
+// AddTxToBlock adds node.tx to node.block after the txs already in it.
+func (node *Node) AddTxToBlock() error {
+	parent := node.blockchain.Node(node.block.Header.PrevHash)
+	if parent == nil {
+		return validator.NewBlockErr(validator.REJECT_UNKNOWN_PARENT)
+	}
+	view := node.blockchain.View()
+	for i := 1; i < len(node.block.Transactions); i++ {
+		view.ConnectTx(&node.block.Transactions[i], parent.Height()+1)
+	}
+	return node.miner.AddTxToBlock(node.tx, node.block, view, parent.Height()+1)
 }
 
 func (node *Node) AddTxToPool() error {
-	if !node.txValidator.ValidateTx(node.tx) {
-		return errors.New("invalid tx")
+	if err := node.txValidator.ValidateTx(node.tx); err != nil {
+		return err
 	}
-	node.mempool.Write(node.tx.Hash(), node.tx, node.blockchain.GetFee(node.tx))
+	fee, err := node.blockchain.GetFee(node.tx)
+	if err != nil {
+		return err
+	}
+	node.mempool.Write(node.tx.Hash(), node.tx, fee)
 	return nil
 }
 
-func (node *Node) ValidateTx() bool {
+func (node *Node) ValidateTx() error {
 	return node.txValidator.ValidateTx(node.tx)
 }
 
@@ -284,52 +371,10 @@ func (node *Node) TxListen() <-chan *transaction.Tx {
 	return ch
 }
 
-func (node *Node) UpdateUtxoSet() {
-
-	if node.block.Transactions == nil {
-		return
-	}
-	wg := sync.WaitGroup{}
-	for _, tx := range node.block.Transactions {
-		wg.Add(1)
-		go func(tx *transaction.Tx) {
-			defer wg.Done()
-			for idx, out := range tx.Outputs {
-				wg.Add(1)
-				go func(out *transaction.TxOut, idx int32) {
-					defer wg.Done()
-					utxo := transaction.Utxo{
-						OutPoint: transaction.OutPoint{
-							TxId: tx.Hash(),
-							Idx:  idx,
-						},
-						Value:             out.Value,
-						LockingScriptSize: out.LockingScriptSize,
-						LockingScript:     out.LockingScript,
-					}
-					node.utxoStore.Write(&utxo)
-				}(&out, int32(idx))
-			}
-		}(&tx)
-	}
-	wg.Wait()
-}
-
-func (node *Node) UpdateTxIndex() {
-	for i, tx := range node.block.Transactions {
-		node.txIndex.Create(tx.Hash(), &transaction.TxMetadata{
-			BlockHash:   node.block.Hash(),
-			BlockHeight: node.blockchain.Height(),
-			Index:       uint8(i),
-		})
-	}
-}
-
 func (node *Node) Broadcast() {
 	node.server.Block().InStream <- node.block
 }
 
 func (node *Node) Genesis() {
 	node.block = node.miner.Genesis()
-	node.UpdateUtxoSet()
 }
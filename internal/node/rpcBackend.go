@@ -0,0 +1,69 @@
+package node
+
+import (
+	"github.com/tiereum/trmnode/internal/blockchain"
+	"github.com/tiereum/trmnode/internal/mempool"
+	"github.com/tiereum/trmnode/internal/rpc"
+	"github.com/tiereum/trmnode/internal/server"
+	"github.com/tiereum/trmnode/internal/transaction"
+	"github.com/tiereum/trmnode/internal/utxoSet"
+)
+
+// Node is the backend of its own RPC server.
+var _ rpc.Backend = (*Node)(nil)
+
+// Do runs fn on the main loop of Run and waits for it to finish.
+func (node *Node) Do(fn func()) {
+	done := make(chan struct{})
+	node.requests <- func() {
+		defer close(done)
+		fn()
+	}
+	<-done
+}
+
+func (node *Node) Blockchain() *blockchain.Blockchain {
+	return node.blockchain
+}
+
+func (node *Node) Mempool() *mempool.MempoolIO {
+	return node.mempool
+}
+
+func (node *Node) TxIndex() *transaction.TxIndexIO {
+	return node.txIndex
+}
+
+func (node *Node) UtxoStore() *utxoSet.UtxoStore {
+	return node.utxoStore
+}
+
+func (node *Node) SyncProgress() (int64, int64) {
+	return node.syncer.Progress()
+}
+
+func (node *Node) SubmitTx(tx *transaction.Tx) error {
+	node.tx = tx
+	if err := node.AddTxToPool(); err != nil {
+		return err
+	}
+	node.syncer.Relay(server.INV_TX, tx.Hash(), nil)
+	return nil
+}
+
+func (node *Node) PeerInfo() []rpc.PeerInfo {
+	peers := node.server.Peers()
+	info := make([]rpc.PeerInfo, len(peers))
+	for i, peer := range peers {
+		version, height, inFlight := node.syncer.PeerSync(peer)
+		info[i] = rpc.PeerInfo{
+			Addr:     peer.Addr,
+			Inbound:  peer.Inbound,
+			BanScore: peer.BanScore(),
+			Version:  version,
+			Height:   height,
+			InFlight: inFlight,
+		}
+	}
+	return info
+}
@@ -0,0 +1,24 @@
+package rpc
+
+import (
+	"github.com/tiereum/trmnode/internal/blockchain"
+	"github.com/tiereum/trmnode/internal/mempool"
+	"github.com/tiereum/trmnode/internal/transaction"
+	"github.com/tiereum/trmnode/internal/utxoSet"
+)
+
+// Backend is the running node the RPC methods query and control. The
+// stores and chain are only touched from inside Do, which runs on the
+// node's main loop between blocks and messages.
+type Backend interface {
+	Do(fn func())
+	Blockchain() *blockchain.Blockchain
+	Mempool() *mempool.MempoolIO
+	TxIndex() *transaction.TxIndexIO
+	UtxoStore() *utxoSet.UtxoStore
+	// SyncProgress returns the height of the tip and of the best header.
+	SyncProgress() (int64, int64)
+	// SubmitTx validates tx, adds it to the mempool and relays it.
+	SubmitTx(tx *transaction.Tx) error
+	PeerInfo() []PeerInfo
+}
@@ -0,0 +1,124 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tiereum/trmnode/internal/t_config"
+)
+
+const CLIENT_TIMEOUT = 5 * time.Minute
+
+type NODE_UNREACHABLE_ERR struct {
+	Addr string
+}
+
+func (e NODE_UNREACHABLE_ERR) Error() string {
+	return "No node is answering RPC requests on " + e.Addr + ". Start one with `run`."
+}
+
+type UNAUTHORIZED_ERR struct{}
+
+func (e UNAUTHORIZED_ERR) Error() string {
+	return "The node rejected the RPC credentials. Check rpcUser and rpcPassword or the cookie file."
+}
+
+// Client sends requests to the node running under the same root dir. It
+// authenticates as RpcUser when the config sets one and with the node's
+// cookie otherwise.
+type Client struct {
+	ctx    *t_config.Context
+	addr   string
+	http   *http.Client
+	nextId int
+}
+
+func NewClient(ctx *t_config.Context) *Client {
+	client := new(Client)
+	client.ctx = ctx
+	client.addr = net.JoinHostPort(RPC_BIND_HOST, strconv.Itoa(int(*ctx.NodeConfig.RpcPort)))
+	client.http = &http.Client{Timeout: CLIENT_TIMEOUT}
+	return client
+}
+
+func (client *Client) credentials() (string, string, error) {
+	conf := client.ctx.NodeConfig
+	if conf.RpcUser != nil && conf.RpcPassword != nil && *conf.RpcUser != "" {
+		return *conf.RpcUser, *conf.RpcPassword, nil
+	}
+	cookie, err := os.ReadFile(CookiePath(client.ctx))
+	if os.IsNotExist(err) {
+		return "", "", NODE_UNREACHABLE_ERR{Addr: client.addr}
+	} else if err != nil {
+		return "", "", err
+	}
+	user, pass, ok := strings.Cut(string(cookie), ":")
+	if !ok {
+		return "", "", UNAUTHORIZED_ERR{}
+	}
+	return user, pass, nil
+}
+
+// Call runs method with positional params and decodes its result into
+// result, which may be nil. A failed method comes back as an *Error.
+func (client *Client) Call(method string, result any, params ...any) error {
+	if params == nil {
+		params = []any{}
+	}
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	client.nextId++
+	body, err := json.Marshal(&Request{
+		JsonRpc: JSONRPC_2_0,
+		Method:  method,
+		Params:  rawParams,
+		Id:      json.RawMessage(strconv.Itoa(client.nextId)),
+	})
+	if err != nil {
+		return err
+	}
+
+	user, pass, err := client.credentials()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+client.addr, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(user, pass)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.http.Do(req)
+	if err != nil {
+		return NODE_UNREACHABLE_ERR{Addr: client.addr}
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusUnauthorized {
+		return UNAUTHORIZED_ERR{}
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("rpc request failed: %s", res.Status)
+	}
+
+	response := new(Response)
+	if err := json.NewDecoder(res.Body).Decode(response); err != nil {
+		return err
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
@@ -0,0 +1,493 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/tiereum/trmnode/internal/block"
+	"github.com/tiereum/trmnode/internal/blockchain"
+	"github.com/tiereum/trmnode/internal/client"
+	"github.com/tiereum/trmnode/internal/transaction"
+	"github.com/tiereum/trmnode/internal/utxoSet"
+)
+
+type method func(backend Backend, params []json.RawMessage) (any, *Error)
+
+var methods = map[string]method{
+	"getblockchaininfo":  getBlockchainInfo,
+	"getchain":           getChain,
+	"getblockhash":       getBlockHash,
+	"getblock":           getBlock,
+	"getblockheader":     getBlockHeader,
+	"getrawtransaction":  getRawTransaction,
+	"sendrawtransaction": sendRawTransaction,
+	"getmempoolinfo":     getMempoolInfo,
+	"getrawmempool":      getRawMempool,
+	"getbalance":         getBalance,
+	"listunspent":        listUnspent,
+	"gettxoutsetinfo":    getTxOutSetInfo,
+	"dumptxoutset":       dumpTxOutSet,
+	"getpeerinfo":        getPeerInfo,
+}
+
+// param decodes the i-th positional parameter into v. A missing optional
+// parameter leaves v unchanged.
+func param(params []json.RawMessage, i int, v any, required bool) *Error {
+	if i >= len(params) {
+		if required {
+			return &Error{ERR_INVALID_PARAMS, fmt.Sprintf("missing parameter %d", i)}
+		}
+		return nil
+	}
+	if err := json.Unmarshal(params[i], v); err != nil {
+		return &Error{ERR_INVALID_PARAMS, fmt.Sprintf("parameter %d: %s", i, err)}
+	}
+	return nil
+}
+
+func hashParam(params []json.RawMessage, i int) ([]byte, *Error) {
+	var s string
+	if err := param(params, i, &s, true); err != nil {
+		return nil, err
+	}
+	hash, err := hex.DecodeString(s)
+	if err != nil || len(hash) != 32 {
+		return nil, &Error{ERR_INVALID_PARAMS, fmt.Sprintf("parameter %d must be a 32 byte hex hash", i)}
+	}
+	return hash, nil
+}
+
+func getBlockchainInfo(backend Backend, params []json.RawMessage) (any, *Error) {
+	info := &BlockchainInfo{}
+	backend.Do(func() {
+		height, best := backend.SyncProgress()
+		info.Blocks = height
+		info.Headers = best
+		info.VerificationProgress = 1
+		if best > 0 {
+			info.VerificationProgress = float64(max(height, 0)) / float64(best)
+		}
+		info.InitialBlockDownload = height < best
+		if tip := backend.Blockchain().Tip(); tip != nil {
+			info.BestBlockHash = hex.EncodeToString(tip.Hash())
+			info.Bits = fmt.Sprintf("%08x", tip.Meta.Bits)
+			info.MedianTime = tip.MedianTimePast()
+			info.ChainWork = tip.ChainWork().Text(16)
+		}
+	})
+	return info, nil
+}
+
+// getchain [count=0] lists the main chain from the tip back to genesis, or
+// only its last count blocks.
+func getChain(backend Backend, params []json.RawMessage) (any, *Error) {
+	count := 0
+	if rpcErr := param(params, 0, &count, false); rpcErr != nil {
+		return nil, rpcErr
+	}
+	if count < 0 {
+		return nil, &Error{ERR_INVALID_PARAMS, "count must not be negative"}
+	}
+
+	entries := make([]ChainEntry, 0)
+	backend.Do(func() {
+		iter := backend.Blockchain().Iterator()
+		for iter.Next(); iter.Valid(); iter.Next() {
+			if count > 0 && len(entries) == count {
+				break
+			}
+			b := iter.Block()
+			entries = append(entries, ChainEntry{
+				Hash:    hex.EncodeToString(iter.Metadata().Hash),
+				Height:  iter.Metadata().Height.Int64(),
+				Time:    b.Header.TimeStamp,
+				TxCount: len(b.Transactions),
+			})
+		}
+	})
+	return entries, nil
+}
+
+// getblockhash [height] returns the hash of the main chain block at height.
+func getBlockHash(backend Backend, params []json.RawMessage) (any, *Error) {
+	var height int64
+	if rpcErr := param(params, 0, &height, true); rpcErr != nil {
+		return nil, rpcErr
+	}
+	var hash []byte
+	backend.Do(func() {
+		hash, _ = backend.Blockchain().HashAtHeight(height)
+	})
+	if hash == nil {
+		return nil, &Error{ERR_NOT_FOUND, "block height out of range"}
+	}
+	return hex.EncodeToString(hash), nil
+}
+
+func headerResult(chain *blockchain.Blockchain, node *blockchain.BlockNode, header *block.Header) BlockHeaderResult {
+	result := BlockHeaderResult{
+		Hash:          hex.EncodeToString(node.Hash()),
+		Confirmations: -1,
+		Height:        node.Height(),
+		Version:       header.Version,
+		MerkleRoot:    hex.EncodeToString(header.MerkleRootHash),
+		Time:          header.TimeStamp,
+		MedianTime:    node.MedianTimePast(),
+		Nonce:         header.Nonce,
+		Bits:          fmt.Sprintf("%08x", header.Bits),
+		ChainWork:     node.ChainWork().Text(16),
+	}
+	if node.Parent != nil {
+		result.PreviousBlockHash = hex.EncodeToString(node.Parent.Hash())
+	}
+	if tip := chain.Tip(); chain.IsOnMainChain(node.Hash()) {
+		result.Confirmations = tip.Height() - node.Height() + 1
+		if next := tip.Ancestor(node.Height() + 1); next != nil {
+			result.NextBlockHash = hex.EncodeToString(next.Hash())
+		}
+	}
+	return result
+}
+
+// lookupBlock runs fn with the stored block and its tree node, or returns
+// a not found error.
+func lookupBlock(backend Backend, hash []byte, fn func(*blockchain.BlockNode, *block.Block)) *Error {
+	found := false
+	backend.Do(func() {
+		chain := backend.Blockchain()
+		node := chain.Node(hash)
+		if node == nil {
+			return
+		}
+		b, _ := chain.Block(hash)
+		if b == nil {
+			return
+		}
+		found = true
+		fn(node, b)
+	})
+	if !found {
+		return &Error{ERR_NOT_FOUND, "block not found"}
+	}
+	return nil
+}
+
+// getblock [hash, verbose=true]
+func getBlock(backend Backend, params []json.RawMessage) (any, *Error) {
+	hash, rpcErr := hashParam(params, 0)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	verbose := true
+	if rpcErr := param(params, 1, &verbose, false); rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	var result any
+	rpcErr = lookupBlock(backend, hash, func(node *blockchain.BlockNode, b *block.Block) {
+		if !verbose {
+			result = hex.EncodeToString(b.Serialize())
+			return
+		}
+		txids := make([]string, len(b.Transactions))
+		for i, tx := range b.Transactions {
+			txids[i] = hex.EncodeToString(tx.Hash())
+		}
+		result = &BlockResult{
+			BlockHeaderResult: headerResult(backend.Blockchain(), node, &b.Header),
+			TxCount:           len(b.Transactions),
+			Tx:                txids,
+		}
+	})
+	return result, rpcErr
+}
+
+// getblockheader [hash, verbose=true]
+func getBlockHeader(backend Backend, params []json.RawMessage) (any, *Error) {
+	hash, rpcErr := hashParam(params, 0)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	verbose := true
+	if rpcErr := param(params, 1, &verbose, false); rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	var result any
+	rpcErr = lookupBlock(backend, hash, func(node *blockchain.BlockNode, b *block.Block) {
+		if !verbose {
+			enc := block.NewHeaderEncoder(nil)
+			enc.Encode(&b.Header)
+			result = hex.EncodeToString(enc.Bytes())
+			return
+		}
+		header := headerResult(backend.Blockchain(), node, &b.Header)
+		result = &header
+	})
+	return result, rpcErr
+}
+
+func txResult(tx *transaction.Tx) *TxResult {
+	result := &TxResult{
+		TxId:     hex.EncodeToString(tx.Hash()),
+		Hex:      hex.EncodeToString(tx.Serialize()),
+		Version:  tx.Version,
+		LockTime: tx.LockTime,
+		Vin:      make([]VinResult, len(tx.Inputs)),
+		Vout:     make([]VoutResult, len(tx.Outputs)),
+	}
+	coinbase := tx.IsCoinbase()
+	for i, in := range tx.Inputs {
+		result.Vin[i] = VinResult{
+			Coinbase:  coinbase,
+			TxId:      hex.EncodeToString(in.PrevOutpt.TxId),
+			Vout:      in.PrevOutpt.Idx,
+			ScriptSig: hex.EncodeToString(in.UnlockingScript),
+			Sequence:  in.Sequence,
+		}
+	}
+	for i, out := range tx.Outputs {
+		result.Vout[i] = VoutResult{
+			Value:        out.Value,
+			N:            i,
+			ScriptPubKey: hex.EncodeToString(out.LockingScript),
+		}
+		result.Vout[i].Address = transaction.LockScriptAddress(out.LockingScript)
+	}
+	return result
+}
+
+// getrawtransaction [txid, verbose=false] looks in the mempool, then in
+// the tx index.
+func getRawTransaction(backend Backend, params []json.RawMessage) (any, *Error) {
+	txid, rpcErr := hashParam(params, 0)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	verbose := false
+	if rpcErr := param(params, 1, &verbose, false); rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	var tx *transaction.Tx
+	var blockHash []byte
+	var confirmations int64
+	backend.Do(func() {
+		if pooled, _, ok := backend.Mempool().Read(txid); ok {
+			tx = pooled
+			return
+		}
+		if !backend.TxIndex().Has(txid) {
+			return
+		}
+		meta := backend.TxIndex().Read(txid)
+		chain := backend.Blockchain()
+		b, _ := chain.Block(meta.BlockHash)
+		if b == nil || int(meta.Index) >= len(b.Transactions) {
+			return
+		}
+		tx = &b.Transactions[meta.Index]
+		blockHash = meta.BlockHash
+		if node := chain.Node(blockHash); node != nil && chain.IsOnMainChain(blockHash) {
+			confirmations = chain.Tip().Height() - node.Height() + 1
+		}
+	})
+	if tx == nil {
+		return nil, &Error{ERR_NOT_FOUND, "tx not found"}
+	}
+	if !verbose {
+		return hex.EncodeToString(tx.Serialize()), nil
+	}
+	result := txResult(tx)
+	if blockHash != nil {
+		result.BlockHash = hex.EncodeToString(blockHash)
+	}
+	result.Confirmations = confirmations
+	return result, nil
+}
+
+// sendrawtransaction [hex] returns the txid once the tx is in the mempool.
+func sendRawTransaction(backend Backend, params []json.RawMessage) (any, *Error) {
+	var s string
+	if rpcErr := param(params, 0, &s, true); rpcErr != nil {
+		return nil, rpcErr
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, &Error{ERR_DESERIALIZE, "tx is not hex"}
+	}
+	dec := transaction.NewTxDecoder(nil)
+	if err := dec.Decode(bytes.NewBuffer(b)); err != nil {
+		return nil, &Error{ERR_DESERIALIZE, err.Error()}
+	}
+	tx := dec.Out()
+
+	backend.Do(func() {
+		err = backend.SubmitTx(tx)
+	})
+	if err != nil {
+		return nil, &Error{ERR_REJECTED, err.Error()}
+	}
+	return hex.EncodeToString(tx.Hash()), nil
+}
+
+func getMempoolInfo(backend Backend, params []json.RawMessage) (any, *Error) {
+	info := &MempoolInfo{}
+	backend.Do(func() {
+		info.Size, info.Bytes, info.Fees = backend.Mempool().Stats()
+	})
+	return info, nil
+}
+
+// getrawmempool [verbose=false] lists the txids in the mempool, or their
+// size and fee too when verbose.
+func getRawMempool(backend Backend, params []json.RawMessage) (any, *Error) {
+	verbose := false
+	if rpcErr := param(params, 0, &verbose, false); rpcErr != nil {
+		return nil, rpcErr
+	}
+	txids := make([]string, 0)
+	entries := make([]MempoolEntry, 0)
+	backend.Do(func() {
+		pool := backend.Mempool()
+		for _, txid := range pool.TxIds() {
+			txids = append(txids, hex.EncodeToString(txid))
+			if !verbose {
+				continue
+			}
+			if tx, fee, ok := pool.Read(txid); ok {
+				entries = append(entries, MempoolEntry{
+					TxId: hex.EncodeToString(txid),
+					Size: len(tx.Serialize()),
+					Fee:  fee,
+				})
+			}
+		}
+	})
+	if verbose {
+		return entries, nil
+	}
+	return txids, nil
+}
+
+// getbalance [address] sums the confirmed outputs paying to address.
+func getBalance(backend Backend, params []json.RawMessage) (any, *Error) {
+	var address string
+	if rpcErr := param(params, 0, &address, true); rpcErr != nil {
+		return nil, rpcErr
+	}
+	if _, _, err := client.DecodeAddress(address); err != nil {
+		return nil, &Error{ERR_NOT_FOUND, err.Error()}
+	}
+
+	result := &BalanceResult{Address: address}
+	backend.Do(func() {
+		utxos := backend.UtxoStore().FindUTXOsByAddr(address)
+		result.Utxos = len(utxos)
+		for _, utxo := range utxos {
+			result.Balance += utxo.Value
+		}
+	})
+	return result, nil
+}
+
+// listunspent [address] lists the confirmed outputs paying to address, or
+// the whole utxo set when no address is given.
+func listUnspent(backend Backend, params []json.RawMessage) (any, *Error) {
+	var address string
+	if rpcErr := param(params, 0, &address, false); rpcErr != nil {
+		return nil, rpcErr
+	}
+	if address != "" {
+		if _, _, err := client.DecodeAddress(address); err != nil {
+			return nil, &Error{ERR_NOT_FOUND, err.Error()}
+		}
+	}
+
+	unspent := make([]UnspentResult, 0)
+	var next int64 // height of the next block, set before add runs
+	add := func(utxo *transaction.Utxo) {
+		result := UnspentResult{
+			TxId:         hex.EncodeToString(utxo.OutPoint.TxId),
+			Vout:         utxo.OutPoint.Idx,
+			Value:        utxo.Value,
+			ScriptPubKey: hex.EncodeToString(utxo.LockingScript),
+			Height:       utxo.Height,
+			Coinbase:     utxo.Coinbase,
+			Spendable:    utxo.IsMature(next),
+		}
+		result.Address = transaction.LockScriptAddress(utxo.LockingScript)
+		unspent = append(unspent, result)
+	}
+	backend.Do(func() {
+		h := backend.Blockchain().Height()
+		next = h.Int64() + 1
+		if address == "" {
+			backend.UtxoStore().ForEach(add)
+			return
+		}
+		utxos := backend.UtxoStore().FindUTXOsByAddr(address)
+		for i := range utxos {
+			add(&utxos[i])
+		}
+	})
+	return unspent, nil
+}
+
+// txOutSetInfo describes stats, looking up the height of its best block.
+func txOutSetInfo(backend Backend, stats *utxoSet.UtxoStats) *TxOutSetInfo {
+	info := &TxOutSetInfo{
+		Height:      -1,
+		BestBlock:   hex.EncodeToString(stats.BestBlock),
+		TxOuts:      stats.Count,
+		TotalAmount: stats.Total,
+		Hash:        hex.EncodeToString(stats.Hash),
+	}
+	backend.Do(func() {
+		if node := backend.Blockchain().Node(stats.BestBlock); node != nil {
+			info.Height = node.Height()
+		}
+	})
+	return info
+}
+
+// gettxoutsetinfo reports the size, total value and hash of the utxo set.
+// The set is read from a store snapshot, so the node keeps running.
+func getTxOutSetInfo(backend Backend, params []json.RawMessage) (any, *Error) {
+	return txOutSetInfo(backend, backend.UtxoStore().Stats()), nil
+}
+
+// dumptxoutset path writes the utxo set to a snapshot file at path, which
+// must not exist yet.
+func dumpTxOutSet(backend Backend, params []json.RawMessage) (any, *Error) {
+	var path string
+	if rpcErr := param(params, 0, &path, true); rpcErr != nil {
+		return nil, rpcErr
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, &Error{ERR_INVALID_PARAMS, err.Error()}
+	}
+	stats, err := backend.UtxoStore().Dump(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, &Error{ERR_INTERNAL, err.Error()}
+	}
+	info := txOutSetInfo(backend, stats)
+	info.Path = path
+	return info, nil
+}
+
+func getPeerInfo(backend Backend, params []json.RawMessage) (any, *Error) {
+	var peers []PeerInfo
+	backend.Do(func() {
+		peers = backend.PeerInfo()
+	})
+	return peers, nil
+}
@@ -0,0 +1,113 @@
+package rpc
+
+type BlockchainInfo struct {
+	Blocks               int64   `json:"blocks"`
+	Headers              int64   `json:"headers"`
+	BestBlockHash        string  `json:"bestblockhash"`
+	Bits                 string  `json:"bits"`
+	MedianTime           uint32  `json:"mediantime"`
+	ChainWork            string  `json:"chainwork"`
+	VerificationProgress float64 `json:"verificationprogress"`
+	InitialBlockDownload bool    `json:"initialblockdownload"`
+}
+
+type BlockHeaderResult struct {
+	Hash              string `json:"hash"`
+	Confirmations     int64  `json:"confirmations"` // -1 when not on the main chain
+	Height            int64  `json:"height"`
+	Version           int32  `json:"version"`
+	MerkleRoot        string `json:"merkleroot"`
+	Time              uint32 `json:"time"`
+	MedianTime        uint32 `json:"mediantime"`
+	Nonce             uint32 `json:"nonce"`
+	Bits              string `json:"bits"`
+	ChainWork         string `json:"chainwork"`
+	PreviousBlockHash string `json:"previousblockhash,omitempty"`
+	NextBlockHash     string `json:"nextblockhash,omitempty"`
+}
+
+type BlockResult struct {
+	BlockHeaderResult
+	TxCount int      `json:"nTx"`
+	Tx      []string `json:"tx"`
+}
+
+type VinResult struct {
+	Coinbase  bool   `json:"coinbase,omitempty"`
+	TxId      string `json:"txid"`
+	Vout      int32  `json:"vout"`
+	ScriptSig string `json:"scriptSig"`
+	Sequence  uint32 `json:"sequence"`
+}
+
+type VoutResult struct {
+	Value        int64  `json:"value"`
+	N            int    `json:"n"`
+	ScriptPubKey string `json:"scriptPubKey"`
+	Address      string `json:"address,omitempty"`
+}
+
+type TxResult struct {
+	TxId          string       `json:"txid"`
+	Hex           string       `json:"hex"`
+	Version       int32        `json:"version"`
+	LockTime      uint32       `json:"locktime"`
+	Vin           []VinResult  `json:"vin"`
+	Vout          []VoutResult `json:"vout"`
+	BlockHash     string       `json:"blockhash,omitempty"` // empty while in the mempool
+	Confirmations int64        `json:"confirmations"`
+}
+
+type MempoolInfo struct {
+	Size  int64 `json:"size"`
+	Bytes int64 `json:"bytes"`
+	Fees  int64 `json:"fees"`
+}
+
+type BalanceResult struct {
+	Address string `json:"address"`
+	Balance int64  `json:"balance"`
+	Utxos   int    `json:"utxos"`
+}
+
+type PeerInfo struct {
+	Addr     string `json:"addr"`
+	Inbound  bool   `json:"inbound"`
+	BanScore int    `json:"banscore"`
+	Version  int32  `json:"version"`
+	Height   int64  `json:"height"` // -1 before the handshake
+	InFlight int    `json:"inflight"`
+}
+
+type UnspentResult struct {
+	TxId         string `json:"txid"`
+	Vout         int32  `json:"vout"`
+	Value        int64  `json:"value"`
+	ScriptPubKey string `json:"scriptPubKey"`
+	Address      string `json:"address,omitempty"`
+	Height       uint32 `json:"height"`
+	Coinbase     bool   `json:"coinbase"`
+	Spendable    bool   `json:"spendable"` // false for coinbase outputs that are not mature yet
+}
+
+type ChainEntry struct {
+	Hash    string `json:"hash"`
+	Height  int64  `json:"height"`
+	Time    uint32 `json:"time"`
+	TxCount int    `json:"nTx"`
+}
+
+type MempoolEntry struct {
+	TxId string `json:"txid"`
+	Size int    `json:"size"`
+	Fee  int64  `json:"fee"`
+}
+
+type TxOutSetInfo struct {
+	Height      int64  `json:"height"` // -1 when the best block is not in the block tree
+	BestBlock   string `json:"bestblock"`
+	TxOuts      uint64 `json:"txouts"`
+	TotalAmount int64  `json:"total_amount"`
+	Hash        string `json:"hash_serialized"`
+	Path        string `json:"path,omitempty"`
+}
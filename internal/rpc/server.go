@@ -0,0 +1,201 @@
+package rpc
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/tiereum/trmnode/internal/t_config"
+	"github.com/tiereum/trmnode/internal/t_error"
+)
+
+const (
+	COOKIE_USER   = "__cookie__"
+	MAX_BODY      = 4 * 1024 * 1024
+	JSONRPC_2_0   = "2.0"
+	COOKIE_FILE   = ".cookie"
+	RPC_BIND_HOST = "127.0.0.1"
+)
+
+// JSON-RPC 2.0 error codes, and the application codes used by the methods.
+const (
+	ERR_PARSE            = -32700
+	ERR_INVALID_REQUEST  = -32600
+	ERR_METHOD_NOT_FOUND = -32601
+	ERR_INVALID_PARAMS   = -32602
+	ERR_INTERNAL         = -32603
+
+	ERR_NOT_FOUND   = -5  // unknown block, tx or address
+	ERR_DESERIALIZE = -22 // hex data does not decode
+	ERR_REJECTED    = -26 // tx failed validation
+)
+
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+type Request struct {
+	JsonRpc string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"` // positional, an array
+	Id      json.RawMessage `json:"id,omitempty"`
+}
+
+type Response struct {
+	JsonRpc string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	Id      json.RawMessage `json:"id"`
+}
+
+// Server answers JSON-RPC 2.0 requests over HTTP on the configured
+// RpcPort. Requests authenticate with basic auth, either as RpcUser and
+// RpcPassword from the config or with the cookie written to the root dir
+// on start.
+type Server struct {
+	ctx     *t_config.Context
+	backend Backend
+	cookie  string
+}
+
+func NewServer(ctx *t_config.Context, backend Backend) *Server {
+	server := new(Server)
+	server.ctx = ctx
+	server.backend = backend
+	return server
+}
+
+func CookiePath(ctx *t_config.Context) string {
+	return path.Join(ctx.TerieumRoot, COOKIE_FILE)
+}
+
+// Run writes a fresh cookie and serves requests. It does not return.
+func (server *Server) Run() {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	t_error.LogErr(err)
+	server.cookie = COOKIE_USER + ":" + hex.EncodeToString(secret)
+	t_error.LogErr(os.WriteFile(CookiePath(server.ctx), []byte(server.cookie), 0600))
+
+	addr := net.JoinHostPort(RPC_BIND_HOST, strconv.Itoa(int(*server.ctx.NodeConfig.RpcPort)))
+	fmt.Println("RPC listening on " + addr + "\n")
+	t_error.LogErr(http.ListenAndServe(addr, server))
+}
+
+func (server *Server) authorized(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	given := []byte(user + ":" + pass)
+	if subtle.ConstantTimeCompare(given, []byte(server.cookie)) == 1 {
+		return true
+	}
+	conf := server.ctx.NodeConfig
+	if conf.RpcUser == nil || conf.RpcPassword == nil || *conf.RpcUser == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare(given, []byte(*conf.RpcUser+":"+*conf.RpcPassword)) == 1
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "JSON-RPC requests must be POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !server.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="jsonrpc"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, MAX_BODY))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var reply any
+	if batch := []json.RawMessage{}; json.Unmarshal(body, &batch) == nil {
+		responses := make([]*Response, 0, len(batch))
+		for _, raw := range batch {
+			if response := server.handle(raw); response != nil {
+				responses = append(responses, response)
+			}
+		}
+		if len(batch) == 0 {
+			reply = &Response{JsonRpc: JSONRPC_2_0, Error: &Error{ERR_INVALID_REQUEST, "empty batch"}, Id: json.RawMessage("null")}
+		} else if len(responses) > 0 {
+			reply = responses
+		}
+	} else if response := server.handle(body); response != nil {
+		reply = response
+	}
+
+	if reply == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	t_error.LogWarn(json.NewEncoder(w).Encode(reply))
+}
+
+// handle runs a single request. Notifications, requests without an id, get
+// no response.
+func (server *Server) handle(raw json.RawMessage) *Response {
+	req := new(Request)
+	if err := json.Unmarshal(raw, req); err != nil {
+		return &Response{JsonRpc: JSONRPC_2_0, Error: &Error{ERR_PARSE, err.Error()}, Id: json.RawMessage("null")}
+	}
+	if req.JsonRpc != JSONRPC_2_0 || req.Method == "" {
+		return &Response{JsonRpc: JSONRPC_2_0, Error: &Error{ERR_INVALID_REQUEST, "not a JSON-RPC 2.0 request"}, Id: nullId(req.Id)}
+	}
+
+	var result any
+	var rpcErr *Error
+	params := make([]json.RawMessage, 0)
+	method, ok := methods[req.Method]
+	if !ok {
+		rpcErr = &Error{ERR_METHOD_NOT_FOUND, "method not found: " + req.Method}
+	} else if len(req.Params) > 0 && json.Unmarshal(req.Params, &params) != nil {
+		rpcErr = &Error{ERR_INVALID_PARAMS, "params must be an array"}
+	} else {
+		result, rpcErr = method(server.backend, params)
+	}
+
+	if req.Id == nil {
+		return nil
+	}
+	response := &Response{JsonRpc: JSONRPC_2_0, Id: req.Id}
+	if rpcErr == nil {
+		var err error
+		response.Result, err = json.Marshal(result)
+		if err != nil {
+			rpcErr = &Error{ERR_INTERNAL, err.Error()}
+		}
+	}
+	response.Error = rpcErr
+	if rpcErr != nil {
+		response.Result = nil
+	}
+	return response
+}
+
+func nullId(id json.RawMessage) json.RawMessage {
+	if id == nil {
+		return json.RawMessage("null")
+	}
+	return id
+}
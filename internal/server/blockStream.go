@@ -4,17 +4,24 @@ import (
 	"bytes"
 
 	"github.com/tiereum/trmnode/internal/block"
+	"github.com/tiereum/trmnode/internal/network"
 )
 
+// BlockMsg is a block received from the network and the peer it came from.
+type BlockMsg struct {
+	Block *block.Block
+	Peer  *network.Peer
+}
+
 type _BlockStream struct {
 	inStream  chan *block.Block
-	outStream chan *block.Block
+	outStream chan *BlockMsg
 }
 
 func NewBlockStream() *_BlockStream {
 	stream := new(_BlockStream)
 	stream.inStream = make(chan *block.Block)
-	stream.outStream = make(chan *block.Block)
+	stream.outStream = make(chan *BlockMsg)
 	return stream
 }
 
@@ -22,23 +29,25 @@ func (stream *_BlockStream) InStream() chan *block.Block {
 	return stream.inStream
 }
 
-func (stream *_BlockStream) OutStream() chan *block.Block {
+func (stream *_BlockStream) OutStream() chan *BlockMsg {
 	return stream.outStream
 }
 
-func (stream *_BlockStream) writeToOut(b []byte) {
+func (stream *_BlockStream) writeToOut(peer *network.Peer, b []byte) error {
 
 	buffer := bytes.Buffer{}
 	buffer.Write(b)
 	blockDec := block.NewBlockDecoder(nil)
-	blockDec.Decode(&buffer)
-	stream.outStream <- blockDec.Out()
+	if err := blockDec.Decode(&buffer); err != nil {
+		return err
+	}
+	stream.outStream <- &BlockMsg{Block: blockDec.Out(), Peer: peer}
+	return nil
 }
 
 func (stream *_BlockStream) readFromIn() []byte {
 
 	buffer := bytes.Buffer{}
-	buffer.WriteByte(BLOCK_MESSAGE)
 	blockEnc := block.NewBlockEncoder(&buffer)
 	block := <-stream.inStream
 	blockEnc.Encode(block)
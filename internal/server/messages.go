@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/tiereum/trmnode/internal/block"
+)
+
+type BAD_MESSAGE_ERR struct{}
+
+func (e BAD_MESSAGE_ERR) Error() string {
+	return "Incorrect message format."
+}
+
+const (
+	INV_TX    uint8 = 0x01
+	INV_BLOCK uint8 = 0x02
+)
+
+// MAX_LOCATOR_SIZE bounds the hashes a locator may carry. Locators step
+// back exponentially, so an honest one never comes near it.
+const MAX_LOCATOR_SIZE = 101
+
+// VersionMsg opens the handshake and tells the peer how far our chain goes.
+type VersionMsg struct {
+	Version  int32
+	Height   int64
+	BestHash []byte // 32 bytes
+}
+
+func (m *VersionMsg) Serialize() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, m.Version)
+	binary.Write(buffer, binary.BigEndian, m.Height)
+	buffer.Write(m.BestHash)
+	return buffer.Bytes()
+}
+
+func (m *VersionMsg) Decode(buffer *bytes.Buffer) error {
+	if buffer.Len() < 4+8+32 {
+		return BAD_MESSAGE_ERR{}
+	}
+	m.Version = int32(binary.BigEndian.Uint32(buffer.Next(4)))
+	m.Height = int64(binary.BigEndian.Uint64(buffer.Next(8)))
+	m.BestHash = buffer.Next(32)
+	return nil
+}
+
+// LocatorMsg is the payload of getheaders and getblocks. Hashes describe
+// the sender's chain from its tip back to genesis, more sparsely the
+// further back they go, so the receiver can find the fork point.
+type LocatorMsg struct {
+	Hashes   [][]byte
+	StopHash []byte // 32 bytes, zero to get as many as allowed
+}
+
+func (m *LocatorMsg) Serialize() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, uint32(len(m.Hashes)))
+	for _, hash := range m.Hashes {
+		buffer.Write(hash)
+	}
+	buffer.Write(m.StopHash)
+	return buffer.Bytes()
+}
+
+func (m *LocatorMsg) Decode(buffer *bytes.Buffer) error {
+	if buffer.Len() < 4 {
+		return BAD_MESSAGE_ERR{}
+	}
+	n := binary.BigEndian.Uint32(buffer.Next(4))
+	if n > MAX_LOCATOR_SIZE || uint64(buffer.Len()) < (uint64(n)+1)*32 {
+		return BAD_MESSAGE_ERR{}
+	}
+	m.Hashes = make([][]byte, n)
+	for i := range m.Hashes {
+		m.Hashes[i] = buffer.Next(32)
+	}
+	m.StopHash = buffer.Next(32)
+	return nil
+}
+
+type HeadersMsg struct {
+	Headers []block.Header
+}
+
+func (m *HeadersMsg) Serialize() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, uint32(len(m.Headers)))
+	enc := block.NewHeaderEncoder(buffer)
+	for _, header := range m.Headers {
+		enc.Encode(&header)
+	}
+	return buffer.Bytes()
+}
+
+func (m *HeadersMsg) Decode(buffer *bytes.Buffer) error {
+	if buffer.Len() < 4 {
+		return BAD_MESSAGE_ERR{}
+	}
+	n := binary.BigEndian.Uint32(buffer.Next(4))
+	m.Headers = make([]block.Header, 0, min(n, 2000))
+	for range n {
+		dec := block.NewHeaderDecoder(nil)
+		if err := dec.Decode(buffer); err != nil {
+			return err
+		}
+		m.Headers = append(m.Headers, *dec.Out())
+	}
+	return nil
+}
+
+type InvVect struct {
+	Type uint8
+	Hash []byte // 32 bytes
+}
+
+// InvMsg is the payload of inv, announcing objects, and getdata,
+// requesting them.
+type InvMsg struct {
+	Inv []InvVect
+}
+
+func (m *InvMsg) Serialize() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, uint32(len(m.Inv)))
+	for _, inv := range m.Inv {
+		buffer.WriteByte(inv.Type)
+		buffer.Write(inv.Hash)
+	}
+	return buffer.Bytes()
+}
+
+func (m *InvMsg) Decode(buffer *bytes.Buffer) error {
+	if buffer.Len() < 4 {
+		return BAD_MESSAGE_ERR{}
+	}
+	n := binary.BigEndian.Uint32(buffer.Next(4))
+	if uint64(buffer.Len()) < uint64(n)*33 {
+		return BAD_MESSAGE_ERR{}
+	}
+	m.Inv = make([]InvVect, n)
+	for i := range m.Inv {
+		m.Inv[i].Type = buffer.Next(1)[0]
+		m.Inv[i].Hash = buffer.Next(32)
+	}
+	return nil
+}
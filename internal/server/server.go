@@ -1,7 +1,7 @@
 package server
 
 import (
-	"errors"
+	"fmt"
 
 	"github.com/tiereum/trmnode/internal/block"
 	"github.com/tiereum/trmnode/internal/network"
@@ -10,16 +10,33 @@ import (
 	"github.com/tiereum/trmnode/internal/transaction"
 )
 
+// Commands in the header of network.WriteMessage frames.
 const (
-	TX_MESSAGE    byte = 0x00
-	BLOCK_MESSAGE byte = 0x01
+	TX_MESSAGE         = "tx"
+	BLOCK_MESSAGE      = "block"
+	VERSION_MESSAGE    = "version"
+	VERACK_MESSAGE     = "verack"
+	GETHEADERS_MESSAGE = "getheaders"
+	HEADERS_MESSAGE    = "headers"
+	GETBLOCKS_MESSAGE  = "getblocks"
+	INV_MESSAGE        = "inv"
+	GETDATA_MESSAGE    = "getdata"
 )
 
+// Message is a sync protocol message received from a peer. Payload is
+// decoded by the receiver with the matching *Msg type.
+type Message struct {
+	Peer    *network.Peer
+	Command string
+	Payload []byte
+}
+
 type Server struct {
 	ctx         *t_config.Context
 	network     *network.Network
 	txStream    *_TxStream
 	blockStream *_BlockStream
+	syncStream  chan *Message
 }
 
 func NewServer(ctx *t_config.Context) *Server {
@@ -28,26 +45,35 @@ func NewServer(ctx *t_config.Context) *Server {
 	server.network = network.NewNetwork(ctx)
 	server.txStream = NewTxStream()
 	server.blockStream = NewBlockStream()
+	server.syncStream = make(chan *Message)
 	return server
 }
 
 func (server *Server) Run() {
 	go server.Broadcast()
 	go server.Listen()
+	go server.network.Connect()
 }
 
 func (server *Server) Listen() {
 	go server.network.Listen()
-	for data := range server.network.IStream() {
-		switch data[0] {
+	for packet := range server.network.IStream() {
+		var err error
+		switch packet.Command {
 		case TX_MESSAGE:
-			server.txStream.writeToOut(data[1:])
+			err = server.txStream.writeToOut(packet.Peer, packet.Payload)
 		case BLOCK_MESSAGE:
-			server.blockStream.writeToOut(data[1:])
+			err = server.blockStream.writeToOut(packet.Peer, packet.Payload)
+		case VERSION_MESSAGE, VERACK_MESSAGE, GETHEADERS_MESSAGE, HEADERS_MESSAGE,
+			GETBLOCKS_MESSAGE, INV_MESSAGE, GETDATA_MESSAGE:
+			server.syncStream <- &Message{Peer: packet.Peer, Command: packet.Command, Payload: packet.Payload}
 		default:
-			t_error.LogWarn(errors.New("undefined message code"))
+			t_error.LogWarn(fmt.Errorf("undefined message command %q", packet.Command))
 			continue
 		}
+		if err != nil {
+			server.Misbehaving(packet.Peer, network.MALFORMED_BAN_SCORE, packet.Command+": "+err.Error())
+		}
 
 	}
 }
@@ -57,23 +83,27 @@ func (server *Server) Broadcast() {
 	go server.network.Broadcast()
 
 	go func() {
-		server.network.OStream() <- server.blockStream.readFromIn()
+		for {
+			server.network.OStream() <- &network.Packet{Command: BLOCK_MESSAGE, Payload: server.blockStream.readFromIn()}
+		}
 	}()
 
 	go func() {
-		server.network.OStream() <- server.txStream.readFromIn()
+		for {
+			server.network.OStream() <- &network.Packet{Command: TX_MESSAGE, Payload: server.txStream.readFromIn()}
+		}
 	}()
 
 }
 
 type TxStream struct {
 	InStream  chan<- *transaction.Tx
-	OutStream <-chan *transaction.Tx
+	OutStream <-chan *TxMsg
 }
 
 type BlockStream struct {
 	InStream  chan<- *block.Block
-	OutStream <-chan *block.Block
+	OutStream <-chan *BlockMsg
 }
 
 func (server *Server) Tx() *TxStream {
@@ -82,3 +112,42 @@ func (server *Server) Tx() *TxStream {
 func (server *Server) Block() *BlockStream {
 	return &BlockStream{InStream: server.blockStream.inStream, OutStream: server.blockStream.outStream}
 }
+
+// Sync delivers handshake, header and inventory messages from peers.
+func (server *Server) Sync() <-chan *Message {
+	return server.syncStream
+}
+
+// Connected delivers peers as their connections are opened.
+func (server *Server) Connected() <-chan *network.Peer {
+	return server.network.Connected()
+}
+
+// Peers returns the open peer connections.
+func (server *Server) Peers() []*network.Peer {
+	return server.network.Peers()
+}
+
+// Misbehaving adds score to peer's ban score, see network.Misbehaving.
+func (server *Server) Misbehaving(peer *network.Peer, score int, reason string) {
+	server.network.Misbehaving(peer, score, reason)
+}
+
+// Send writes a single message to peer.
+func (server *Server) Send(peer *network.Peer, command string, payload []byte) error {
+	return peer.Send(command, payload)
+}
+
+// SendBlock answers a getdata request from peer.
+func (server *Server) SendBlock(peer *network.Peer, b *block.Block) error {
+	enc := block.NewBlockEncoder(nil)
+	enc.Encode(b)
+	return server.Send(peer, BLOCK_MESSAGE, enc.Bytes())
+}
+
+// SendTx answers a getdata request from peer.
+func (server *Server) SendTx(peer *network.Peer, tx *transaction.Tx) error {
+	enc := transaction.NewTxEncoder(nil)
+	enc.Encode(tx)
+	return server.Send(peer, TX_MESSAGE, enc.Bytes())
+}
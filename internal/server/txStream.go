@@ -3,18 +3,25 @@ package server
 import (
 	"bytes"
 
+	"github.com/tiereum/trmnode/internal/network"
 	"github.com/tiereum/trmnode/internal/transaction"
 )
 
+// TxMsg is a tx received from the network and the peer it came from.
+type TxMsg struct {
+	Tx   *transaction.Tx
+	Peer *network.Peer
+}
+
 type _TxStream struct {
 	inStream  chan *transaction.Tx
-	outStream chan *transaction.Tx
+	outStream chan *TxMsg
 }
 
 func NewTxStream() *_TxStream {
 	stream := new(_TxStream)
 	stream.inStream = make(chan *transaction.Tx)
-	stream.outStream = make(chan *transaction.Tx)
+	stream.outStream = make(chan *TxMsg)
 	return stream
 }
 
@@ -22,22 +29,24 @@ func (stream *_TxStream) InStream() chan *transaction.Tx {
 	return stream.inStream
 }
 
-func (stream *_TxStream) OutStream() chan *transaction.Tx {
+func (stream *_TxStream) OutStream() chan *TxMsg {
 	return stream.outStream
 }
 
-func (stream *_TxStream) writeToOut(b []byte) {
+func (stream *_TxStream) writeToOut(peer *network.Peer, b []byte) error {
 
 	buffer := bytes.Buffer{}
 	buffer.Write(b)
 	txDec := transaction.NewTxDecoder(nil)
-	txDec.Decode(&buffer)
-	stream.outStream <- txDec.Out()
+	if err := txDec.Decode(&buffer); err != nil {
+		return err
+	}
+	stream.outStream <- &TxMsg{Tx: txDec.Out(), Peer: peer}
+	return nil
 }
 
 func (stream *_TxStream) readFromIn() []byte {
 	buffer := bytes.Buffer{}
-	buffer.WriteByte(TX_MESSAGE)
 	txEnc := transaction.NewTxEncoder(&buffer)
 	tx := <-stream.inStream
 	txEnc.Encode(tx)
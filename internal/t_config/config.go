@@ -10,10 +10,22 @@ import (
 )
 
 const (
-	Version           int32 = 0x01
-	NBits             uint8 = 15
-	COINBASE_MATURITY uint8 = 100
-	BLOCK_REWARD      int64 = 100_000
+	Version           int32  = 0x01
+	NBits             uint32 = 0x1f020000 // target of the genesis block, also the easiest allowed
+	COINBASE_MATURITY uint8  = 100
+	BLOCK_REWARD      int64  = 100_000 // subsidy before the first halving
+	HALVING_INTERVAL  int64  = 100_000 // blocks between subsidy halvings
+
+	// difficulty is recalculated every RETARGET_INTERVAL blocks so that
+	// blocks arrive TARGET_BLOCK_TIME seconds apart on average
+	RETARGET_INTERVAL int64 = 20
+	TARGET_BLOCK_TIME int64 = 60
+
+	// a block's timestamp must be later than the median of the previous
+	// MEDIAN_TIME_SPAN blocks and at most MAX_FUTURE_BLOCK_TIME seconds
+	// ahead of the validating node's clock
+	MEDIAN_TIME_SPAN      int   = 11
+	MAX_FUTURE_BLOCK_TIME int64 = 2 * 60 * 60
 )
 
 var (
@@ -54,13 +66,20 @@ type Context struct {
 }
 
 type Config struct {
-	NumTxInBlock    *uint8  `json:"numTxInBlock"`
-	RpcEndpointPort *uint16 `json:"RpcEndpointPort"`
-	ClientAddress   *string `json:"clientAddress"`
+	NumTxInBlock  *uint8   `json:"numTxInBlock"`
+	P2PPort       *uint16  `json:"RpcEndpointPort"` // peer to peer socket, named before the RPC server existed
+	RpcPort       *uint16  `json:"rpcPort"`
+	RpcUser       *string  `json:"rpcUser"` // basic auth, the cookie file is used when unset
+	RpcPassword   *string  `json:"rpcPassword"`
+	BindHost      *string  `json:"bindHost"`
+	Peers         []string `json:"peers"` // host:port addresses to connect to on start
+	ClientAddress *string  `json:"clientAddress"`
 }
 
 var NumTxInBlock uint8 = 10
-var RpcEndpointPort uint16 = 8033
+var P2PPort uint16 = 8033
+var RpcPort uint16 = 8034
+var BindHost string = "127.0.0.1"
 
 func NewContext() *Context {
 
@@ -150,8 +169,18 @@ func (ctx *Context) GetConfig() {
 		changed = true
 	}
 
-	if ctx.NodeConfig.RpcEndpointPort == nil {
-		ctx.NodeConfig.RpcEndpointPort = &RpcEndpointPort
+	if ctx.NodeConfig.P2PPort == nil {
+		ctx.NodeConfig.P2PPort = &P2PPort
+		changed = true
+	}
+
+	if ctx.NodeConfig.RpcPort == nil {
+		ctx.NodeConfig.RpcPort = &RpcPort
+		changed = true
+	}
+
+	if ctx.NodeConfig.BindHost == nil {
+		ctx.NodeConfig.BindHost = &BindHost
 		changed = true
 	}
 
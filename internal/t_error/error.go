@@ -6,6 +6,11 @@ import (
 	"runtime/debug"
 )
 
+// LogInfo reports progress of long running work, such as recovery.
+func LogInfo(format string, args ...any) {
+	log.Printf(format, args...)
+}
+
 func LogWarn(err error) {
 	if err != nil {
 		fmt.Println(err.Error())
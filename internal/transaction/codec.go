@@ -323,6 +323,11 @@ func (d TxInDecoder) Decode(buffer *bytes.Buffer) error {
 	d.txin.UnlockingScriptSize = script.Size
 	d.txin.UnlockingScript = script.Script
 
+	if buffer.Len() < 4 {
+		return BAD_TXIN_ERR{}
+	}
+	d.txin.Sequence = binary.BigEndian.Uint32(buffer.Next(4))
+
 	return nil
 }
 
@@ -356,7 +361,8 @@ func (e *TxInEncoder) Encode(txin *TxIn) {
 	outPointEncoder.Encode(&txin.PrevOutpt)
 
 	scriptEncoder := NewScriptEncoder(e.buffer)
-	scriptEncoder.Encode(&ScriptBase{Size: CompactSize{Type: txin.UnlockingScriptSize.Type, Size: txin.UnlockingScriptSize.Size}})
+	scriptEncoder.Encode(&ScriptBase{Size: CompactSize{Type: txin.UnlockingScriptSize.Type, Size: txin.UnlockingScriptSize.Size}, Script: txin.UnlockingScript})
+	binary.Write(e.buffer, binary.BigEndian, txin.Sequence)
 
 }
 
@@ -517,6 +523,12 @@ func (d *UtxoDecoder) Decode(buffer *bytes.Buffer) error {
 	d.utxo.LockingScript = scriptdec.Out().Script
 	d.utxo.LockingScriptSize = scriptdec.Out().Size
 
+	if buffer.Len() < 5 {
+		return BAD_UTXO_ERR{}
+	}
+	d.utxo.Height = binary.BigEndian.Uint32(buffer.Next(4))
+	d.utxo.Coinbase = buffer.Next(1)[0] == 1
+
 	return nil
 }
 
@@ -556,6 +568,15 @@ func (e *UtxoEncoder) Encode(utxo *Utxo) {
 	scriptenc := NewScriptEncoder(e.buffer)
 	scriptenc.Encode(&ScriptBase{Size: utxo.LockingScriptSize, Script: utxo.LockingScript})
 
+	h := make([]byte, 4)
+	binary.BigEndian.PutUint32(h, utxo.Height)
+	e.buffer.Write(h)
+	if utxo.Coinbase {
+		e.buffer.WriteByte(1)
+	} else {
+		e.buffer.WriteByte(0)
+	}
+
 }
 
 func (e *UtxoEncoder) Bytes() []byte {
@@ -0,0 +1,277 @@
+package transaction
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+type UNKNOWN_OPCODE_ERR struct {
+	Op OpCode
+}
+
+func (e UNKNOWN_OPCODE_ERR) Error() string {
+	return fmt.Sprintf("Unknown opcode 0x%02x.", byte(e.Op))
+}
+
+type STACK_UNDERFLOW_ERR struct {
+	Op OpCode
+}
+
+func (e STACK_UNDERFLOW_ERR) Error() string {
+	return e.Op.String() + " needs more items than the stack holds."
+}
+
+type PUSH_OUT_OF_BOUNDS_ERR struct{}
+
+func (e PUSH_OUT_OF_BOUNDS_ERR) Error() string {
+	return "Push reads past the end of the script."
+}
+
+type PUSH_SIZE_ERR struct{}
+
+func (e PUSH_SIZE_ERR) Error() string {
+	return fmt.Sprintf("Stack item is larger than %d bytes.", MAX_SCRIPT_ELEMENT_SIZE)
+}
+
+type SCRIPT_SIZE_ERR struct{}
+
+func (e SCRIPT_SIZE_ERR) Error() string {
+	return fmt.Sprintf("Script is larger than %d bytes.", MAX_SCRIPT_SIZE)
+}
+
+type OP_COUNT_ERR struct{}
+
+func (e OP_COUNT_ERR) Error() string {
+	return fmt.Sprintf("Script runs more than %d ops.", MAX_OPS_PER_SCRIPT)
+}
+
+type STACK_SIZE_ERR struct{}
+
+func (e STACK_SIZE_ERR) Error() string {
+	return fmt.Sprintf("Stack holds more than %d items.", MAX_STACK_SIZE)
+}
+
+type VERIFY_ERR struct {
+	Op OpCode
+}
+
+func (e VERIFY_ERR) Error() string {
+	return e.Op.String() + " failed."
+}
+
+type PUSH_ONLY_ERR struct{}
+
+func (e PUSH_ONLY_ERR) Error() string {
+	return "Unlocking script does more than push data."
+}
+
+type EVAL_FALSE_ERR struct{}
+
+func (e EVAL_FALSE_ERR) Error() string {
+	return "Script left false or nothing on the stack."
+}
+
+// Interpreter runs scripts on an OpCtx. Any error fails the script; ops
+// never panic on script input.
+type Interpreter struct {
+	ctx *OpCtx
+}
+
+func NewInterpreter(ctx *OpCtx) *Interpreter {
+	i := new(Interpreter)
+	i.ctx = ctx
+	return i
+}
+
+// Execute runs ctx.Script from the start on the current stack. It sets
+// ctx.State to OP_PANIC and returns the error if the script fails.
+func (i *Interpreter) Execute() error {
+	err := i.execute()
+	if err != nil {
+		i.ctx.State = OP_PANIC
+	} else {
+		i.ctx.State = OP_OK
+	}
+	return err
+}
+
+func (i *Interpreter) execute() error {
+	ctx := i.ctx
+	if len(ctx.Script) > MAX_SCRIPT_SIZE {
+		return SCRIPT_SIZE_ERR{}
+	}
+	ctx.ScriptPtr = 0
+	ctx.OpCount = 0
+	ctx.CondStack = nil
+	for ctx.ScriptPtr < uint64(len(ctx.Script)) {
+		op := OpCode(ctx.Script[ctx.ScriptPtr])
+		fn, ok := OpMap[op]
+		if !ok {
+			return UNKNOWN_OPCODE_ERR{op}
+		}
+		if !IsPushOp(op) {
+			if ctx.OpCount++; ctx.OpCount > MAX_OPS_PER_SCRIPT {
+				return OP_COUNT_ERR{}
+			}
+		}
+
+		// in a branch that is skipped only flow ops run, and pushes are
+		// read to step over their data
+		if !ctx.executing() && !isFlowOp(op) {
+			if _, push := OpPushMap[op]; push {
+				_, next, err := readPush(ctx.Script, ctx.ScriptPtr)
+				if err != nil {
+					return err
+				}
+				ctx.ScriptPtr = next
+			} else {
+				ctx.ScriptPtr++
+			}
+			continue
+		}
+
+		ctx.ScriptPtr++
+		if err := fn(ctx); err != nil {
+			return err
+		}
+		if ctx.Stack.Size() > MAX_STACK_SIZE {
+			return STACK_SIZE_ERR{}
+		}
+	}
+	if len(ctx.CondStack) > 0 {
+		return UNBALANCED_CONDITIONAL_ERR{}
+	}
+	return nil
+}
+
+// Verify decides whether unlocking satisfies locking. unlocking may only
+// push data. It is run on an empty stack and locking on the stack it
+// leaves. The input is valid exactly when both scripts run to the end
+// without an error and the top of the final stack is true.
+func (i *Interpreter) Verify(unlocking, locking []byte) error {
+	if !IsPushOnly(unlocking) {
+		i.ctx.State = OP_PANIC
+		return PUSH_ONLY_ERR{}
+	}
+	i.ctx.Stack = OpStack{}
+	i.ctx.Script = unlocking
+	if err := i.Execute(); err != nil {
+		return err
+	}
+	i.ctx.Script = locking
+	if err := i.Execute(); err != nil {
+		return err
+	}
+	if i.ctx.Stack.IsEmpty() || !CastToBool(i.ctx.Stack.Peek()) {
+		i.ctx.State = OP_PANIC
+		return EVAL_FALSE_ERR{}
+	}
+	return nil
+}
+
+// IsPushOnly reports whether script is a well formed series of pushes,
+// small integers included.
+func IsPushOnly(script []byte) bool {
+	_, ok := PushedItems(script)
+	return ok
+}
+
+// PushedItems returns what a push only script leaves on an empty stack,
+// or false if script is not push only.
+func PushedItems(script []byte) ([][]byte, bool) {
+	items := [][]byte{}
+	var ptr uint64
+	for ptr < uint64(len(script)) {
+		op := OpCode(script[ptr])
+		if IsSmallInt(op) {
+			items = append(items, smallIntValue(op).Bytes())
+			ptr++
+			continue
+		}
+		if _, ok := OpPushMap[op]; !ok {
+			return nil, false
+		}
+		data, next, err := readPush(script, ptr)
+		if err != nil {
+			return nil, false
+		}
+		items = append(items, data)
+		ptr = next
+	}
+	return items, true
+}
+
+// readPush decodes the push whose opcode is at pos: the opcode, a big
+// endian length of OpPushMap[opcode] bytes and that many bytes of data. It
+// returns the data and the position after it.
+func readPush(script []byte, pos uint64) ([]byte, uint64, error) {
+	nSz := uint64(OpPushMap[OpCode(script[pos])])
+	start := pos + 1 + nSz
+	if start > uint64(len(script)) {
+		return nil, 0, PUSH_OUT_OF_BOUNDS_ERR{}
+	}
+	sizeBytes := make([]byte, 4)
+	copy(sizeBytes[4-nSz:], script[pos+1:start])
+	size := uint64(binary.BigEndian.Uint32(sizeBytes))
+	if size > MAX_SCRIPT_ELEMENT_SIZE {
+		return nil, 0, PUSH_SIZE_ERR{}
+	}
+	end := start + size
+	if end > uint64(len(script)) {
+		return nil, 0, PUSH_OUT_OF_BOUNDS_ERR{}
+	}
+	return script[start:end], end, nil
+}
+
+// CastToBool is how ops and Verify read a stack item as a condition: false
+// is any run of zero bytes, where the last may also be 0x80, negative zero.
+func CastToBool(item []byte) bool {
+	for i, b := range item {
+		if b != 0 {
+			return !(i == len(item)-1 && b == 0x80)
+		}
+	}
+	return false
+}
+
+func boolBytes(b bool) []byte {
+	if b {
+		return []byte{0x01}
+	}
+	return []byte{}
+}
+
+func (ctx *OpCtx) push(item []byte) error {
+	if len(item) > MAX_SCRIPT_ELEMENT_SIZE {
+		return PUSH_SIZE_ERR{}
+	}
+	ctx.Stack.Push(item)
+	return nil
+}
+
+func (ctx *OpCtx) pop(op OpCode) ([]byte, error) {
+	if ctx.Stack.IsEmpty() {
+		return nil, STACK_UNDERFLOW_ERR{op}
+	}
+	return ctx.Stack.Pop(), nil
+}
+
+// popN pops n items for op, top first, or none if there are fewer.
+func (ctx *OpCtx) popN(op OpCode, n int) ([][]byte, error) {
+	if ctx.Stack.Size() < n {
+		return nil, STACK_UNDERFLOW_ERR{op}
+	}
+	items := make([][]byte, n)
+	for i := range items {
+		items[i] = ctx.Stack.Pop()
+	}
+	return items, nil
+}
+
+// peek returns the item depth places below the top without removing it.
+func (ctx *OpCtx) peek(op OpCode, depth int) ([]byte, error) {
+	if depth < 0 || ctx.Stack.Size() <= depth {
+		return nil, STACK_UNDERFLOW_ERR{op}
+	}
+	return ctx.Stack.items[ctx.Stack.Size()-1-depth], nil
+}
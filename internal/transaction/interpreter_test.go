@@ -0,0 +1,213 @@
+package transaction
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tiereum/trmnode/internal/client"
+)
+
+// runScript runs script on a stack holding stack, bottom first, and
+// returns the stack it leaves.
+func runScript(stack [][]byte, script []byte) ([][]byte, error) {
+	ctx := &OpCtx{Script: script}
+	for _, item := range stack {
+		ctx.Stack.Push(item)
+	}
+	err := NewInterpreter(ctx).Execute()
+	return ctx.Stack.items, err
+}
+
+func assertStack(t *testing.T, got, want [][]byte) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("stack is %x, want %x", got, want)
+	}
+	for i := range got {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("stack is %x, want %x", got, want)
+		}
+	}
+}
+
+// pushBytes is a script pushing data with OP_PUSHDATA1 or OP_PUSHDATA2.
+func pushBytes(data []byte) []byte {
+	if len(data) <= 0xff {
+		return append([]byte{byte(OP_PUSHDATA1), byte(len(data))}, data...)
+	}
+	return append([]byte{byte(OP_PUSHDATA2), byte(len(data) >> 8), byte(len(data))}, data...)
+}
+
+func repeatOp(op OpCode, n int) []byte {
+	return bytes.Repeat([]byte{byte(op)}, n)
+}
+
+// cat joins script pieces into a new script.
+func cat(pieces ...[]byte) []byte {
+	return bytes.Join(pieces, nil)
+}
+
+func TestScriptLimits(t *testing.T) {
+	one := pushBytes([]byte{0x01})
+	tests := []struct {
+		name   string
+		stack  int // items on the stack before the script runs
+		script []byte
+		err    error
+	}{
+		{"script too large", 1, repeatOp(OP_DUP, MAX_SCRIPT_SIZE+1), SCRIPT_SIZE_ERR{}},
+		{"ops at max", 1, repeatOp(OP_DUP, MAX_OPS_PER_SCRIPT), nil},
+		{"too many ops", 1, repeatOp(OP_DUP, MAX_OPS_PER_SCRIPT+1), OP_COUNT_ERR{}},
+		{"pushes not counted", 0, cat(bytes.Repeat(one, 300), repeatOp(OP_EQUALVERIFY, 150)), nil},
+		{"stack at max", MAX_STACK_SIZE - 1, repeatOp(OP_DUP, 1), nil},
+		{"stack too large", MAX_STACK_SIZE, repeatOp(OP_DUP, 1), STACK_SIZE_ERR{}},
+		{"pushes fill stack", 0, bytes.Repeat(one, MAX_STACK_SIZE+1), STACK_SIZE_ERR{}},
+		{"element at max", 0, pushBytes(make([]byte, MAX_SCRIPT_ELEMENT_SIZE)), nil},
+		{"element too large", 0, pushBytes(make([]byte, MAX_SCRIPT_ELEMENT_SIZE+1)), PUSH_SIZE_ERR{}},
+		{"push past end", 0, []byte{byte(OP_PUSHDATA1), 0x05, 0x01, 0x02}, PUSH_OUT_OF_BOUNDS_ERR{}},
+		{"push length past end", 0, []byte{byte(OP_PUSHDATA2), 0x01}, PUSH_OUT_OF_BOUNDS_ERR{}},
+		{"unknown opcode", 0, []byte{0xff}, UNKNOWN_OPCODE_ERR{0xff}},
+		{"unknown opcode after push", 0, cat(one, []byte{0x0b}), UNKNOWN_OPCODE_ERR{0x0b}},
+		{"underflow", 0, repeatOp(OP_DUP, 1), STACK_UNDERFLOW_ERR{OP_DUP}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			stack := make([][]byte, tc.stack)
+			for i := range stack {
+				stack[i] = []byte{0x01}
+			}
+			if _, err := runScript(stack, tc.script); err != tc.err {
+				t.Errorf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	one, zero := pushBytes([]byte{0x01}), pushBytes([]byte{})
+	tests := []struct {
+		name      string
+		unlocking []byte
+		locking   []byte
+		err       error
+	}{
+		{"true", one, nil, nil},
+		{"equal", one, cat(one, repeatOp(OP_EQUAL, 1)), nil},
+		{"empty stack", nil, nil, EVAL_FALSE_ERR{}},
+		{"false", zero, nil, EVAL_FALSE_ERR{}},
+		{"negative zero", pushBytes([]byte{0x00, 0x80}), nil, EVAL_FALSE_ERR{}},
+		{"not equal", one, cat(zero, repeatOp(OP_EQUAL, 1)), EVAL_FALSE_ERR{}},
+		{"locking fails", one, cat(zero, repeatOp(OP_EQUALVERIFY, 1)), VERIFY_ERR{OP_EQUALVERIFY}},
+		{"unlocking not push only", cat(one, repeatOp(OP_DUP, 1)), nil, PUSH_ONLY_ERR{}},
+		{"unlocking bad push", []byte{byte(OP_PUSHDATA1), 0x02}, nil, PUSH_ONLY_ERR{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := &OpCtx{}
+			err := NewInterpreter(ctx).Verify(tc.unlocking, tc.locking)
+			if err != tc.err {
+				t.Fatalf("got %v, want %v", err, tc.err)
+			}
+			want := OP_OK
+			if err != nil {
+				want = OP_PANIC
+			}
+			if ctx.State != want {
+				t.Errorf("state is %v, want %v", ctx.State, want)
+			}
+		})
+	}
+}
+
+// spendingTx returns a tx spending an output locked by lock, and that
+// output.
+func spendingTx(lock []byte) (*Tx, *Utxo) {
+	utxo := &Utxo{
+		OutPoint:          OutPoint{TxId: make([]byte, 32), Idx: 0},
+		Value:             50,
+		LockingScriptSize: NewCompactSize(int64(len(lock))),
+		LockingScript:     lock,
+	}
+	tx := &Tx{
+		Version:    1,
+		NumInputs:  1,
+		Inputs:     []TxIn{{PrevOutpt: utxo.OutPoint, UnlockingScriptSize: NewCompactSize(0)}},
+		NumOutputs: 1,
+		Outputs:    []TxOut{{Value: 40, LockingScriptSize: NewCompactSize(1), LockingScript: []byte{0x00}}},
+	}
+	return tx, utxo
+}
+
+// p2pkhInput returns a tx spending a P2PKH output of id, and that output.
+func p2pkhInput(id *client.ClientId) (*Tx, *Utxo) {
+	return spendingTx(cat([]byte{byte(OP_DUP), byte(OP_HASH160)}, pushBytes(id.PubKeyHash), []byte{byte(OP_EQUALVERIFY), byte(OP_CHECKSIG)}))
+}
+
+// OP_CHECKSIG takes the sighash flag from the last byte of the signature.
+func TestCheckSig(t *testing.T) {
+	owner, other := client.NewClientId(), client.NewClientId()
+	all, none := byte(SIGHASH_ALL), byte(SIGHASH_NONE)
+	tests := []struct {
+		name   string
+		signer *client.ClientId
+		signed byte   // flag the signature commits to
+		suffix []byte // what follows the signature
+		change bool   // change the output after signing
+		ok     bool
+	}{
+		{"all", owner, all, []byte{all}, false, true},
+		{"none", owner, none, []byte{none}, false, true},
+		{"none allows output change", owner, none, []byte{none}, true, true},
+		{"all forbids output change", owner, all, []byte{all}, true, false},
+		{"flag swapped", owner, all, []byte{none}, false, false},
+		{"no flag", owner, all, nil, false, false},
+		// how signatures were laid out before the flag became one byte
+		{"8 byte flag", owner, all, []byte{0, 0, 0, 0, 0, 0, 0, all}, false, false},
+		{"other key", other, all, []byte{all}, false, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tx, utxo := p2pkhInput(owner)
+			sig := append(tc.signer.Sign(tx.Preimage(0, utxo, tc.signed)), tc.suffix...)
+			if tc.change {
+				tx.Outputs[0].Value--
+			}
+			unlocking := cat(pushBytes(sig), pushBytes(client.MarshalPubKey(owner.PublicKey)))
+			ctx := &OpCtx{Tx: tx, TxIn: &tx.Inputs[0], InUtxo: utxo, InIdx: 0}
+			err := NewInterpreter(ctx).Verify(unlocking, utxo.LockingScript)
+			if tc.ok && err != nil {
+				t.Errorf("rejected: %v", err)
+			}
+			if !tc.ok && err != (EVAL_FALSE_ERR{}) {
+				t.Errorf("got %v, want %v", err, EVAL_FALSE_ERR{})
+			}
+		})
+	}
+}
+
+// A malformed key or signature makes OP_CHECKSIG push false rather than
+// fail the script.
+func TestCheckSigMalformed(t *testing.T) {
+	owner := client.NewClientId()
+	tx, utxo := p2pkhInput(owner)
+	sig := append(owner.Sign(tx.Preimage(0, utxo, byte(SIGHASH_ALL))), byte(SIGHASH_ALL))
+	key := client.MarshalPubKey(owner.PublicKey)
+	tests := []struct {
+		name     string
+		sig, key []byte
+	}{
+		{"bad key", sig, []byte{0x02, 0x03}},
+		{"bad signature", []byte{0x30, 0x01, byte(SIGHASH_ALL)}, key},
+		{"empty signature", []byte{}, key},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := &OpCtx{Tx: tx, TxIn: &tx.Inputs[0], InUtxo: utxo}
+			ctx.Script = cat(pushBytes(tc.sig), pushBytes(tc.key), repeatOp(OP_CHECKSIG, 1))
+			if err := NewInterpreter(ctx).Execute(); err != nil {
+				t.Fatal(err)
+			}
+			assertStack(t, ctx.Stack.items, [][]byte{{}})
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package transaction
+
+// A tx's LockTime is a block height below LOCKTIME_THRESHOLD and a unix
+// time at or above it. See IsFinal.
+const LOCKTIME_THRESHOLD uint32 = 500000000
+
+// An input's Sequence locks it relative to the output it spends unless
+// SEQUENCE_LOCKTIME_DISABLE_FLAG is set: the output must be the masked
+// value of blocks old, or with SEQUENCE_LOCKTIME_TYPE_FLAG that many units
+// of 2^SEQUENCE_LOCKTIME_GRANULARITY seconds of median time past.
+// SEQUENCE_FINAL also opts the input out of the tx's LockTime.
+const (
+	SEQUENCE_FINAL                 uint32 = 0xffffffff
+	SEQUENCE_LOCKTIME_DISABLE_FLAG uint32 = 1 << 31
+	SEQUENCE_LOCKTIME_TYPE_FLAG    uint32 = 1 << 22
+	SEQUENCE_LOCKTIME_MASK         uint32 = 0x0000ffff
+	SEQUENCE_LOCKTIME_GRANULARITY         = 9
+)
+
+// LOCKTIME_NUM_SIZE bounds the numbers OP_CHECKLOCKTIMEVERIFY and
+// OP_CHECKSEQUENCEVERIFY read, long enough for any uint32.
+const LOCKTIME_NUM_SIZE = 5
+
+type NEGATIVE_LOCKTIME_ERR struct{}
+
+func (e NEGATIVE_LOCKTIME_ERR) Error() string {
+	return "Locktime is negative."
+}
+
+type UNSATISFIED_LOCKTIME_ERR struct {
+	Op OpCode
+}
+
+func (e UNSATISFIED_LOCKTIME_ERR) Error() string {
+	return e.Op.String() + " lock is not met by the tx."
+}
+
+// IsFinal reports whether tx may be in a block at height whose parent has
+// median time past medianTime. It is once LockTime, a height or a time, is
+// passed, or if every input has SEQUENCE_FINAL.
+func (tx *Tx) IsFinal(height int64, medianTime uint32) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+	limit := int64(medianTime)
+	if tx.LockTime < LOCKTIME_THRESHOLD {
+		limit = height
+	}
+	if int64(tx.LockTime) < limit {
+		return true
+	}
+	for _, in := range tx.Inputs {
+		if in.Sequence != SEQUENCE_FINAL {
+			return false
+		}
+	}
+	return true
+}
+
+// HasRelativeLock reports whether seq locks its input relative to the
+// output it spends.
+func HasRelativeLock(seq uint32) bool {
+	return seq&SEQUENCE_LOCKTIME_DISABLE_FLAG == 0
+}
+
+// IsTimeRelativeLock reports whether a relative lock counts time rather
+// than blocks.
+func IsTimeRelativeLock(seq uint32) bool {
+	return seq&SEQUENCE_LOCKTIME_TYPE_FLAG != 0
+}
+
+// RelativeLockMet reports whether an input with sequence seq, spending an
+// output created at utxoHeight, may be in a block at height whose parent
+// has median time past medianTime. utxoTime is the median time past of the
+// block before the one that created the output.
+func RelativeLockMet(seq uint32, utxoHeight int64, utxoTime uint32, height int64, medianTime uint32) bool {
+	if !HasRelativeLock(seq) {
+		return true
+	}
+	value := int64(seq & SEQUENCE_LOCKTIME_MASK)
+	if IsTimeRelativeLock(seq) {
+		return int64(medianTime) >= int64(utxoTime)+value<<SEQUENCE_LOCKTIME_GRANULARITY
+	}
+	return height >= utxoHeight+value
+}
+
+// lockOperand reads the top item, leaving it in place, as the lock op
+// compares the tx against.
+func (ctx *OpCtx) lockOperand(op OpCode) (int64, error) {
+	top, err := ctx.peek(op, 0)
+	if err != nil {
+		return 0, err
+	}
+	n, err := DecodeNum(top, LOCKTIME_NUM_SIZE)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, NEGATIVE_LOCKTIME_ERR{}
+	}
+	if ctx.Tx == nil || int(ctx.InIdx) >= len(ctx.Tx.Inputs) {
+		return 0, UNSATISFIED_LOCKTIME_ERR{op}
+	}
+	return int64(n), nil
+}
+
+var (
+	// OpCheckLockTimeVerify fails unless the tx's LockTime is of the same
+	// kind as the top item, a height or a time, and at least as late. The
+	// input must not have SEQUENCE_FINAL, which would let the tx ignore its
+	// LockTime. The item is left on the stack.
+	OpCheckLockTimeVerify OpFunc = func(ctx *OpCtx) error {
+		n, err := ctx.lockOperand(OP_CHECKLOCKTIMEVERIFY)
+		if err != nil {
+			return err
+		}
+		lockTime := int64(ctx.Tx.LockTime)
+		threshold := int64(LOCKTIME_THRESHOLD)
+		if (n < threshold) != (lockTime < threshold) ||
+			n > lockTime ||
+			ctx.Tx.Inputs[ctx.InIdx].Sequence == SEQUENCE_FINAL {
+			return UNSATISFIED_LOCKTIME_ERR{OP_CHECKLOCKTIMEVERIFY}
+		}
+		return nil
+	}
+
+	// OpCheckSequenceVerify fails unless the input's Sequence is a relative
+	// lock of the same kind as the top item, blocks or time, and at least
+	// as long. A top item with SEQUENCE_LOCKTIME_DISABLE_FLAG set makes it
+	// do nothing. The item is left on the stack.
+	OpCheckSequenceVerify OpFunc = func(ctx *OpCtx) error {
+		n, err := ctx.lockOperand(OP_CHECKSEQUENCEVERIFY)
+		if err != nil {
+			return err
+		}
+		operand := uint32(n)
+		if !HasRelativeLock(operand) {
+			return nil
+		}
+		seq := ctx.Tx.Inputs[ctx.InIdx].Sequence
+		if !HasRelativeLock(seq) ||
+			IsTimeRelativeLock(operand) != IsTimeRelativeLock(seq) ||
+			operand&SEQUENCE_LOCKTIME_MASK > seq&SEQUENCE_LOCKTIME_MASK {
+			return UNSATISFIED_LOCKTIME_ERR{OP_CHECKSEQUENCEVERIFY}
+		}
+		return nil
+	}
+)
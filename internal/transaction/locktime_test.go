@@ -0,0 +1,134 @@
+package transaction
+
+import "testing"
+
+func TestIsFinal(t *testing.T) {
+	const height, mtp = 100, LOCKTIME_THRESHOLD + 1000
+	tests := []struct {
+		name     string
+		lockTime uint32
+		seqs     []uint32
+		want     bool
+	}{
+		{"no locktime", 0, []uint32{0}, true},
+		{"height passed", height - 1, []uint32{0}, true},
+		{"at height", height, []uint32{0}, false},
+		{"height ahead", height + 1, []uint32{0}, false},
+		// a height is compared against the block's height, a time
+		// against the parent's median time past
+		{"largest height", LOCKTIME_THRESHOLD - 1, []uint32{0}, false},
+		{"smallest time", LOCKTIME_THRESHOLD, []uint32{0}, true},
+		{"time passed", mtp - 1, []uint32{0}, true},
+		{"at median time", mtp, []uint32{0}, false},
+		{"time ahead", mtp + 1, []uint32{0}, false},
+		{"all inputs final", height, []uint32{SEQUENCE_FINAL, SEQUENCE_FINAL}, true},
+		{"one input not final", height, []uint32{SEQUENCE_FINAL, SEQUENCE_FINAL - 1}, false},
+		{"time lock, all inputs final", mtp, []uint32{SEQUENCE_FINAL}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tx := &Tx{LockTime: tc.lockTime}
+			for _, seq := range tc.seqs {
+				tx.Inputs = append(tx.Inputs, TxIn{Sequence: seq})
+			}
+			if got := tx.IsFinal(height, mtp); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRelativeLockMet(t *testing.T) {
+	const utxoHeight, utxoTime = 50, 1_700_000_000
+	timeLock := func(units uint32) uint32 { return SEQUENCE_LOCKTIME_TYPE_FLAG | units }
+	tests := []struct {
+		name       string
+		seq        uint32
+		height     int64
+		medianTime uint32
+		want       bool
+	}{
+		{"disabled", SEQUENCE_LOCKTIME_DISABLE_FLAG | 10, utxoHeight, utxoTime, true},
+		{"final", SEQUENCE_FINAL, utxoHeight, utxoTime, true},
+		{"blocks met", 10, utxoHeight + 10, utxoTime, true},
+		{"blocks not met", 10, utxoHeight + 9, utxoTime, false},
+		{"zero blocks", 0, utxoHeight, utxoTime, true},
+		// bits outside the mask and the flags are ignored
+		{"unused bits", 1<<16 | 10, utxoHeight + 10, utxoTime, true},
+		{"time met", timeLock(2), utxoHeight, utxoTime + 2<<SEQUENCE_LOCKTIME_GRANULARITY, true},
+		{"time not met", timeLock(2), utxoHeight + 1000, utxoTime + 2<<SEQUENCE_LOCKTIME_GRANULARITY - 1, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := RelativeLockMet(tc.seq, utxoHeight, utxoTime, tc.height, tc.medianTime); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckLockTimeVerify(t *testing.T) {
+	cltv := repeatOp(OP_CHECKLOCKTIMEVERIFY, 1)
+	tests := []struct {
+		name     string
+		operand  []byte
+		lockTime uint32
+		seq      uint32
+		err      error
+	}{
+		{"height met", PushNum(100), 100, 0, nil},
+		{"height passed", PushNum(100), 150, 0, nil},
+		{"height not met", PushNum(100), 99, 0, UNSATISFIED_LOCKTIME_ERR{OP_CHECKLOCKTIMEVERIFY}},
+		{"time met", PushNum(int(LOCKTIME_THRESHOLD)), LOCKTIME_THRESHOLD + 1, 0, nil},
+		{"time against height", PushNum(int(LOCKTIME_THRESHOLD)), 100, 0, UNSATISFIED_LOCKTIME_ERR{OP_CHECKLOCKTIMEVERIFY}},
+		{"height against time", PushNum(100), LOCKTIME_THRESHOLD, 0, UNSATISFIED_LOCKTIME_ERR{OP_CHECKLOCKTIMEVERIFY}},
+		// SEQUENCE_FINAL would let the tx ignore its LockTime
+		{"input final", PushNum(100), 100, SEQUENCE_FINAL, UNSATISFIED_LOCKTIME_ERR{OP_CHECKLOCKTIMEVERIFY}},
+		{"negative", PushNum(-1), 100, 0, NEGATIVE_LOCKTIME_ERR{}},
+		{"empty stack", nil, 100, 0, STACK_UNDERFLOW_ERR{OP_CHECKLOCKTIMEVERIFY}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tx, utxo := spendingTx(cltv)
+			tx.LockTime = tc.lockTime
+			tx.Inputs[0].Sequence = tc.seq
+			ctx := &OpCtx{Tx: tx, TxIn: &tx.Inputs[0], InUtxo: utxo, Script: cat(tc.operand, cltv)}
+			if err := NewInterpreter(ctx).Execute(); err != tc.err {
+				t.Errorf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestCheckSequenceVerify(t *testing.T) {
+	csv := repeatOp(OP_CHECKSEQUENCEVERIFY, 1)
+	timeLock := int(SEQUENCE_LOCKTIME_TYPE_FLAG)
+	tests := []struct {
+		name    string
+		operand []byte
+		seq     uint32
+		err     error
+	}{
+		{"blocks met", PushNum(10), 10, nil},
+		{"blocks longer", PushNum(10), 20, nil},
+		{"blocks not met", PushNum(10), 9, UNSATISFIED_LOCKTIME_ERR{OP_CHECKSEQUENCEVERIFY}},
+		{"time met", PushNum(timeLock | 10), SEQUENCE_LOCKTIME_TYPE_FLAG | 10, nil},
+		{"time against blocks", PushNum(timeLock | 10), 10, UNSATISFIED_LOCKTIME_ERR{OP_CHECKSEQUENCEVERIFY}},
+		{"blocks against time", PushNum(10), SEQUENCE_LOCKTIME_TYPE_FLAG | 10, UNSATISFIED_LOCKTIME_ERR{OP_CHECKSEQUENCEVERIFY}},
+		{"input not locked", PushNum(10), SEQUENCE_LOCKTIME_DISABLE_FLAG | 10, UNSATISFIED_LOCKTIME_ERR{OP_CHECKSEQUENCEVERIFY}},
+		{"input final", PushNum(10), SEQUENCE_FINAL, UNSATISFIED_LOCKTIME_ERR{OP_CHECKSEQUENCEVERIFY}},
+		// an operand with the disable flag makes the op a NOP
+		{"operand disabled", PushNum(int(SEQUENCE_LOCKTIME_DISABLE_FLAG)), SEQUENCE_FINAL, nil},
+		{"negative", PushNum(-1), 10, NEGATIVE_LOCKTIME_ERR{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tx, utxo := spendingTx(csv)
+			tx.Inputs[0].Sequence = tc.seq
+			ctx := &OpCtx{Tx: tx, TxIn: &tx.Inputs[0], InUtxo: utxo, Script: cat(tc.operand, csv)}
+			if err := NewInterpreter(ctx).Execute(); err != tc.err {
+				t.Errorf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
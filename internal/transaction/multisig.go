@@ -0,0 +1,164 @@
+package transaction
+
+import (
+	"fmt"
+)
+
+// MAX_PUBKEYS_PER_MULTISIG bounds n in an m-of-n script. Every key counts
+// as an op towards MAX_OPS_PER_SCRIPT, as each may cost a signature check.
+const MAX_PUBKEYS_PER_MULTISIG = 20
+
+type PUBKEY_COUNT_ERR struct{}
+
+func (e PUBKEY_COUNT_ERR) Error() string {
+	return fmt.Sprintf("Multisig needs 0 to %d keys.", MAX_PUBKEYS_PER_MULTISIG)
+}
+
+type SIG_COUNT_ERR struct{}
+
+func (e SIG_COUNT_ERR) Error() string {
+	return "Multisig needs between 0 and its number of keys signatures."
+}
+
+var (
+	// OpCheckSigVerify is OP_CHECKSIG followed by OP_VERIFY.
+	OpCheckSigVerify OpFunc = func(ctx *OpCtx) error {
+		items, err := ctx.popN(OP_CHECKSIGVERIFY, 2)
+		if err != nil {
+			return err
+		}
+		if !ctx.checkSig(items[1], items[0]) {
+			return VERIFY_ERR{OP_CHECKSIGVERIFY}
+		}
+		return nil
+	}
+
+	// OpCheckMultiSig takes, from the top down, n, n public keys, m and m
+	// signatures, and replaces them with whether every signature signs
+	// this input with one of the keys. The signatures must be in the same
+	// order as their keys, so each key is tried at most once. For
+	// OP_CHECKMULTISIGVERIFY a false result fails the script instead.
+	OpCheckMultiSig OpFunc = func(ctx *OpCtx) error {
+		op := OpCode(ctx.Script[ctx.ScriptPtr-1])
+		nums, err := ctx.popNums(op, 1)
+		if err != nil {
+			return err
+		}
+		n := int(nums[0])
+		if n < 0 || n > MAX_PUBKEYS_PER_MULTISIG {
+			return PUBKEY_COUNT_ERR{}
+		}
+		if ctx.OpCount += n; ctx.OpCount > MAX_OPS_PER_SCRIPT {
+			return OP_COUNT_ERR{}
+		}
+		pubKeys, err := ctx.popN(op, n)
+		if err != nil {
+			return err
+		}
+		if nums, err = ctx.popNums(op, 1); err != nil {
+			return err
+		}
+		m := int(nums[0])
+		if m < 0 || m > n {
+			return SIG_COUNT_ERR{}
+		}
+		sigs, err := ctx.popN(op, m)
+		if err != nil {
+			return err
+		}
+
+		// both came off the stack last first, so walk them backwards to
+		// go in script order
+		valid := true
+		k := n - 1
+		for s := m - 1; s >= 0 && valid; s-- {
+			for k >= 0 && !ctx.checkSig(sigs[s], pubKeys[k]) {
+				k--
+			}
+			if k < 0 {
+				valid = false
+			}
+			k--
+		}
+
+		if op == OP_CHECKMULTISIGVERIFY {
+			if !valid {
+				return VERIFY_ERR{op}
+			}
+			return nil
+		}
+		return ctx.push(boolBytes(valid))
+	}
+)
+
+// PushData returns the shortest push of data.
+func PushData(data []byte) []byte {
+	var r []byte
+	switch {
+	case len(data) <= 0xff:
+		r = []byte{byte(OP_PUSHDATA1), byte(len(data))}
+	case len(data) <= 0xffff:
+		r = []byte{byte(OP_PUSHDATA2), byte(len(data) >> 8), byte(len(data))}
+	default:
+		r = []byte{byte(OP_PUSHDATA4), byte(len(data) >> 24), byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data))}
+	}
+	return append(r, data...)
+}
+
+// PushNum returns the shortest push of n.
+func PushNum(n int) []byte {
+	if n >= -1 && n <= 16 {
+		return []byte{byte(SmallIntOp(n))}
+	}
+	return PushData(ScriptNum(n).Bytes())
+}
+
+// MultisigLockScript locks an output to any m of pubKeys:
+//
+//	m <pubkey 1> ... <pubkey n> n OP_CHECKMULTISIG
+func MultisigLockScript(m int, pubKeys [][]byte) ([]byte, error) {
+	if len(pubKeys) == 0 || len(pubKeys) > MAX_PUBKEYS_PER_MULTISIG {
+		return nil, PUBKEY_COUNT_ERR{}
+	}
+	if m < 1 || m > len(pubKeys) {
+		return nil, SIG_COUNT_ERR{}
+	}
+	r := PushNum(m)
+	for _, pk := range pubKeys {
+		if len(pk) > MAX_SCRIPT_ELEMENT_SIZE {
+			return nil, PUSH_SIZE_ERR{}
+		}
+		r = append(r, PushData(pk)...)
+	}
+	r = append(r, PushNum(len(pubKeys))...)
+	return append(r, byte(OP_CHECKMULTISIG)), nil
+}
+
+// ParseMultisigLockScript returns m and the keys of a script made by
+// MultisigLockScript, or false for any other script.
+func ParseMultisigLockScript(script []byte) (int, [][]byte, bool) {
+	if len(script) == 0 || OpCode(script[len(script)-1]) != OP_CHECKMULTISIG {
+		return 0, nil, false
+	}
+	items, ok := PushedItems(script[:len(script)-1])
+	if !ok || len(items) < 3 {
+		return 0, nil, false
+	}
+	m, errM := DecodeNum(items[0], MAX_NUM_SIZE)
+	n, errN := DecodeNum(items[len(items)-1], MAX_NUM_SIZE)
+	pubKeys := items[1 : len(items)-1]
+	if errM != nil || errN != nil || int(n) != len(pubKeys) || m < 1 || m > n {
+		return 0, nil, false
+	}
+	return int(m), pubKeys, true
+}
+
+// MultisigUnlockScript pushes sigs, which must be in the order of their
+// keys in the locking script.
+func MultisigUnlockScript(sigs [][]byte) []byte {
+	r := []byte{}
+	for _, sig := range sigs {
+		r = append(r, PushData(sig)...)
+	}
+	return r
+}
@@ -0,0 +1,130 @@
+package transaction
+
+import (
+	"testing"
+
+	"github.com/tiereum/trmnode/internal/client"
+)
+
+// signInput signs input 0 of tx, which spends utxo, as OP_CHECKSIG
+// expects.
+func signInput(id *client.ClientId, tx *Tx, utxo *Utxo, flag byte) []byte {
+	return append(id.Sign(tx.Preimage(0, utxo, flag)), flag)
+}
+
+func TestCheckMultiSig(t *testing.T) {
+	k1, k2, k3, outsider := client.NewClientId(), client.NewClientId(), client.NewClientId(), client.NewClientId()
+	keys := [][]byte{}
+	for _, id := range []*client.ClientId{k1, k2, k3} {
+		keys = append(keys, client.MarshalPubKey(id.PublicKey))
+	}
+	lock, err := MultisigLockScript(2, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyLock := cat(lock[:len(lock)-1], repeatOp(OP_CHECKMULTISIGVERIFY, 1), repeatOp(OP_1, 1))
+
+	all := byte(SIGHASH_ALL)
+	tests := []struct {
+		name    string
+		signers []*client.ClientId
+		flag    byte // flag the signatures are made and marked with
+		lock    []byte
+		err     error
+	}{
+		{"first two", []*client.ClientId{k1, k2}, all, lock, nil},
+		{"first and last", []*client.ClientId{k1, k3}, all, lock, nil},
+		{"last two", []*client.ClientId{k2, k3}, all, lock, nil},
+		{"sighash none", []*client.ClientId{k1, k3}, byte(SIGHASH_NONE), lock, nil},
+		// each key is tried once, in script order
+		{"out of order", []*client.ClientId{k2, k1}, all, lock, EVAL_FALSE_ERR{}},
+		{"same key twice", []*client.ClientId{k1, k1}, all, lock, EVAL_FALSE_ERR{}},
+		{"key not in script", []*client.ClientId{k1, outsider}, all, lock, EVAL_FALSE_ERR{}},
+		{"too few signatures", []*client.ClientId{k3}, all, lock, STACK_UNDERFLOW_ERR{OP_CHECKMULTISIG}},
+		{"verify", []*client.ClientId{k1, k2}, all, verifyLock, nil},
+		{"verify fails", []*client.ClientId{k2, k1}, all, verifyLock, VERIFY_ERR{OP_CHECKMULTISIGVERIFY}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tx, utxo := spendingTx(tc.lock)
+			sigs := [][]byte{}
+			for _, id := range tc.signers {
+				sigs = append(sigs, signInput(id, tx, utxo, tc.flag))
+			}
+			ctx := &OpCtx{Tx: tx, TxIn: &tx.Inputs[0], InUtxo: utxo}
+			err := NewInterpreter(ctx).Verify(MultisigUnlockScript(sigs), tc.lock)
+			if err != tc.err {
+				t.Errorf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+// Unlike Bitcoin's, OP_CHECKMULTISIG takes exactly m signatures and no
+// dummy element, so an item below them is left on the stack.
+func TestCheckMultiSigTakesNoDummy(t *testing.T) {
+	k1 := client.NewClientId()
+	lock, _ := MultisigLockScript(1, [][]byte{client.MarshalPubKey(k1.PublicKey)})
+	tx, utxo := spendingTx(lock)
+	dummy := []byte{0x07}
+
+	ctx := &OpCtx{Tx: tx, TxIn: &tx.Inputs[0], InUtxo: utxo, Script: lock}
+	ctx.Stack.Push(dummy)
+	ctx.Stack.Push(signInput(k1, tx, utxo, byte(SIGHASH_ALL)))
+	if err := NewInterpreter(ctx).Execute(); err != nil {
+		t.Fatal(err)
+	}
+	assertStack(t, ctx.Stack.items, [][]byte{dummy, {0x01}})
+}
+
+func TestCheckMultiSigCounts(t *testing.T) {
+	key := client.MarshalPubKey(client.NewClientId().PublicKey)
+	tests := []struct {
+		name   string
+		script []byte
+		err    error
+	}{
+		{"too many keys", cat(PushNum(0), PushNum(MAX_PUBKEYS_PER_MULTISIG+1), repeatOp(OP_CHECKMULTISIG, 1)), PUBKEY_COUNT_ERR{}},
+		{"negative keys", cat(PushNum(0), PushNum(-1), repeatOp(OP_CHECKMULTISIG, 1)), PUBKEY_COUNT_ERR{}},
+		{"more sigs than keys", cat(PushNum(2), PushData(key), PushNum(1), repeatOp(OP_CHECKMULTISIG, 1)), SIG_COUNT_ERR{}},
+		{"missing keys", cat(PushNum(0), PushData(key), PushNum(2), repeatOp(OP_CHECKMULTISIG, 1)), STACK_UNDERFLOW_ERR{OP_CHECKMULTISIG}},
+		{"zero of zero", cat(PushNum(0), PushNum(0), repeatOp(OP_CHECKMULTISIG, 1)), nil},
+		// every key counts towards MAX_OPS_PER_SCRIPT
+		{"keys count as ops", cat(repeatOp(OP_NOP, MAX_OPS_PER_SCRIPT-MAX_PUBKEYS_PER_MULTISIG), PushNum(0), PushNum(MAX_PUBKEYS_PER_MULTISIG), repeatOp(OP_CHECKMULTISIG, 1)), OP_COUNT_ERR{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := runScript(nil, tc.script); err != tc.err {
+				t.Errorf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestMultisigLockScript(t *testing.T) {
+	keys := [][]byte{{0x01}, {0x02}, {0x03}}
+	lock, err := MultisigLockScript(2, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, parsed, ok := ParseMultisigLockScript(lock)
+	if !ok || m != 2 {
+		t.Fatalf("parsed %d, %v", m, ok)
+	}
+	assertStack(t, parsed, keys)
+
+	if _, err := MultisigLockScript(0, keys); err != (SIG_COUNT_ERR{}) {
+		t.Errorf("0 of 3: got %v, want %v", err, SIG_COUNT_ERR{})
+	}
+	if _, err := MultisigLockScript(4, keys); err != (SIG_COUNT_ERR{}) {
+		t.Errorf("4 of 3: got %v, want %v", err, SIG_COUNT_ERR{})
+	}
+	if _, err := MultisigLockScript(1, nil); err != (PUBKEY_COUNT_ERR{}) {
+		t.Errorf("no keys: got %v, want %v", err, PUBKEY_COUNT_ERR{})
+	}
+	for _, script := range [][]byte{nil, cat(PushData([]byte{0x01}), repeatOp(OP_CHECKMULTISIG, 1)), lock[:len(lock)-1]} {
+		if _, _, ok := ParseMultisigLockScript(script); ok {
+			t.Errorf("parsed %x as multisig", script)
+		}
+	}
+}
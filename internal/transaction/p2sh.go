@@ -0,0 +1,112 @@
+package transaction
+
+import (
+	"bytes"
+	"encoding/hex"
+
+	"github.com/tiereum/trmnode/internal/client"
+)
+
+// P2SH_LOCK_SCRIPT_SZ is the size of OP_HASH160 <20 byte hash> OP_EQUAL.
+const P2SH_LOCK_SCRIPT_SZ int64 = 24
+
+type MISSING_REDEEM_SCRIPT_ERR struct{}
+
+func (e MISSING_REDEEM_SCRIPT_ERR) Error() string {
+	return "P2SH unlocking script does not end with a redeem script."
+}
+
+// ScriptHash is the hash160 a P2SH output commits to.
+func ScriptHash(script []byte) []byte {
+	return ripemd160Sum(sha256Sum(script))
+}
+
+// P2SH_LockScript locks an output to whoever reveals a script hashing to
+// scriptHash together with pushes that satisfy it.
+func P2SH_LockScript(scriptHash []byte) []byte {
+	r := []byte{
+		byte(OP_HASH160),   // 1
+		byte(OP_PUSHDATA1), // 1
+		byte(0x14),         // 1
+	}
+	r = append(r, scriptHash...)
+	return append(r, byte(OP_EQUAL))
+}
+
+// P2SHScriptHash returns the script hash a P2SH locking script commits to,
+// or false for any other script.
+func P2SHScriptHash(script []byte) ([]byte, bool) {
+	if int64(len(script)) != P2SH_LOCK_SCRIPT_SZ ||
+		OpCode(script[0]) != OP_HASH160 ||
+		OpCode(script[1]) != OP_PUSHDATA1 ||
+		script[2] != 0x14 ||
+		OpCode(script[23]) != OP_EQUAL {
+		return nil, false
+	}
+	return script[3:23], true
+}
+
+// SplitRedeemScript splits a P2SH unlocking script into the items the
+// redeem script runs on and the redeem script, its last push.
+func SplitRedeemScript(unlocking []byte) ([][]byte, []byte, error) {
+	items, ok := PushedItems(unlocking)
+	if !ok {
+		return nil, nil, PUSH_ONLY_ERR{}
+	}
+	if len(items) == 0 {
+		return nil, nil, MISSING_REDEEM_SCRIPT_ERR{}
+	}
+	return items[:len(items)-1], items[len(items)-1], nil
+}
+
+// LockScriptForAddress returns the locking script paying to address, P2PKH
+// for a key address and P2SH for a script address.
+func LockScriptForAddress(address string) ([]byte, error) {
+	version, hash, err := client.DecodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if version == client.SCRIPT_HASH_ADDR {
+		return P2SH_LockScript(hash), nil
+	}
+	return P2PKH_LockScript(address), nil
+}
+
+// LockScriptAddress returns the address a P2PKH or P2SH locking script pays
+// to, or "" for any other script.
+func LockScriptAddress(script []byte) string {
+	if hash, ok := P2SHScriptHash(script); ok {
+		return client.MakeAddress(client.SCRIPT_HASH_ADDR, hash)
+	}
+	if pkh, err := hex.DecodeString(GetAddrFromP2PKHLockScript(script)); err == nil && len(pkh) > 0 {
+		return client.MakeAddress(client.PUBKEY_HASH_ADDR, pkh)
+	}
+	return ""
+}
+
+// VerifyRedeemScript is the second stage of spending a P2SH output, run
+// after Verify has checked the redeem script against the output's hash. It
+// runs redeem on a stack holding args and succeeds like Verify does.
+// ctx.InUtxo should carry redeem as its locking script so signatures are
+// checked against it.
+func (i *Interpreter) VerifyRedeemScript(args [][]byte, redeem []byte) error {
+	i.ctx.Stack = OpStack{}
+	for _, arg := range args {
+		i.ctx.Stack.Push(arg)
+	}
+	i.ctx.Script = redeem
+	if err := i.Execute(); err != nil {
+		return err
+	}
+	if i.ctx.Stack.IsEmpty() || !CastToBool(i.ctx.Stack.Peek()) {
+		i.ctx.State = OP_PANIC
+		return EVAL_FALSE_ERR{}
+	}
+	return nil
+}
+
+// IsP2SHRedeem reports whether redeem is the script utxo commits to.
+func IsP2SHRedeem(utxo *Utxo, redeem []byte) bool {
+	hash, ok := P2SHScriptHash(utxo.LockingScript)
+	return ok && bytes.Equal(hash, ScriptHash(redeem))
+}
@@ -0,0 +1,99 @@
+package transaction
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestP2SHScriptHash(t *testing.T) {
+	redeem := []byte{byte(OP_1)}
+	lock := P2SH_LockScript(ScriptHash(redeem))
+	if int64(len(lock)) != P2SH_LOCK_SCRIPT_SZ {
+		t.Fatalf("lock script is %d bytes, want %d", len(lock), P2SH_LOCK_SCRIPT_SZ)
+	}
+	hash, ok := P2SHScriptHash(lock)
+	if !ok || !bytes.Equal(hash, ScriptHash(redeem)) {
+		t.Errorf("got %x, %v, want %x", hash, ok, ScriptHash(redeem))
+	}
+
+	utxo := &Utxo{LockingScript: lock}
+	if !IsP2SHRedeem(utxo, redeem) {
+		t.Error("redeem script does not match its own hash")
+	}
+	if IsP2SHRedeem(utxo, []byte{byte(OP_0)}) {
+		t.Error("another script matches the hash")
+	}
+
+	notP2SH := [][]byte{
+		nil,
+		lock[:len(lock)-1],
+		cat(lock[:len(lock)-1], repeatOp(OP_EQUALVERIFY, 1)),
+		cat(repeatOp(OP_DUP, 1), lock[1:]),
+		cat([]byte{byte(OP_DUP), byte(OP_HASH160)}, pushBytes(make([]byte, 20)), []byte{byte(OP_EQUALVERIFY), byte(OP_CHECKSIG)}),
+	}
+	for _, script := range notP2SH {
+		if _, ok := P2SHScriptHash(script); ok {
+			t.Errorf("%x read as P2SH", script)
+		}
+		if IsP2SHRedeem(&Utxo{LockingScript: script}, redeem) {
+			t.Errorf("%x accepts a redeem script", script)
+		}
+	}
+}
+
+func TestSplitRedeemScript(t *testing.T) {
+	redeem := []byte{byte(OP_1)}
+	tests := []struct {
+		name      string
+		unlocking []byte
+		args      [][]byte
+		err       error
+	}{
+		{"redeem only", pushBytes(redeem), [][]byte{}, nil},
+		{"args", cat(pushBytes([]byte{0x01}), pushBytes([]byte{0x02}), pushBytes(redeem)), [][]byte{{0x01}, {0x02}}, nil},
+		{"empty", nil, nil, MISSING_REDEEM_SCRIPT_ERR{}},
+		// the redeem script may only be reached through pushes
+		{"not push only", cat(pushBytes([]byte{0x01}), repeatOp(OP_DUP, 1), pushBytes(redeem)), nil, PUSH_ONLY_ERR{}},
+		{"bad push", []byte{byte(OP_PUSHDATA1), 0x02, 0x01}, nil, PUSH_ONLY_ERR{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			args, got, err := SplitRedeemScript(tc.unlocking)
+			if err != tc.err {
+				t.Fatalf("got %v, want %v", err, tc.err)
+			}
+			if err != nil {
+				return
+			}
+			assertStack(t, args, tc.args)
+			if !bytes.Equal(got, redeem) {
+				t.Errorf("redeem script is %x, want %x", got, redeem)
+			}
+		})
+	}
+}
+
+func TestVerifyRedeemScript(t *testing.T) {
+	// OP_VERIFY OP_1 succeeds exactly when its argument is true
+	redeem := []byte{byte(OP_VERIFY), byte(OP_1)}
+	tests := []struct {
+		name   string
+		args   [][]byte
+		redeem []byte
+		err    error
+	}{
+		{"true", [][]byte{{0x01}}, redeem, nil},
+		{"false", [][]byte{{}}, redeem, VERIFY_ERR{OP_VERIFY}},
+		{"no args", nil, redeem, STACK_UNDERFLOW_ERR{OP_VERIFY}},
+		{"leaves false", [][]byte{{}}, nil, EVAL_FALSE_ERR{}},
+		{"leaves nothing", nil, nil, EVAL_FALSE_ERR{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := &OpCtx{}
+			if err := NewInterpreter(ctx).VerifyRedeemScript(tc.args, tc.redeem); err != tc.err {
+				t.Errorf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
@@ -3,9 +3,7 @@ package transaction
 import (
 	"crypto/ecdsa"
 	"crypto/sha256"
-	"encoding/binary"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"regexp"
 
@@ -18,9 +16,18 @@ import (
 
 const P2PKH_LOCK_SCRIPT_SZ int64 = 26
 
+// Limits on what a script may do. Scripts come from untrusted txs, so every
+// one of them bounds the work a single input can cause.
+const (
+	MAX_SCRIPT_SIZE         = 10000 // bytes in one script
+	MAX_SCRIPT_ELEMENT_SIZE = 520   // bytes in one stack item
+	MAX_OPS_PER_SCRIPT      = 201   // non push ops in one script
+	MAX_STACK_SIZE          = 1000  // items on the stack
+)
+
 type OpCode byte
 type OpState byte
-type OpFunc func(ctx *OpCtx)
+type OpFunc func(ctx *OpCtx) error
 type OpCtx struct {
 	Tx        *Tx
 	Stack     OpStack
@@ -29,7 +36,9 @@ type OpCtx struct {
 	InUtxo    *Utxo
 	InIdx     uint8
 	Script    []byte
-	ScriptPtr uint64
+	ScriptPtr uint64 // next byte of Script to read
+	OpCount   int    // non push ops run so far in Script
+	CondStack []bool // one entry per open OP_IF, whether its branch runs
 }
 
 type OpMap_T map[OpCode]OpFunc
@@ -46,14 +55,180 @@ const (
 	OP_PUSHDATA1   OpCode  = 0x08
 	OP_PUSHDATA2   OpCode  = 0x09
 	OP_PUSHDATA4   OpCode  = 0x0A
+
+	// small integers, OP_N pushes N
+	OP_0       OpCode = 0x00
+	OP_FALSE   OpCode = OP_0
+	OP_1NEGATE OpCode = 0x10
+	OP_1       OpCode = 0x11
+	OP_TRUE    OpCode = OP_1
+	OP_16      OpCode = 0x20
+
+	// flow control
+	OP_NOP    OpCode = 0x21
+	OP_IF     OpCode = 0x22
+	OP_NOTIF  OpCode = 0x23
+	OP_ELSE   OpCode = 0x24
+	OP_ENDIF  OpCode = 0x25
+	OP_RETURN OpCode = 0x26
+
+	// stack
+	OP_DROP  OpCode = 0x30
+	OP_2DROP OpCode = 0x31
+	OP_SWAP  OpCode = 0x32
+	OP_OVER  OpCode = 0x33
+	OP_ROT   OpCode = 0x34
+	OP_PICK  OpCode = 0x35
+	OP_ROLL  OpCode = 0x36
+	OP_NIP   OpCode = 0x37
+	OP_TUCK  OpCode = 0x38
+	OP_DEPTH OpCode = 0x39
+	OP_SIZE  OpCode = 0x3A
+	OP_IFDUP OpCode = 0x3B
+
+	// arithmetic, on numbers of at most MAX_NUM_SIZE bytes
+	OP_1ADD               OpCode = 0x40
+	OP_1SUB               OpCode = 0x41
+	OP_NEGATE             OpCode = 0x42
+	OP_ABS                OpCode = 0x43
+	OP_NOT                OpCode = 0x44
+	OP_0NOTEQUAL          OpCode = 0x45
+	OP_ADD                OpCode = 0x46
+	OP_SUB                OpCode = 0x47
+	OP_BOOLAND            OpCode = 0x48
+	OP_BOOLOR             OpCode = 0x49
+	OP_NUMEQUAL           OpCode = 0x4A
+	OP_NUMEQUALVERIFY     OpCode = 0x4B
+	OP_NUMNOTEQUAL        OpCode = 0x4C
+	OP_LESSTHAN           OpCode = 0x4D
+	OP_GREATERTHAN        OpCode = 0x4E
+	OP_LESSTHANOREQUAL    OpCode = 0x4F
+	OP_GREATERTHANOREQUAL OpCode = 0x50
+	OP_MIN                OpCode = 0x51
+	OP_MAX                OpCode = 0x52
+	OP_WITHIN             OpCode = 0x53
+
+	// crypto, OP_HASH160 and OP_CHECKSIG above
+	OP_RIPEMD160           OpCode = 0x60
+	OP_SHA256              OpCode = 0x61
+	OP_HASH256             OpCode = 0x62
+	OP_CHECKSIGVERIFY      OpCode = 0x63
+	OP_CHECKMULTISIG       OpCode = 0x64
+	OP_CHECKMULTISIGVERIFY OpCode = 0x65
+
+	// locktime
+	OP_CHECKLOCKTIMEVERIFY OpCode = 0x66
+	OP_CHECKSEQUENCEVERIFY OpCode = 0x67
 )
 
+// IsSmallInt reports whether op is one of OP_0, OP_1NEGATE and OP_1 to
+// OP_16, which push their number.
+func IsSmallInt(op OpCode) bool {
+	return op == OP_0 || (op >= OP_1NEGATE && op <= OP_16)
+}
+
+// SmallIntOp returns the opcode that pushes n, for n from -1 to 16.
+func SmallIntOp(n int) OpCode {
+	switch n {
+	case 0:
+		return OP_0
+	case -1:
+		return OP_1NEGATE
+	}
+	return OP_1 + OpCode(n-1)
+}
+
+// IsPushOp reports whether op only pushes data. Push ops do not count
+// towards MAX_OPS_PER_SCRIPT and are all an unlocking script may hold.
+func IsPushOp(op OpCode) bool {
+	_, ok := OpPushMap[op]
+	return ok || IsSmallInt(op)
+}
+
+// OpPushMap gives the size of the length that follows each push opcode.
 var OpPushMap map[OpCode]int = map[OpCode]int{
 	OP_PUSHDATA1: 1,
 	OP_PUSHDATA2: 2,
 	OP_PUSHDATA4: 4,
 }
 
+var opNames = map[OpCode]string{
+	OP_DUP:         "OP_DUP",
+	OP_HASH160:     "OP_HASH160",
+	OP_EQUALVERIFY: "OP_EQUALVERIFY",
+	OP_EQUAL:       "OP_EQUAL",
+	OP_VERIFY:      "OP_VERIFY",
+	OP_CHECKSIG:    "OP_CHECKSIG",
+	OP_PUSHDATA1:   "OP_PUSHDATA1",
+	OP_PUSHDATA2:   "OP_PUSHDATA2",
+	OP_PUSHDATA4:   "OP_PUSHDATA4",
+
+	OP_0:       "OP_0",
+	OP_1NEGATE: "OP_1NEGATE",
+
+	OP_NOP:    "OP_NOP",
+	OP_IF:     "OP_IF",
+	OP_NOTIF:  "OP_NOTIF",
+	OP_ELSE:   "OP_ELSE",
+	OP_ENDIF:  "OP_ENDIF",
+	OP_RETURN: "OP_RETURN",
+
+	OP_DROP:  "OP_DROP",
+	OP_2DROP: "OP_2DROP",
+	OP_SWAP:  "OP_SWAP",
+	OP_OVER:  "OP_OVER",
+	OP_ROT:   "OP_ROT",
+	OP_PICK:  "OP_PICK",
+	OP_ROLL:  "OP_ROLL",
+	OP_NIP:   "OP_NIP",
+	OP_TUCK:  "OP_TUCK",
+	OP_DEPTH: "OP_DEPTH",
+	OP_SIZE:  "OP_SIZE",
+	OP_IFDUP: "OP_IFDUP",
+
+	OP_1ADD:               "OP_1ADD",
+	OP_1SUB:               "OP_1SUB",
+	OP_NEGATE:             "OP_NEGATE",
+	OP_ABS:                "OP_ABS",
+	OP_NOT:                "OP_NOT",
+	OP_0NOTEQUAL:          "OP_0NOTEQUAL",
+	OP_ADD:                "OP_ADD",
+	OP_SUB:                "OP_SUB",
+	OP_BOOLAND:            "OP_BOOLAND",
+	OP_BOOLOR:             "OP_BOOLOR",
+	OP_NUMEQUAL:           "OP_NUMEQUAL",
+	OP_NUMEQUALVERIFY:     "OP_NUMEQUALVERIFY",
+	OP_NUMNOTEQUAL:        "OP_NUMNOTEQUAL",
+	OP_LESSTHAN:           "OP_LESSTHAN",
+	OP_GREATERTHAN:        "OP_GREATERTHAN",
+	OP_LESSTHANOREQUAL:    "OP_LESSTHANOREQUAL",
+	OP_GREATERTHANOREQUAL: "OP_GREATERTHANOREQUAL",
+	OP_MIN:                "OP_MIN",
+	OP_MAX:                "OP_MAX",
+	OP_WITHIN:             "OP_WITHIN",
+
+	OP_RIPEMD160: "OP_RIPEMD160",
+	OP_SHA256:    "OP_SHA256",
+	OP_HASH256:   "OP_HASH256",
+
+	OP_CHECKSIGVERIFY:      "OP_CHECKSIGVERIFY",
+	OP_CHECKMULTISIG:       "OP_CHECKMULTISIG",
+	OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+	OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY",
+}
+
+func (op OpCode) String() string {
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	if op >= OP_1 && op <= OP_16 {
+		return fmt.Sprintf("OP_%d", op-OP_1+1)
+	}
+	return fmt.Sprintf("OP_UNKNOWN(0x%02x)", byte(op))
+}
+
 type SigHashFlag byte
 
 const (
@@ -63,6 +238,9 @@ const (
 	SIGHASH_ANYONECANPAY SigHashFlag = 0x80
 )
 
+// Each op is called with ScriptPtr just past its opcode. It returns an
+// error when the script must fail; ops that test something either push
+// the result or, for the VERIFY forms, fail when it is false.
 var (
 	OpMap OpMap_T = OpMap_T{
 		OP_PUSHDATA1:   OpPushData,
@@ -74,112 +252,195 @@ var (
 		OP_EQUAL:       OpEqual,
 		OP_VERIFY:      OpVerify,
 		OP_CHECKSIG:    OpCheckSig,
-	}
 
-	OpPushData OpFunc = func(ctx *OpCtx) {
-		nSz := OpPushMap[OpCode(ctx.Script[ctx.ScriptPtr])]
-		ctx.ScriptPtr++
-		sz := binary.BigEndian.Uint32(ctx.Script[ctx.ScriptPtr:nSz])
-		ctx.ScriptPtr += uint64(nSz)
-		ctx.Stack.Push(ctx.Script[ctx.ScriptPtr:sz])
-		ctx.ScriptPtr += uint64(sz)
-	}
+		OP_0:       OpSmallInt,
+		OP_1NEGATE: OpSmallInt,
+
+		OP_NOP:    OpNop,
+		OP_IF:     OpIf,
+		OP_NOTIF:  OpIf,
+		OP_ELSE:   OpElse,
+		OP_ENDIF:  OpEndIf,
+		OP_RETURN: OpReturn,
+
+		OP_DROP:  OpDrop,
+		OP_2DROP: Op2Drop,
+		OP_SWAP:  OpSwap,
+		OP_OVER:  OpOver,
+		OP_ROT:   OpRot,
+		OP_PICK:  OpPick,
+		OP_ROLL:  OpPick,
+		OP_NIP:   OpNip,
+		OP_TUCK:  OpTuck,
+		OP_DEPTH: OpDepth,
+		OP_SIZE:  OpSize,
+		OP_IFDUP: OpIfDup,
+
+		OP_1ADD:               unaryNumOp(OP_1ADD, func(a ScriptNum) ScriptNum { return a + 1 }),
+		OP_1SUB:               unaryNumOp(OP_1SUB, func(a ScriptNum) ScriptNum { return a - 1 }),
+		OP_NEGATE:             unaryNumOp(OP_NEGATE, func(a ScriptNum) ScriptNum { return -a }),
+		OP_ABS:                unaryNumOp(OP_ABS, func(a ScriptNum) ScriptNum { return max(a, -a) }),
+		OP_NOT:                unaryNumOp(OP_NOT, func(a ScriptNum) ScriptNum { return numBool(a == 0) }),
+		OP_0NOTEQUAL:          unaryNumOp(OP_0NOTEQUAL, func(a ScriptNum) ScriptNum { return numBool(a != 0) }),
+		OP_ADD:                binaryNumOp(OP_ADD, func(a, b ScriptNum) ScriptNum { return a + b }),
+		OP_SUB:                binaryNumOp(OP_SUB, func(a, b ScriptNum) ScriptNum { return a - b }),
+		OP_BOOLAND:            binaryNumOp(OP_BOOLAND, func(a, b ScriptNum) ScriptNum { return numBool(a != 0 && b != 0) }),
+		OP_BOOLOR:             binaryNumOp(OP_BOOLOR, func(a, b ScriptNum) ScriptNum { return numBool(a != 0 || b != 0) }),
+		OP_NUMEQUAL:           binaryNumOp(OP_NUMEQUAL, func(a, b ScriptNum) ScriptNum { return numBool(a == b) }),
+		OP_NUMEQUALVERIFY:     OpNumEqualVerify,
+		OP_NUMNOTEQUAL:        binaryNumOp(OP_NUMNOTEQUAL, func(a, b ScriptNum) ScriptNum { return numBool(a != b) }),
+		OP_LESSTHAN:           binaryNumOp(OP_LESSTHAN, func(a, b ScriptNum) ScriptNum { return numBool(a < b) }),
+		OP_GREATERTHAN:        binaryNumOp(OP_GREATERTHAN, func(a, b ScriptNum) ScriptNum { return numBool(a > b) }),
+		OP_LESSTHANOREQUAL:    binaryNumOp(OP_LESSTHANOREQUAL, func(a, b ScriptNum) ScriptNum { return numBool(a <= b) }),
+		OP_GREATERTHANOREQUAL: binaryNumOp(OP_GREATERTHANOREQUAL, func(a, b ScriptNum) ScriptNum { return numBool(a >= b) }),
+		OP_MIN:                binaryNumOp(OP_MIN, func(a, b ScriptNum) ScriptNum { return min(a, b) }),
+		OP_MAX:                binaryNumOp(OP_MAX, func(a, b ScriptNum) ScriptNum { return max(a, b) }),
+		OP_WITHIN:             OpWithin,
 
-	OpDup OpFunc = func(ctx *OpCtx) {
-		ctx.Stack.Push(ctx.Stack.Peek())
-		ctx.ScriptPtr++
+		OP_RIPEMD160: hashOp(OP_RIPEMD160, ripemd160Sum),
+		OP_SHA256:    hashOp(OP_SHA256, sha256Sum),
+		OP_HASH256:   hashOp(OP_HASH256, t_util.Hash256),
+
+		OP_CHECKSIGVERIFY:      OpCheckSigVerify,
+		OP_CHECKMULTISIG:       OpCheckMultiSig,
+		OP_CHECKMULTISIGVERIFY: OpCheckMultiSig,
+
+		OP_CHECKLOCKTIMEVERIFY: OpCheckLockTimeVerify,
+		OP_CHECKSEQUENCEVERIFY: OpCheckSequenceVerify,
 	}
 
-	OpHash160 OpFunc = func(ctx *OpCtx) {
-		sha256Hasher := sha256.New()
-		ripemd160Hasher := ripemd160.New()
-		sha256Hasher.Write(ctx.Stack.Peek())
-		ripemd160Hasher.Write(sha256Hasher.Sum(nil))
-		ctx.Stack.Push(ripemd160Hasher.Sum(nil))
-		ctx.ScriptPtr++
+	// OpPushData pushes the bytes that follow its length.
+	OpPushData OpFunc = func(ctx *OpCtx) error {
+		data, next, err := readPush(ctx.Script, ctx.ScriptPtr-1)
+		if err != nil {
+			return err
+		}
+		ctx.ScriptPtr = next
+		return ctx.push(data)
 	}
 
-	OpEqualVerify OpFunc = func(ctx *OpCtx) {
-		OpEqual(ctx)
-		OpVerify(ctx)
-		ctx.ScriptPtr--
+	// OpDup pushes a copy of the top item.
+	OpDup OpFunc = func(ctx *OpCtx) error {
+		top, err := ctx.peek(OP_DUP, 0)
+		if err != nil {
+			return err
+		}
+		return ctx.push(top)
 	}
 
-	OpEqual OpFunc = func(ctx *OpCtx) {
-		first, second := ctx.Stack.Pop(), ctx.Stack.Pop()
+	// OpHash160 replaces the top item with its ripemd160(sha256) hash.
+	OpHash160 OpFunc = hashOp(OP_HASH160, func(b []byte) []byte { return ripemd160Sum(sha256Sum(b)) })
 
-		if t_util.SliceCompare(first, second) {
-			ctx.Stack.Push([]byte{0x01})
-		} else {
-			ctx.Stack.Push([]byte{0x00})
+	// OpEqualVerify is OP_EQUAL followed by OP_VERIFY.
+	OpEqualVerify OpFunc = func(ctx *OpCtx) error {
+		items, err := ctx.popN(OP_EQUALVERIFY, 2)
+		if err != nil {
+			return err
+		}
+		if !t_util.SliceCompare(items[0], items[1]) {
+			return VERIFY_ERR{OP_EQUALVERIFY}
 		}
-		ctx.ScriptPtr++
+		return nil
 	}
 
-	OpVerify OpFunc = func(ctx *OpCtx) {
-		top := ctx.Stack.Peek()
-		if top[0] == byte(0x00) {
-			ctx.Stack.Pop()
-		} else {
-			ctx.State = OP_PANIC
+	// OpEqual replaces the top two items with true if they are byte for
+	// byte equal and false otherwise.
+	OpEqual OpFunc = func(ctx *OpCtx) error {
+		items, err := ctx.popN(OP_EQUAL, 2)
+		if err != nil {
+			return err
 		}
-		ctx.ScriptPtr++
+		return ctx.push(boolBytes(t_util.SliceCompare(items[0], items[1])))
 	}
 
-	OpCheckSig OpFunc = func(ctx *OpCtx) {
-		pubKey := ctx.Stack.Pop()
-		sig := ctx.Stack.Pop()
-
-		sigHashFlag := uint8(binary.BigEndian.Uint16(sig[len(sig)-8:]))
-		sig = sig[:len(sig)-8]
+	// OpVerify removes the top item and fails the script if it is false.
+	OpVerify OpFunc = func(ctx *OpCtx) error {
+		top, err := ctx.pop(OP_VERIFY)
+		if err != nil {
+			return err
+		}
+		if !CastToBool(top) {
+			return VERIFY_ERR{OP_VERIFY}
+		}
+		return nil
+	}
 
-		preimage := ctx.Tx.Preimage(ctx.InIdx, ctx.InUtxo, sigHashFlag)
+	// OpCheckSig replaces a signature and the public key above it with
+	// whether the signature signs this input. A malformed signature or key
+	// is a false result, not an error.
+	OpCheckSig OpFunc = func(ctx *OpCtx) error {
+		items, err := ctx.popN(OP_CHECKSIG, 2)
+		if err != nil {
+			return err
+		}
+		pubKey, sig := items[0], items[1]
+		return ctx.push(boolBytes(ctx.checkSig(sig, pubKey)))
+	}
+)
 
-		pubKeyObj := client.UnMarshalPubKey(pubKey)
-		valid := ecdsa.VerifyASN1(pubKeyObj, preimage, sig)
+func init() {
+	for op := OP_1; op <= OP_16; op++ {
+		OpMap[op] = OpSmallInt
+	}
+}
 
-		if valid {
-			ctx.State = OP_OK
-			ctx.ScriptPtr++
-			return
+// hashOp makes an op that replaces the top item with its hash.
+func hashOp(op OpCode, hash func([]byte) []byte) OpFunc {
+	return func(ctx *OpCtx) error {
+		top, err := ctx.pop(op)
+		if err != nil {
+			return err
 		}
-		ctx.State = OP_PANIC
-		ctx.ScriptPtr++
-
+		return ctx.push(hash(top))
 	}
-)
+}
 
-type Interpreter struct {
-	ctx *OpCtx
+func sha256Sum(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	return sum[:]
 }
 
-func NewInterpreter(ctx *OpCtx) *Interpreter {
-	i := new(Interpreter)
-	i.ctx = ctx
-	return i
+func ripemd160Sum(b []byte) []byte {
+	ripemd160Hasher := ripemd160.New()
+	ripemd160Hasher.Write(b)
+	return ripemd160Hasher.Sum(nil)
 }
 
-func (i *Interpreter) Execute() OpState {
-	for i.ctx.ScriptPtr < uint64(len(i.ctx.Script)) {
-		OpMap[OpCode(i.ctx.Script[i.ctx.ScriptPtr])](i.ctx)
+// checkSig verifies sig, a DER signature followed by its sighash flag,
+// against the preimage of this input.
+func (ctx *OpCtx) checkSig(sig, pubKey []byte) bool {
+	if len(sig) < 2 || ctx.Tx == nil || ctx.InUtxo == nil {
+		return false
+	}
+	sigHashFlag := sig[len(sig)-1]
+	sig = sig[:len(sig)-1]
+	if SigHashFlag(sigHashFlag&0b11) == SIGHASH_SINGLE && int(ctx.InIdx) >= len(ctx.Tx.Outputs) {
+		return false
+	}
+	key, err := client.ParsePubKey(pubKey)
+	if err != nil {
+		return false
 	}
-	return OpState(i.ctx.Stack.Peek()[0])
+	preimage := ctx.Tx.Preimage(ctx.InIdx, ctx.InUtxo, sigHashFlag)
+	return ecdsa.VerifyASN1(key, preimage, sig)
 }
 
+// GetAddrFromP2PKHLockScript returns the hex public key hash a P2PKH
+// script pays to, or "" for any other script.
 func GetAddrFromP2PKHLockScript(script []byte) string {
 	scriptStr := hex.EncodeToString(script)
 
 	pattern := fmt.Sprintf(`^%02x%02x%02x%02x([0-9a-fA-F]{40})%02x%02x$`,
-		OP_DUP,
-		OP_HASH160,
-		OP_PUSHDATA1,
+		byte(OP_DUP),
+		byte(OP_HASH160),
+		byte(OP_PUSHDATA1),
 		0x14,
-		OP_EQUALVERIFY,
-		OP_CHECKSIG,
+		byte(OP_EQUALVERIFY),
+		byte(OP_CHECKSIG),
 	)
 	re := regexp.MustCompile(pattern)
 	if !re.MatchString(scriptStr) {
-		t_error.LogErr(errors.New("bad scriptPubKey"))
+		return "" // not a P2PKH script
 	}
 	matches := re.FindAllStringSubmatch(scriptStr, 1)
 	return matches[0][1]
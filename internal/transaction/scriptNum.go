@@ -0,0 +1,143 @@
+package transaction
+
+// MAX_NUM_SIZE bounds the numbers arithmetic ops accept. Results may be
+// one byte longer, but cannot be fed to another arithmetic op.
+const MAX_NUM_SIZE = 4
+
+type NUM_OVERFLOW_ERR struct{}
+
+func (e NUM_OVERFLOW_ERR) Error() string {
+	return "Number is longer than 4 bytes."
+}
+
+type NON_MINIMAL_NUM_ERR struct{}
+
+func (e NON_MINIMAL_NUM_ERR) Error() string {
+	return "Number is not minimally encoded."
+}
+
+// ScriptNum is a number on the stack. It is stored little endian with the
+// sign in the top bit of the last byte, so 0 is empty, 1 is 0x01, -1 is
+// 0x81 and 128 is 0x80 0x00. Only the shortest encoding of a number is
+// accepted.
+type ScriptNum int64
+
+func DecodeNum(item []byte, maxSize int) (ScriptNum, error) {
+	if len(item) > maxSize {
+		return 0, NUM_OVERFLOW_ERR{}
+	}
+	if len(item) == 0 {
+		return 0, nil
+	}
+	// the last byte may only be 0x00 or 0x80 if the one before needs its
+	// top bit for the magnitude
+	if item[len(item)-1]&0x7f == 0 {
+		if len(item) == 1 || item[len(item)-2]&0x80 == 0 {
+			return 0, NON_MINIMAL_NUM_ERR{}
+		}
+	}
+	var n int64
+	for i, b := range item {
+		n |= int64(b) << (8 * i)
+	}
+	if item[len(item)-1]&0x80 != 0 {
+		n &^= int64(0x80) << (8 * (len(item) - 1))
+		n = -n
+	}
+	return ScriptNum(n), nil
+}
+
+func (n ScriptNum) Bytes() []byte {
+	if n == 0 {
+		return []byte{}
+	}
+	negative := n < 0
+	abs := uint64(n)
+	if negative {
+		abs = uint64(-n)
+	}
+	b := []byte{}
+	for abs > 0 {
+		b = append(b, byte(abs))
+		abs >>= 8
+	}
+	if b[len(b)-1]&0x80 != 0 {
+		if negative {
+			b = append(b, 0x80)
+		} else {
+			b = append(b, 0x00)
+		}
+	} else if negative {
+		b[len(b)-1] |= 0x80
+	}
+	return b
+}
+
+func numBool(b bool) ScriptNum {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// popNums pops n numbers for op, top first.
+func (ctx *OpCtx) popNums(op OpCode, n int) ([]ScriptNum, error) {
+	items, err := ctx.popN(op, n)
+	if err != nil {
+		return nil, err
+	}
+	nums := make([]ScriptNum, n)
+	for i, item := range items {
+		if nums[i], err = DecodeNum(item, MAX_NUM_SIZE); err != nil {
+			return nil, err
+		}
+	}
+	return nums, nil
+}
+
+// unaryNumOp makes an op that replaces the top number with fn of it.
+func unaryNumOp(op OpCode, fn func(a ScriptNum) ScriptNum) OpFunc {
+	return func(ctx *OpCtx) error {
+		nums, err := ctx.popNums(op, 1)
+		if err != nil {
+			return err
+		}
+		return ctx.push(fn(nums[0]).Bytes())
+	}
+}
+
+// binaryNumOp makes an op that replaces the top two numbers, a below b,
+// with fn(a, b).
+func binaryNumOp(op OpCode, fn func(a, b ScriptNum) ScriptNum) OpFunc {
+	return func(ctx *OpCtx) error {
+		nums, err := ctx.popNums(op, 2)
+		if err != nil {
+			return err
+		}
+		return ctx.push(fn(nums[1], nums[0]).Bytes())
+	}
+}
+
+var (
+	// OpNumEqualVerify is OP_NUMEQUAL followed by OP_VERIFY.
+	OpNumEqualVerify OpFunc = func(ctx *OpCtx) error {
+		nums, err := ctx.popNums(OP_NUMEQUALVERIFY, 2)
+		if err != nil {
+			return err
+		}
+		if nums[0] != nums[1] {
+			return VERIFY_ERR{OP_NUMEQUALVERIFY}
+		}
+		return nil
+	}
+
+	// OpWithin replaces x, min and max with whether min <= x < max.
+	OpWithin OpFunc = func(ctx *OpCtx) error {
+		nums, err := ctx.popNums(OP_WITHIN, 3)
+		if err != nil {
+			return err
+		}
+		hi, lo, x := nums[0], nums[1], nums[2]
+		return ctx.push(numBool(lo <= x && x < hi).Bytes())
+	}
+)
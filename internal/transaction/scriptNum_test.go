@@ -0,0 +1,126 @@
+package transaction
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestScriptNumEncoding(t *testing.T) {
+	tests := []struct {
+		n   ScriptNum
+		enc []byte
+	}{
+		{0, []byte{}},
+		{1, []byte{0x01}},
+		{-1, []byte{0x81}},
+		{16, []byte{0x10}},
+		{127, []byte{0x7f}},
+		{-127, []byte{0xff}},
+		{128, []byte{0x80, 0x00}},
+		{-128, []byte{0x80, 0x80}},
+		{255, []byte{0xff, 0x00}},
+		{256, []byte{0x00, 0x01}},
+		{-256, []byte{0x00, 0x81}},
+		{32767, []byte{0xff, 0x7f}},
+		{32768, []byte{0x00, 0x80, 0x00}},
+		{2147483647, []byte{0xff, 0xff, 0xff, 0x7f}},
+		{-2147483647, []byte{0xff, 0xff, 0xff, 0xff}},
+		{2147483648, []byte{0x00, 0x00, 0x00, 0x80, 0x00}},
+	}
+	for _, tc := range tests {
+		if enc := tc.n.Bytes(); !bytes.Equal(enc, tc.enc) {
+			t.Errorf("%d encodes to %x, want %x", tc.n, enc, tc.enc)
+		}
+		n, err := DecodeNum(tc.enc, len(tc.enc))
+		if err != nil || n != tc.n {
+			t.Errorf("%x decodes to %d, %v, want %d", tc.enc, n, err, tc.n)
+		}
+	}
+}
+
+func TestDecodeNumRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		item []byte
+		err  error
+	}{
+		{"zero byte", []byte{0x00}, NON_MINIMAL_NUM_ERR{}},
+		{"negative zero", []byte{0x80}, NON_MINIMAL_NUM_ERR{}},
+		{"padded positive", []byte{0x01, 0x00}, NON_MINIMAL_NUM_ERR{}},
+		{"padded negative", []byte{0x01, 0x80}, NON_MINIMAL_NUM_ERR{}},
+		{"padded 127", []byte{0x7f, 0x00}, NON_MINIMAL_NUM_ERR{}},
+		{"padded 128", []byte{0x80, 0x00, 0x00}, NON_MINIMAL_NUM_ERR{}},
+		{"five bytes", []byte{0x00, 0x00, 0x00, 0x80, 0x00}, NUM_OVERFLOW_ERR{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := DecodeNum(tc.item, MAX_NUM_SIZE); err != tc.err {
+				t.Errorf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestNumOps(t *testing.T) {
+	n := func(v ScriptNum) []byte { return v.Bytes() }
+	tests := []struct {
+		name  string
+		stack [][]byte
+		op    OpCode
+		want  [][]byte
+	}{
+		{"1add", [][]byte{n(-1)}, OP_1ADD, [][]byte{n(0)}},
+		{"1sub", [][]byte{n(0)}, OP_1SUB, [][]byte{n(-1)}},
+		{"negate", [][]byte{n(5)}, OP_NEGATE, [][]byte{n(-5)}},
+		{"abs", [][]byte{n(-129)}, OP_ABS, [][]byte{n(129)}},
+		{"not zero", [][]byte{n(0)}, OP_NOT, [][]byte{n(1)}},
+		{"not nonzero", [][]byte{n(7)}, OP_NOT, [][]byte{n(0)}},
+		{"0notequal", [][]byte{n(-3)}, OP_0NOTEQUAL, [][]byte{n(1)}},
+		{"add", [][]byte{n(100), n(28)}, OP_ADD, [][]byte{n(128)}},
+		{"sub", [][]byte{n(3), n(5)}, OP_SUB, [][]byte{n(-2)}},
+		{"booland", [][]byte{n(1), n(0)}, OP_BOOLAND, [][]byte{n(0)}},
+		{"boolor", [][]byte{n(0), n(-1)}, OP_BOOLOR, [][]byte{n(1)}},
+		{"numequal", [][]byte{n(4), n(4)}, OP_NUMEQUAL, [][]byte{n(1)}},
+		{"numnotequal", [][]byte{n(4), n(4)}, OP_NUMNOTEQUAL, [][]byte{n(0)}},
+		{"lessthan", [][]byte{n(-2), n(1)}, OP_LESSTHAN, [][]byte{n(1)}},
+		{"greaterthan", [][]byte{n(-2), n(1)}, OP_GREATERTHAN, [][]byte{n(0)}},
+		{"lessthanorequal", [][]byte{n(1), n(1)}, OP_LESSTHANOREQUAL, [][]byte{n(1)}},
+		{"greaterthanorequal", [][]byte{n(0), n(1)}, OP_GREATERTHANOREQUAL, [][]byte{n(0)}},
+		{"min", [][]byte{n(3), n(-3)}, OP_MIN, [][]byte{n(-3)}},
+		{"max", [][]byte{n(3), n(-3)}, OP_MAX, [][]byte{n(3)}},
+		{"within", [][]byte{n(2), n(2), n(5)}, OP_WITHIN, [][]byte{n(1)}},
+		{"within at max", [][]byte{n(5), n(2), n(5)}, OP_WITHIN, [][]byte{n(0)}},
+		{"numequalverify", [][]byte{n(9), n(9)}, OP_NUMEQUALVERIFY, [][]byte{}},
+		{"add overflows to five bytes", [][]byte{n(2147483647), n(1)}, OP_ADD, [][]byte{n(2147483648)}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			stack, err := runScript(tc.stack, []byte{byte(tc.op)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertStack(t, stack, tc.want)
+		})
+	}
+}
+
+func TestNumOpsRejectBadOperands(t *testing.T) {
+	tests := []struct {
+		name  string
+		stack [][]byte
+		op    OpCode
+		err   error
+	}{
+		{"non minimal", [][]byte{{0x01, 0x00}}, OP_1ADD, NON_MINIMAL_NUM_ERR{}},
+		{"negative zero", [][]byte{{0x80}, {0x01}}, OP_ADD, NON_MINIMAL_NUM_ERR{}},
+		{"too long", [][]byte{ScriptNum(2147483648).Bytes()}, OP_1SUB, NUM_OVERFLOW_ERR{}},
+		{"numequalverify fails", [][]byte{{0x01}, {0x02}}, OP_NUMEQUALVERIFY, VERIFY_ERR{OP_NUMEQUALVERIFY}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := runScript(tc.stack, []byte{byte(tc.op)}); err != tc.err {
+				t.Errorf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package transaction
+
+type UNBALANCED_CONDITIONAL_ERR struct{}
+
+func (e UNBALANCED_CONDITIONAL_ERR) Error() string {
+	return "OP_ELSE or OP_ENDIF without OP_IF, or OP_IF without OP_ENDIF."
+}
+
+type OP_RETURN_ERR struct{}
+
+func (e OP_RETURN_ERR) Error() string {
+	return "Script ran OP_RETURN."
+}
+
+// isFlowOp reports whether op has to run in a branch that is skipped, to
+// keep track of where the branch ends.
+func isFlowOp(op OpCode) bool {
+	return op >= OP_IF && op <= OP_ENDIF
+}
+
+// smallIntValue is the number a small integer opcode pushes.
+func smallIntValue(op OpCode) ScriptNum {
+	switch op {
+	case OP_0:
+		return 0
+	case OP_1NEGATE:
+		return -1
+	}
+	return ScriptNum(op-OP_1) + 1
+}
+
+// executing reports whether every open OP_IF branch is taken.
+func (ctx *OpCtx) executing() bool {
+	for _, cond := range ctx.CondStack {
+		if !cond {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	// OpSmallInt pushes the number its opcode stands for.
+	OpSmallInt OpFunc = func(ctx *OpCtx) error {
+		return ctx.push(smallIntValue(OpCode(ctx.Script[ctx.ScriptPtr-1])).Bytes())
+	}
+
+	// OpNop does nothing.
+	OpNop OpFunc = func(ctx *OpCtx) error {
+		return nil
+	}
+
+	// OpIf opens a branch that runs if the top item, which it removes, is
+	// true, or false for OP_NOTIF. Inside a branch that does not run it
+	// only opens a branch that does not run either.
+	OpIf OpFunc = func(ctx *OpCtx) error {
+		op := OpCode(ctx.Script[ctx.ScriptPtr-1])
+		cond := false
+		if ctx.executing() {
+			top, err := ctx.pop(op)
+			if err != nil {
+				return err
+			}
+			cond = CastToBool(top) == (op == OP_IF)
+		}
+		ctx.CondStack = append(ctx.CondStack, cond)
+		return nil
+	}
+
+	// OpElse flips whether the innermost open branch runs.
+	OpElse OpFunc = func(ctx *OpCtx) error {
+		if len(ctx.CondStack) == 0 {
+			return UNBALANCED_CONDITIONAL_ERR{}
+		}
+		ctx.CondStack[len(ctx.CondStack)-1] = !ctx.CondStack[len(ctx.CondStack)-1]
+		return nil
+	}
+
+	// OpEndIf closes the innermost open branch.
+	OpEndIf OpFunc = func(ctx *OpCtx) error {
+		if len(ctx.CondStack) == 0 {
+			return UNBALANCED_CONDITIONAL_ERR{}
+		}
+		ctx.CondStack = ctx.CondStack[:len(ctx.CondStack)-1]
+		return nil
+	}
+
+	// OpReturn fails the script. An output whose locking script starts
+	// with it can never be spent and is kept out of the UTXO set.
+	OpReturn OpFunc = func(ctx *OpCtx) error {
+		return OP_RETURN_ERR{}
+	}
+
+	// OpDrop removes the top item.
+	OpDrop OpFunc = func(ctx *OpCtx) error {
+		_, err := ctx.pop(OP_DROP)
+		return err
+	}
+
+	// Op2Drop removes the top two items.
+	Op2Drop OpFunc = func(ctx *OpCtx) error {
+		_, err := ctx.popN(OP_2DROP, 2)
+		return err
+	}
+
+	// OpSwap swaps the top two items.
+	OpSwap OpFunc = func(ctx *OpCtx) error {
+		items, err := ctx.popN(OP_SWAP, 2)
+		if err != nil {
+			return err
+		}
+		ctx.Stack.Push(items[0])
+		ctx.Stack.Push(items[1])
+		return nil
+	}
+
+	// OpOver pushes a copy of the second item.
+	OpOver OpFunc = func(ctx *OpCtx) error {
+		item, err := ctx.peek(OP_OVER, 1)
+		if err != nil {
+			return err
+		}
+		return ctx.push(item)
+	}
+
+	// OpRot moves the third item to the top.
+	OpRot OpFunc = func(ctx *OpCtx) error {
+		items, err := ctx.popN(OP_ROT, 3)
+		if err != nil {
+			return err
+		}
+		ctx.Stack.Push(items[1])
+		ctx.Stack.Push(items[0])
+		ctx.Stack.Push(items[2])
+		return nil
+	}
+
+	// OpPick removes the number n from the top and pushes a copy of the
+	// item n places below the new top. OP_ROLL moves the item instead.
+	OpPick OpFunc = func(ctx *OpCtx) error {
+		op := OpCode(ctx.Script[ctx.ScriptPtr-1])
+		nums, err := ctx.popNums(op, 1)
+		if err != nil {
+			return err
+		}
+		n := nums[0]
+		if n < 0 || int64(n) >= int64(ctx.Stack.Size()) {
+			return STACK_UNDERFLOW_ERR{op}
+		}
+		idx := ctx.Stack.Size() - 1 - int(n)
+		item := ctx.Stack.items[idx]
+		if op == OP_ROLL {
+			ctx.Stack.items = append(ctx.Stack.items[:idx], ctx.Stack.items[idx+1:]...)
+		}
+		ctx.Stack.Push(item)
+		return nil
+	}
+
+	// OpNip removes the second item.
+	OpNip OpFunc = func(ctx *OpCtx) error {
+		items, err := ctx.popN(OP_NIP, 2)
+		if err != nil {
+			return err
+		}
+		ctx.Stack.Push(items[0])
+		return nil
+	}
+
+	// OpTuck puts a copy of the top item below the second.
+	OpTuck OpFunc = func(ctx *OpCtx) error {
+		items, err := ctx.popN(OP_TUCK, 2)
+		if err != nil {
+			return err
+		}
+		ctx.Stack.Push(items[0])
+		ctx.Stack.Push(items[1])
+		return ctx.push(items[0])
+	}
+
+	// OpDepth pushes the number of items on the stack.
+	OpDepth OpFunc = func(ctx *OpCtx) error {
+		return ctx.push(ScriptNum(ctx.Stack.Size()).Bytes())
+	}
+
+	// OpSize pushes the length of the top item, leaving it in place.
+	OpSize OpFunc = func(ctx *OpCtx) error {
+		top, err := ctx.peek(OP_SIZE, 0)
+		if err != nil {
+			return err
+		}
+		return ctx.push(ScriptNum(len(top)).Bytes())
+	}
+
+	// OpIfDup pushes a copy of the top item if it is true.
+	OpIfDup OpFunc = func(ctx *OpCtx) error {
+		top, err := ctx.peek(OP_IFDUP, 0)
+		if err != nil {
+			return err
+		}
+		if CastToBool(top) {
+			return ctx.push(top)
+		}
+		return nil
+	}
+)
+
+// IsUnspendable reports whether a locking script can never be satisfied
+// because it starts with OP_RETURN.
+func IsUnspendable(script []byte) bool {
+	return len(script) > 0 && OpCode(script[0]) == OP_RETURN
+}
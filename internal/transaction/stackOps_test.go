@@ -0,0 +1,122 @@
+package transaction
+
+import (
+	"testing"
+)
+
+func TestStackOps(t *testing.T) {
+	a, b, c := []byte{0x0a}, []byte{0x0b}, []byte{0x0c}
+	tests := []struct {
+		name   string
+		stack  [][]byte
+		script []byte
+		want   [][]byte
+	}{
+		{"nop", [][]byte{a}, []byte{byte(OP_NOP)}, [][]byte{a}},
+		{"drop", [][]byte{a, b}, []byte{byte(OP_DROP)}, [][]byte{a}},
+		{"2drop", [][]byte{a, b, c}, []byte{byte(OP_2DROP)}, [][]byte{a}},
+		{"swap", [][]byte{a, b}, []byte{byte(OP_SWAP)}, [][]byte{b, a}},
+		{"over", [][]byte{a, b}, []byte{byte(OP_OVER)}, [][]byte{a, b, a}},
+		{"rot", [][]byte{a, b, c}, []byte{byte(OP_ROT)}, [][]byte{b, c, a}},
+		{"pick top", [][]byte{a, b, c}, []byte{byte(OP_0), byte(OP_PICK)}, [][]byte{a, b, c, c}},
+		{"pick bottom", [][]byte{a, b, c}, []byte{byte(OP_1) + 1, byte(OP_PICK)}, [][]byte{a, b, c, a}},
+		{"roll bottom", [][]byte{a, b, c}, []byte{byte(OP_1) + 1, byte(OP_ROLL)}, [][]byte{b, c, a}},
+		{"nip", [][]byte{a, b}, []byte{byte(OP_NIP)}, [][]byte{b}},
+		{"tuck", [][]byte{a, b}, []byte{byte(OP_TUCK)}, [][]byte{b, a, b}},
+		{"depth", [][]byte{a, b}, []byte{byte(OP_DEPTH)}, [][]byte{a, b, {0x02}}},
+		{"depth empty", nil, []byte{byte(OP_DEPTH)}, [][]byte{{}}},
+		{"size", [][]byte{{1, 2, 3}}, []byte{byte(OP_SIZE)}, [][]byte{{1, 2, 3}, {0x03}}},
+		{"ifdup true", [][]byte{a}, []byte{byte(OP_IFDUP)}, [][]byte{a, a}},
+		{"ifdup false", [][]byte{{0x80}}, []byte{byte(OP_IFDUP)}, [][]byte{{0x80}}},
+		{"small ints", nil, []byte{byte(OP_1NEGATE), byte(OP_0), byte(OP_16)}, [][]byte{{0x81}, {}, {0x10}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			stack, err := runScript(tc.stack, tc.script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertStack(t, stack, tc.want)
+		})
+	}
+}
+
+func TestStackUnderflow(t *testing.T) {
+	one := [][]byte{{0x01}}
+	two := [][]byte{{0x01}, {0x02}}
+	tests := []struct {
+		name   string
+		stack  [][]byte
+		script []byte
+		op     OpCode
+	}{
+		{"drop", nil, []byte{byte(OP_DROP)}, OP_DROP},
+		{"2drop", one, []byte{byte(OP_2DROP)}, OP_2DROP},
+		{"swap", one, []byte{byte(OP_SWAP)}, OP_SWAP},
+		{"over", one, []byte{byte(OP_OVER)}, OP_OVER},
+		{"rot", two, []byte{byte(OP_ROT)}, OP_ROT},
+		{"pick no index", nil, []byte{byte(OP_PICK)}, OP_PICK},
+		{"pick past bottom", two, []byte{byte(OP_1) + 1, byte(OP_PICK)}, OP_PICK},
+		{"pick negative", two, []byte{byte(OP_1NEGATE), byte(OP_PICK)}, OP_PICK},
+		{"roll past bottom", one, []byte{byte(OP_1), byte(OP_ROLL)}, OP_ROLL},
+		{"nip", one, []byte{byte(OP_NIP)}, OP_NIP},
+		{"tuck", one, []byte{byte(OP_TUCK)}, OP_TUCK},
+		{"size", nil, []byte{byte(OP_SIZE)}, OP_SIZE},
+		{"ifdup", nil, []byte{byte(OP_IFDUP)}, OP_IFDUP},
+		{"if", nil, []byte{byte(OP_IF), byte(OP_ENDIF)}, OP_IF},
+		{"notif", nil, []byte{byte(OP_NOTIF), byte(OP_ENDIF)}, OP_NOTIF},
+		{"1add", nil, []byte{byte(OP_1ADD)}, OP_1ADD},
+		{"add", one, []byte{byte(OP_ADD)}, OP_ADD},
+		{"within", two, []byte{byte(OP_WITHIN)}, OP_WITHIN},
+		{"numequalverify", one, []byte{byte(OP_NUMEQUALVERIFY)}, OP_NUMEQUALVERIFY},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := runScript(tc.stack, tc.script)
+			if want := (STACK_UNDERFLOW_ERR{tc.op}); err != want {
+				t.Errorf("got %v, want %v", err, want)
+			}
+		})
+	}
+}
+
+func TestConditionals(t *testing.T) {
+	t1, t0 := byte(OP_1), byte(OP_0)
+	IF, NOTIF, ELSE, ENDIF := byte(OP_IF), byte(OP_NOTIF), byte(OP_ELSE), byte(OP_ENDIF)
+	two, three := byte(OP_1)+1, byte(OP_1)+2
+	tests := []struct {
+		name   string
+		script []byte
+		want   [][]byte
+		err    error
+	}{
+		{"if taken", []byte{t1, IF, two, ELSE, three, ENDIF}, [][]byte{{0x02}}, nil},
+		{"else taken", []byte{t0, IF, two, ELSE, three, ENDIF}, [][]byte{{0x03}}, nil},
+		{"notif", []byte{t0, NOTIF, two, ENDIF}, [][]byte{{0x02}}, nil},
+		{"else twice", []byte{t1, IF, two, ELSE, three, ELSE, two, ENDIF}, [][]byte{{0x02}, {0x02}}, nil},
+		{"nested both taken", []byte{t1, IF, t1, IF, two, ELSE, three, ENDIF, ENDIF}, [][]byte{{0x02}}, nil},
+		{"nested inner else", []byte{t1, IF, t0, IF, two, ELSE, three, ENDIF, ENDIF}, [][]byte{{0x03}}, nil},
+		// the inner IF is skipped, so it takes no condition and neither of
+		// its branches runs
+		{"nested in skipped branch", []byte{t0, IF, IF, two, ELSE, three, ENDIF, ELSE, t1, ENDIF}, [][]byte{{0x01}}, nil},
+		{"skipped push and return", append(append([]byte{t0, IF}, pushBytes([]byte{byte(OP_ENDIF)})...), byte(OP_RETURN), ENDIF, t1), [][]byte{{0x01}}, nil},
+		{"return", []byte{t1, IF, byte(OP_RETURN), ENDIF}, nil, OP_RETURN_ERR{}},
+		{"else without if", []byte{t1, ELSE}, nil, UNBALANCED_CONDITIONAL_ERR{}},
+		{"endif without if", []byte{ENDIF}, nil, UNBALANCED_CONDITIONAL_ERR{}},
+		{"extra endif", []byte{t1, IF, ENDIF, ENDIF}, nil, UNBALANCED_CONDITIONAL_ERR{}},
+		{"if without endif", []byte{t1, IF, two}, nil, UNBALANCED_CONDITIONAL_ERR{}},
+		{"nested without endif", []byte{t1, IF, t1, IF, ENDIF}, nil, UNBALANCED_CONDITIONAL_ERR{}},
+		{"skipped if without endif", []byte{t0, IF, IF, ENDIF}, nil, UNBALANCED_CONDITIONAL_ERR{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			stack, err := runScript(nil, tc.script)
+			if err != tc.err {
+				t.Fatalf("got %v, want %v", err, tc.err)
+			}
+			if err == nil {
+				assertStack(t, stack, tc.want)
+			}
+		})
+	}
+}
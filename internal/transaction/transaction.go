@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 
+	"github.com/tiereum/trmnode/internal/t_config"
 	"github.com/tiereum/trmnode/internal/t_util"
 )
 
@@ -83,6 +84,7 @@ type TxIn struct {
 	PrevOutpt           OutPoint
 	UnlockingScriptSize CompactSize
 	UnlockingScript     []byte
+	Sequence            uint32 // relative lock, see SEQUENCE_FINAL
 }
 
 type TxIns []TxIn
@@ -93,6 +95,7 @@ func (s TxIn) Copy() TxIn {
 		PrevOutpt:           s.PrevOutpt.Copy(),
 		UnlockingScriptSize: s.UnlockingScriptSize,
 		UnlockingScript:     unlockscript,
+		Sequence:            s.Sequence,
 	}
 	return o
 }
@@ -111,13 +114,34 @@ type Tx struct {
 	Inputs     TxIns
 	NumOutputs uint8
 	Outputs    TxOuts
-	LockTime   uint32 // number of blocks until spending is allowed
+	LockTime   uint32 // height or time before which the tx is not final, see IsFinal
 }
 type Utxo struct {
 	OutPoint          OutPoint
 	Value             int64
 	LockingScriptSize CompactSize
 	LockingScript     []byte
+	Height            uint32 // of the block that created the output
+	Coinbase          bool
+}
+
+// NewUtxo makes the utxo for output idx of tx, created in a block at height.
+func NewUtxo(tx *Tx, txHash []byte, idx int, height int64) *Utxo {
+	out := tx.Outputs[idx]
+	return &Utxo{
+		OutPoint:          OutPoint{TxId: txHash, Idx: int32(idx)},
+		Value:             out.Value,
+		LockingScriptSize: out.LockingScriptSize,
+		LockingScript:     out.LockingScript,
+		Height:            uint32(height),
+		Coinbase:          tx.IsCoinbase(),
+	}
+}
+
+// IsMature reports whether utxo may be spent by a tx in a block at height.
+// Only coinbase outputs have to wait COINBASE_MATURITY blocks.
+func (utxo *Utxo) IsMature(height int64) bool {
+	return !utxo.Coinbase || height-int64(utxo.Height) >= int64(t_config.COINBASE_MATURITY)
 }
 
 func (s *Tx) Copy() Tx {
@@ -148,7 +172,34 @@ func Coinbase(scriptSz CompactSize, script []byte) TxIn {
 		PrevOutpt:           OutPoint{TxId: make([]byte, 32), Idx: -1},
 		UnlockingScriptSize: scriptSz,
 		UnlockingScript:     script,
+		Sequence:            SEQUENCE_FINAL,
+	}
+}
+
+// CoinbaseScript is the unlocking script of the coinbase at height: the
+// height pushed first, then extra. The height makes every coinbase, and so
+// its txid, unique even when it pays the same amount to the same address.
+func CoinbaseScript(height int64, extra []byte) []byte {
+	return append(PushData(ScriptNum(height).Bytes()), extra...)
+}
+
+// CoinbaseHeight reads the height CoinbaseScript put first in script.
+func CoinbaseHeight(script []byte) (int64, bool) {
+	if len(script) == 0 {
+		return 0, false
+	}
+	if _, ok := OpPushMap[OpCode(script[0])]; !ok {
+		return 0, false
+	}
+	data, _, err := readPush(script, 0)
+	if err != nil {
+		return 0, false
+	}
+	n, err := DecodeNum(data, MAX_NUM_SIZE)
+	if err != nil {
+		return 0, false
 	}
+	return int64(n), true
 }
 
 func (tx *Tx) IsCoinbase() bool {
@@ -171,9 +222,9 @@ func (tx *Tx) HasCoinbases() bool {
 func (tx *Tx) Preimage(inIdx uint8, inUTXO *Utxo, sigHashFlag byte) []byte {
 	txCopy := tx.Copy()
 
-	for _, tx_in := range txCopy.Inputs {
-		tx_in.UnlockingScript = []byte{0x00}
-		tx_in.UnlockingScriptSize = NewCompactSize(1)
+	for i := range txCopy.Inputs {
+		txCopy.Inputs[i].UnlockingScript = []byte{0x00}
+		txCopy.Inputs[i].UnlockingScriptSize = NewCompactSize(1)
 	}
 	txCopy.Inputs[inIdx].UnlockingScriptSize = inUTXO.LockingScriptSize
 	txCopy.Inputs[inIdx].UnlockingScript = inUTXO.LockingScript
@@ -185,10 +236,10 @@ func (tx *Tx) Preimage(inIdx uint8, inUTXO *Utxo, sigHashFlag byte) []byte {
 		txCopy.Outputs = []TxOut{}
 	case SIGHASH_SINGLE:
 		txCopy.Outputs = txCopy.Outputs[:inIdx+1]
-		for _, tx_out := range txCopy.Outputs[:inIdx] {
-			tx_out.Value = -1
-			tx_out.LockingScriptSize = NewCompactSize(1)
-			tx_out.LockingScript = []byte{0x00}
+		for i := range txCopy.Outputs[:inIdx] {
+			txCopy.Outputs[i].Value = -1
+			txCopy.Outputs[i].LockingScriptSize = NewCompactSize(1)
+			txCopy.Outputs[i].LockingScript = []byte{0x00}
 		}
 	}
 
@@ -69,6 +69,18 @@ func (io *TxIndexIO) Read(txHash []byte) *TxMetadata {
 	return &meta
 }
 
+func (io *TxIndexIO) Has(txHash []byte) bool {
+	err := io.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(txHash)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return false
+	}
+	t_error.LogErr(err)
+	return true
+}
+
 func (io *TxIndexIO) Delete(txHash []byte) {
 	err := io.db.Update(func(txn *badger.Txn) error {
 		err := txn.Delete(txHash)
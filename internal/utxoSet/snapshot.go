@@ -0,0 +1,267 @@
+package utxoSet
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"io"
+
+	"github.com/tiereum/trmnode/internal/t_error"
+	"github.com/tiereum/trmnode/internal/transaction"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// A snapshot is the UTXO set as of one block, in key order:
+//
+//	magic       4 bytes
+//	version     1 byte
+//	best block 32 bytes
+//	records     4 byte length and an encoded utxo each
+//	end         4 zero bytes
+//	count       8 bytes
+//	total       8 bytes, sum of the values
+//	hash       32 bytes, the set hash
+//
+// The footer lets a loader check it read exactly the set that was dumped.
+const (
+	SNAPSHOT_MAGIC   uint32 = 0x74726d75 // "trmu"
+	SNAPSHOT_VERSION uint8  = 1
+	LOAD_BATCH_SIZE         = 10000
+)
+
+type BAD_SNAPSHOT_ERR struct {
+	Reason string
+}
+
+func (e BAD_SNAPSHOT_ERR) Error() string {
+	return "Bad UTXO snapshot: " + e.Reason + "."
+}
+
+type UNKNOWN_SNAPSHOT_BASE_ERR struct{}
+
+func (e UNKNOWN_SNAPSHOT_BASE_ERR) Error() string {
+	return "The snapshot was taken at a block that is not in the block index."
+}
+
+// UtxoStats describes the set as of BestBlock. Hash is sha256 over every
+// encoded utxo, each preceded by its length, in outpoint key order, so two
+// stores holding the same outputs have the same hash however they were
+// built.
+type UtxoStats struct {
+	BestBlock []byte
+	Count     uint64
+	Total     int64
+	Hash      []byte
+}
+
+type statsWriter struct {
+	stats UtxoStats
+	hash  hash.Hash
+}
+
+func newStatsWriter(best []byte) *statsWriter {
+	return &statsWriter{stats: UtxoStats{BestBlock: best}, hash: sha256.New()}
+}
+
+func (w *statsWriter) add(val []byte, utxo *transaction.Utxo) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(len(val)))
+	w.hash.Write(b)
+	w.hash.Write(val)
+	w.stats.Count++
+	w.stats.Total += utxo.Value
+}
+
+func (w *statsWriter) done() *UtxoStats {
+	w.stats.Hash = w.hash.Sum(nil)
+	return &w.stats
+}
+
+// scan calls fn with every encoded utxo and the best block marker, all read
+// in one transaction so they belong to the same block.
+func (store *UtxoStore) scan(fn func(best []byte, val []byte, utxo *transaction.Utxo) error) (*UtxoStats, error) {
+	var stats *UtxoStats
+	err := store.db.View(func(txn *badger.Txn) error {
+		var best []byte
+		if item, err := txn.Get(BEST_BLOCK_KEY); err == nil {
+			if best, err = item.ValueCopy(nil); err != nil {
+				return err
+			}
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		w := newStatsWriter(best)
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			if bytes.Equal(iter.Item().Key(), BEST_BLOCK_KEY) {
+				continue
+			}
+			val, err := iter.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			utxoDec := transaction.NewUtxoDecoder(nil)
+			if err := utxoDec.Decode(bytes.NewBuffer(val)); err != nil {
+				return err
+			}
+			w.add(val, utxoDec.Out())
+			if fn != nil {
+				if err := fn(best, val, utxoDec.Out()); err != nil {
+					return err
+				}
+			}
+		}
+		stats = w.done()
+		return nil
+	})
+	return stats, err
+}
+
+// Stats counts the set and computes its hash.
+func (store *UtxoStore) Stats() *UtxoStats {
+	stats, err := store.scan(nil)
+	t_error.LogErr(err)
+	return stats
+}
+
+// Dump writes the set to w as a snapshot.
+func (store *UtxoStore) Dump(w io.Writer) (*UtxoStats, error) {
+	out := bufio.NewWriter(w)
+	started := false
+	start := func(best []byte) {
+		binary.Write(out, binary.BigEndian, SNAPSHOT_MAGIC)
+		out.WriteByte(SNAPSHOT_VERSION)
+		b := make([]byte, 32)
+		copy(b, best)
+		out.Write(b)
+		started = true
+	}
+
+	stats, err := store.scan(func(best []byte, val []byte, utxo *transaction.Utxo) error {
+		if !started {
+			start(best)
+		}
+		binary.Write(out, binary.BigEndian, uint32(len(val)))
+		_, err := out.Write(val)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !started {
+		start(stats.BestBlock)
+	}
+	binary.Write(out, binary.BigEndian, uint32(0))
+	binary.Write(out, binary.BigEndian, stats.Count)
+	binary.Write(out, binary.BigEndian, stats.Total)
+	out.Write(stats.Hash)
+	return stats, out.Flush()
+}
+
+// Load replaces the set with the snapshot read from r. hasBlock is asked
+// whether the snapshot's block is known before anything is changed. The
+// best block marker is only moved to the snapshot's block once every record
+// is written and the footer matches, so an interrupted load leaves a set
+// the node refuses to start with rather than a wrong one.
+func (store *UtxoStore) Load(r io.Reader, hasBlock func(hash []byte) bool) (*UtxoStats, error) {
+	in := bufio.NewReader(r)
+	header := make([]byte, 4+1+32)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return nil, BAD_SNAPSHOT_ERR{"truncated header"}
+	}
+	if binary.BigEndian.Uint32(header) != SNAPSHOT_MAGIC {
+		return nil, BAD_SNAPSHOT_ERR{"not a snapshot"}
+	}
+	if header[4] != SNAPSHOT_VERSION {
+		return nil, BAD_SNAPSHOT_ERR{"unsupported version"}
+	}
+	best := header[5:]
+	if !hasBlock(best) {
+		return nil, UNKNOWN_SNAPSHOT_BASE_ERR{}
+	}
+
+	if err := store.db.DropAll(); err != nil {
+		return nil, err
+	}
+	if err := store.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(BEST_BLOCK_KEY, make([]byte, 32))
+	}); err != nil {
+		return nil, err
+	}
+
+	w := newStatsWriter(best)
+	batch := store.db.NewWriteBatch()
+	defer func() {
+		if batch != nil {
+			batch.Cancel()
+		}
+	}()
+	pending := 0
+	size := make([]byte, 4)
+	var prev []byte
+	for {
+		if _, err := io.ReadFull(in, size); err != nil {
+			return nil, BAD_SNAPSHOT_ERR{"truncated record"}
+		}
+		n := binary.BigEndian.Uint32(size)
+		if n == 0 {
+			break
+		}
+		val := make([]byte, n)
+		if _, err := io.ReadFull(in, val); err != nil {
+			return nil, BAD_SNAPSHOT_ERR{"truncated record"}
+		}
+		utxoDec := transaction.NewUtxoDecoder(nil)
+		if err := utxoDec.Decode(bytes.NewBuffer(val)); err != nil {
+			return nil, BAD_SNAPSHOT_ERR{"bad record"}
+		}
+		utxo := utxoDec.Out()
+		w.add(val, utxo)
+
+		outptEnc := transaction.NewOutPointEncoder(nil)
+		outptEnc.Encode(&utxo.OutPoint)
+		key := outptEnc.Bytes()
+		// in key order, which also rules out duplicates
+		if prev != nil && bytes.Compare(key, prev) <= 0 {
+			return nil, BAD_SNAPSHOT_ERR{"records out of order"}
+		}
+		prev = key
+		if err := batch.Set(key, val); err != nil {
+			return nil, err
+		}
+		if pending++; pending == LOAD_BATCH_SIZE {
+			err := batch.Flush()
+			batch = nil
+			if err != nil {
+				return nil, err
+			}
+			batch = store.db.NewWriteBatch()
+			pending = 0
+		}
+	}
+	err := batch.Flush()
+	batch = nil
+	if err != nil {
+		return nil, err
+	}
+
+	stats := w.done()
+	footer := make([]byte, 8+8+32)
+	if _, err := io.ReadFull(in, footer); err != nil {
+		return nil, BAD_SNAPSHOT_ERR{"truncated footer"}
+	}
+	if binary.BigEndian.Uint64(footer) != stats.Count ||
+		int64(binary.BigEndian.Uint64(footer[8:])) != stats.Total ||
+		!bytes.Equal(footer[16:], stats.Hash) {
+		return nil, BAD_SNAPSHOT_ERR{"contents do not match the footer"}
+	}
+	if err := store.Apply(nil, nil, best); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
@@ -13,6 +13,11 @@ import (
 	"github.com/dgraph-io/badger/v4"
 )
 
+// BEST_BLOCK_KEY holds the hash of the block whose state the set reflects.
+// It is written in the same transaction as the block's changes, so the set
+// and the marker can never disagree.
+var BEST_BLOCK_KEY = []byte("bestBlock")
+
 type UtxoStore struct {
 	ctx *t_config.Context
 	db  *badger.DB
@@ -93,7 +98,9 @@ func (store *UtxoStore) Delete(pt *transaction.OutPoint) {
 	t_error.LogErr(err)
 }
 
-func (store *UtxoStore) FindUTXOsByAddr(addrHex string) []transaction.Utxo {
+// FindUTXOsByAddr returns the outputs whose locking script pays to address,
+// a key or a script address.
+func (store *UtxoStore) FindUTXOsByAddr(address string) []transaction.Utxo {
 	utxos := list.New()
 	err := store.db.View(func(txn *badger.Txn) error {
 		iter := txn.NewIterator(badger.DefaultIteratorOptions)
@@ -102,13 +109,16 @@ func (store *UtxoStore) FindUTXOsByAddr(addrHex string) []transaction.Utxo {
 		buffer := new(bytes.Buffer)
 		for iter.Rewind(); iter.Valid(); iter.Next() {
 			item := iter.Item()
+			if bytes.Equal(item.Key(), BEST_BLOCK_KEY) {
+				continue
+			}
 			err := item.Value(func(val []byte) error {
 
 				buffer.Write(val)
 				err := utxoDec.Decode(buffer)
 				t_error.LogErr(err)
-				lockaddr := transaction.GetAddrFromP2PKHLockScript(utxoDec.Out().LockingScript)
-				if lockaddr == addrHex {
+				lockaddr := transaction.LockScriptAddress(utxoDec.Out().LockingScript)
+				if lockaddr == address {
 					utxos.PushBack(utxoDec.Out())
 				}
 				buffer.Reset()
@@ -137,3 +147,94 @@ func (store *UtxoStore) FindUTXOsByAddr(addrHex string) []transaction.Utxo {
 	}
 	return utxoSlice
 }
+
+// ForEach calls fn with every utxo in the set, in key order.
+func (store *UtxoStore) ForEach(fn func(utxo *transaction.Utxo)) {
+	err := store.db.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			if bytes.Equal(iter.Item().Key(), BEST_BLOCK_KEY) {
+				continue
+			}
+			val, err := iter.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			utxoDec := transaction.NewUtxoDecoder(nil)
+			if err := utxoDec.Decode(bytes.NewBuffer(val)); err != nil {
+				return err
+			}
+			fn(utxoDec.Out())
+		}
+		return nil
+	})
+	t_error.LogErr(err)
+}
+
+// Apply deletes spent, writes added and moves the best block marker to
+// best in a single transaction.
+func (store *UtxoStore) Apply(spent []*transaction.OutPoint, added []*transaction.Utxo, best []byte) error {
+	return store.db.Update(func(txn *badger.Txn) error {
+		for _, pt := range spent {
+			enc := transaction.NewOutPointEncoder(nil)
+			enc.Encode(pt)
+			if err := txn.Delete(enc.Bytes()); err != nil {
+				return err
+			}
+		}
+		for _, utxo := range added {
+			utxoEnc := transaction.NewUtxoEncoder(nil)
+			utxoEnc.Encode(utxo)
+			outptEnc := transaction.NewOutPointEncoder(nil)
+			outptEnc.Encode(&utxo.OutPoint)
+			if err := txn.Set(outptEnc.Bytes(), utxoEnc.Bytes()); err != nil {
+				return err
+			}
+		}
+		return txn.Set(BEST_BLOCK_KEY, best)
+	})
+}
+
+// BestBlock returns the hash of the block the set was last brought up to,
+// or false for a set written before the marker existed.
+func (store *UtxoStore) BestBlock() ([]byte, bool) {
+	var best []byte
+	err := store.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(BEST_BLOCK_KEY)
+		if err != nil {
+			return err
+		}
+		best, err = item.ValueCopy(nil)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, false
+	}
+	t_error.LogErr(err)
+	return best, true
+}
+
+func (store *UtxoStore) SetBestBlock(best []byte) {
+	t_error.LogErr(store.Apply(nil, nil, best))
+}
+
+// Empty reports whether the set holds no outputs.
+func (store *UtxoStore) Empty() bool {
+	empty := true
+	err := store.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			if !bytes.Equal(iter.Item().Key(), BEST_BLOCK_KEY) {
+				empty = false
+				break
+			}
+		}
+		return nil
+	})
+	t_error.LogErr(err)
+	return empty
+}
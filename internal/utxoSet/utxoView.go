@@ -0,0 +1,109 @@
+package utxoSet
+
+import (
+	"encoding/hex"
+
+	"github.com/tiereum/trmnode/internal/transaction"
+)
+
+// UtxoReader is satisfied by both the store and views on top of it.
+type UtxoReader interface {
+	Read(pt *transaction.OutPoint) (*transaction.Utxo, bool)
+}
+
+// UtxoView stages additions and spends on top of a UtxoStore so a whole
+// block can be applied, or abandoned, before anything is written.
+type UtxoView struct {
+	store *UtxoStore
+	added map[string]*transaction.Utxo
+	spent map[string]*transaction.OutPoint
+}
+
+func NewUtxoView(store *UtxoStore) *UtxoView {
+	return &UtxoView{
+		store: store,
+		added: make(map[string]*transaction.Utxo),
+		spent: make(map[string]*transaction.OutPoint),
+	}
+}
+
+func outPointKey(pt *transaction.OutPoint) string {
+	enc := transaction.NewOutPointEncoder(nil)
+	enc.Encode(pt)
+	return hex.EncodeToString(enc.Bytes())
+}
+
+func (view *UtxoView) Read(pt *transaction.OutPoint) (*transaction.Utxo, bool) {
+	key := outPointKey(pt)
+	if utxo, ok := view.added[key]; ok {
+		return utxo, true
+	}
+	if _, ok := view.spent[key]; ok {
+		return nil, false
+	}
+	return view.store.Read(pt)
+}
+
+func (view *UtxoView) Add(utxo *transaction.Utxo) {
+	key := outPointKey(&utxo.OutPoint)
+	delete(view.spent, key)
+	view.added[key] = utxo
+}
+
+// Spend removes the output from the view and returns it, or false if it
+// is not unspent.
+func (view *UtxoView) Spend(pt *transaction.OutPoint) (*transaction.Utxo, bool) {
+	utxo, ok := view.Read(pt)
+	if !ok {
+		return nil, false
+	}
+	key := outPointKey(pt)
+	delete(view.added, key)
+	if _, ok := view.store.Read(pt); ok {
+		view.spent[key] = pt
+	}
+	return utxo, true
+}
+
+// ConnectTx spends the inputs of tx and adds its outputs, flagged as
+// created at height. Outputs that can never be spent are left out. It
+// returns the spent outputs, or false if an input is not unspent, in which
+// case the view is left partly applied.
+func (view *UtxoView) ConnectTx(tx *transaction.Tx, height int64) ([]transaction.Utxo, bool) {
+	spent := []transaction.Utxo{}
+	if !tx.IsCoinbase() {
+		for _, in := range tx.Inputs {
+			utxo, ok := view.Spend(&in.PrevOutpt)
+			if !ok {
+				return nil, false
+			}
+			spent = append(spent, *utxo)
+		}
+	}
+	txHash := tx.Hash()
+	for idx, out := range tx.Outputs {
+		if !transaction.IsUnspendable(out.LockingScript) {
+			view.Add(transaction.NewUtxo(tx, txHash, idx, height))
+		}
+	}
+	return spent, true
+}
+
+// Flush writes the staged changes to the underlying store, together with
+// best as the block the store now reflects, in one transaction.
+func (view *UtxoView) Flush(best []byte) error {
+	spent := make([]*transaction.OutPoint, 0, len(view.spent))
+	for _, pt := range view.spent {
+		spent = append(spent, pt)
+	}
+	added := make([]*transaction.Utxo, 0, len(view.added))
+	for _, utxo := range view.added {
+		added = append(added, utxo)
+	}
+	if err := view.store.Apply(spent, added, best); err != nil {
+		return err
+	}
+	view.added = make(map[string]*transaction.Utxo)
+	view.spent = make(map[string]*transaction.OutPoint)
+	return nil
+}
@@ -1,18 +1,22 @@
 package validator
 
 import (
+	"bytes"
 	"encoding/hex"
 
 	"github.com/tiereum/trmnode/internal/block"
 	"github.com/tiereum/trmnode/internal/blockchain"
 	"github.com/tiereum/trmnode/internal/blockchain/proof"
 	"github.com/tiereum/trmnode/internal/t_config"
+	"github.com/tiereum/trmnode/internal/transaction"
+	"github.com/tiereum/trmnode/internal/utxoSet"
 )
 
 type BlockValidator struct {
 	ctx         *t_config.Context
 	blockchain  *blockchain.Blockchain
 	txValidator *TxValidator
+	clock       Clock
 }
 
 func NewBlockValidator(ctx *t_config.Context, blockchain *blockchain.Blockchain, txValidator *TxValidator) *BlockValidator {
@@ -20,28 +24,84 @@ func NewBlockValidator(ctx *t_config.Context, blockchain *blockchain.Blockchain,
 	b.ctx = ctx
 	b.blockchain = blockchain
 	b.txValidator = txValidator
+	b.clock = SystemClock{}
 	return b
 }
 
-func (validator *BlockValidator) Validate(block *block.Block) bool {
-	if !validator.AssertNonEmpty(block) ||
-		!validator.AssertNonce(block) ||
-		!validator.AssertMerkelHash(block) ||
-		!validator.AssertCoinbaseFirst(block) ||
-		!validator.AssertValidTxs(block) {
-		return false
+func (validator *BlockValidator) SetClock(clock Clock) {
+	validator.clock = clock
+}
+
+type blockAssertion func(*block.Block) bool
+
+// Validate returns nil if block may be added to the block tree, otherwise
+// a RuleErr for the first rule it breaks.
+func (validator *BlockValidator) Validate(block *block.Block) error {
+	if !validator.AssertNonEmpty(block) {
+		return NewBlockErr(REJECT_EMPTY_BLOCK)
+	}
+	parent := validator.blockchain.Node(block.Header.PrevHash)
+	if err := validator.ValidateHeader(&block.Header, parent); err != nil {
+		return err
+	}
+	checks := []struct {
+		assert blockAssertion
+		code   RejectCode
+	}{
+		{validator.AssertMerkelHash, REJECT_BAD_MERKLE_ROOT},
+		{validator.AssertCoinbaseFirst, REJECT_NO_COINBASE},
+	}
+	for _, check := range checks {
+		if !check.assert(block) {
+			return NewBlockErr(check.code)
+		}
+	}
+	// the UTXO set is the tip's, so a side branch block can only be checked
+	// against it once a reorg connects its parent, which runs ConnectBlock
+	// as the chain's BlockChecker
+	if !bytes.Equal(parent.Hash(), validator.blockchain.Tip().Hash()) {
+		return nil
+	}
+	return validator.ConnectBlock(block)
+}
+
+// ValidateHeader checks the rules a header can be held to without its
+// transactions, given the block it builds on. Headers received during sync
+// are checked this way before their blocks are downloaded.
+func (validator *BlockValidator) ValidateHeader(header *block.Header, parent *blockchain.BlockNode) error {
+	if parent == nil {
+		return NewBlockErr(REJECT_UNKNOWN_PARENT)
+	}
+	if header.Bits != validator.blockchain.NextBits(parent) {
+		return NewBlockErr(REJECT_BAD_TARGET)
 	}
-	return true
+	if err := validator.checkTime(header, parent); err != nil {
+		return err
+	}
+	pow := proof.NewPoW()
+	if !pow.Validate(header.Bits, header.Hash()) {
+		return NewBlockErr(REJECT_BAD_POW)
+	}
+	return nil
 }
 
 func (validator *BlockValidator) AssertNonEmpty(block *block.Block) bool {
 	return len(block.Transactions) > 0
 }
 
-func (validator *BlockValidator) AssertNonce(block *block.Block) bool {
-	pow := proof.NewPoW()
-	return pow.Validate(block.Header.Target, block.Hash())
+// checkTime checks the header time is after the median time past of its
+// parent and not too far ahead of the local clock.
+func (validator *BlockValidator) checkTime(header *block.Header, parent *blockchain.BlockNode) error {
+	if header.TimeStamp <= parent.MedianTimePast() {
+		return NewBlockErr(REJECT_TIME_TOO_OLD)
+	}
+	maxTime := validator.clock.Now().Unix() + t_config.MAX_FUTURE_BLOCK_TIME
+	if int64(header.TimeStamp) > maxTime {
+		return NewBlockErr(REJECT_TIME_TOO_NEW)
+	}
+	return nil
 }
+
 func (validator *BlockValidator) AssertMerkelHash(block *block.Block) bool {
 	a_root := hex.EncodeToString(block.MerkelRoot())
 	e_root := hex.EncodeToString(block.Header.MerkleRootHash)
@@ -52,11 +112,91 @@ func (validator *BlockValidator) AssertCoinbaseFirst(block *block.Block) bool {
 	first := block.Transactions[0]
 	return first.IsCoinbase()
 }
-func (validator *BlockValidator) AssertValidTxs(block *block.Block) bool {
-	for _, tx := range block.Transactions {
-		if !validator.txValidator.ValidateTx(&tx) {
-			return false
+
+// ConnectBlock checks the rules that depend on chain state by applying the
+// block's transactions in order to a view of the UTXO set, so a tx may
+// spend outputs created earlier in the same block. The set must be at the
+// block's parent. The view is discarded; it returns the first rule the
+// block breaks.
+func (validator *BlockValidator) ConnectBlock(block *block.Block) error {
+	parent := validator.blockchain.Node(block.Header.PrevHash)
+	if parent == nil {
+		return NewBlockErr(REJECT_UNKNOWN_PARENT)
+	}
+	if int(block.TXCount) != len(block.Transactions) {
+		return NewBlockErr(REJECT_BAD_TXCOUNT)
+	}
+
+	if len(block.Transactions) == 0 || !block.Transactions[0].IsCoinbase() {
+		return NewBlockErr(REJECT_NO_COINBASE)
+	}
+	// the height keeps coinbase txids unique, so one block's coinbase
+	// output can never overwrite another's
+	height, ok := transaction.CoinbaseHeight(block.Transactions[0].Inputs[0].UnlockingScript)
+	if !ok || height != parent.Height()+1 {
+		return NewTxErr(REJECT_BAD_COINBASE_HEIGHT, block.Transactions[0].Hash(), 0)
+	}
+
+	view := utxoSet.NewUtxoView(validator.txValidator.utxoStore)
+	coinbaseHash := block.Transactions[0].Hash()
+	txids := make(map[string]bool)
+	spent := make(map[string]bool)
+	var fees int64 = 0
+
+	for i, tx := range block.Transactions {
+		txHash := tx.Hash()
+		if txids[hex.EncodeToString(txHash)] {
+			return NewTxErr(REJECT_DUPLICATE_TX, txHash, -1)
 		}
+		txids[hex.EncodeToString(txHash)] = true
+
+		if i > 0 {
+			var sumIn int64 = 0
+			for in_i, in := range tx.Inputs {
+				enc := transaction.NewOutPointEncoder(nil)
+				enc.Encode(&in.PrevOutpt)
+				key := hex.EncodeToString(enc.Bytes())
+				if spent[key] {
+					return NewTxErr(REJECT_DOUBLE_SPEND, txHash, in_i)
+				}
+				spent[key] = true
+				if bytes.Equal(in.PrevOutpt.TxId, coinbaseHash) {
+					return NewTxErr(REJECT_IMMATURE_COINBASE, txHash, in_i)
+				}
+				utxo, ok := view.Read(&in.PrevOutpt)
+				if !ok {
+					return NewTxErr(REJECT_MISSING_INPUT, txHash, in_i)
+				}
+				sumIn += utxo.Value
+			}
+			if err := validator.txValidator.ValidateTxInView(&tx, view, parent); err != nil {
+				return err
+			}
+			for _, in := range tx.Inputs {
+				view.Spend(&in.PrevOutpt)
+			}
+			for _, out := range tx.Outputs {
+				sumIn -= out.Value
+			}
+			fees += sumIn
+		}
+
+		for idx, out := range tx.Outputs {
+			if !transaction.IsUnspendable(out.LockingScript) {
+				view.Add(transaction.NewUtxo(&tx, txHash, idx, parent.Height()+1))
+			}
+		}
+	}
+
+	var claimed int64 = 0
+	for _, out := range block.Transactions[0].Outputs {
+		if out.Value < 0 {
+			return NewTxErr(REJECT_BAD_COINBASE_VALUE, coinbaseHash, -1)
+		}
+		claimed += out.Value
+	}
+	if claimed > blockchain.Subsidy(parent.Height()+1)+fees {
+		return NewTxErr(REJECT_BAD_COINBASE_VALUE, coinbaseHash, -1)
 	}
-	return true
+	return nil
 }
@@ -0,0 +1,24 @@
+package validator
+
+import "time"
+
+// Clock supplies the current time to time-dependent rules so they can be
+// checked against a fixed time.
+type Clock interface {
+	Now() time.Time
+}
+
+type SystemClock struct{}
+
+func (c SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// FixedClock always reports the same time.
+type FixedClock struct {
+	Time time.Time
+}
+
+func (c FixedClock) Now() time.Time {
+	return c.Time
+}
@@ -0,0 +1,100 @@
+package validator
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/tiereum/trmnode/internal/block"
+	"github.com/tiereum/trmnode/internal/blockStore"
+	"github.com/tiereum/trmnode/internal/blockchain"
+	"github.com/tiereum/trmnode/internal/t_config"
+)
+
+// chainOf links nodes with the given timestamps, oldest first from height
+// 0, and returns the last.
+func chainOf(times ...uint32) *blockchain.BlockNode {
+	var node *blockchain.BlockNode
+	for i, ts := range times {
+		meta := &blockStore.BlockMetaData{Height: *big.NewInt(int64(i)), TimeStamp: ts}
+		node = &blockchain.BlockNode{Meta: meta, Parent: node}
+	}
+	return node
+}
+
+func TestMedianTimePast(t *testing.T) {
+	tests := []struct {
+		name  string
+		times []uint32
+		want  uint32
+	}{
+		{"genesis", []uint32{100}, 100},
+		{"out of order", []uint32{100, 300, 200}, 200},
+		{"even count takes upper", []uint32{100, 400, 200, 300}, 300},
+		// only the last MEDIAN_TIME_SPAN blocks count, so the early 1000s
+		// drop out
+		{"window", []uint32{1000, 1000, 1000, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, 6},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := chainOf(tc.times...).MedianTimePast(); got != tc.want {
+				t.Errorf("got %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckTime(t *testing.T) {
+	now := int64(1_700_000_000)
+	// median time past is now - 100
+	parent := chainOf(uint32(now-300), uint32(now-100), uint32(now))
+	maxTime := now + t_config.MAX_FUTURE_BLOCK_TIME
+
+	tests := []struct {
+		name string
+		time int64
+		code RejectCode // 0 when the time is accepted
+	}{
+		{"before median", now - 200, REJECT_TIME_TOO_OLD},
+		{"at median", now - 100, REJECT_TIME_TOO_OLD},
+		{"after median", now - 99, 0},
+		{"before parent", now - 1, 0},
+		{"now", now, 0},
+		{"at max drift", maxTime, 0},
+		{"past max drift", maxTime + 1, REJECT_TIME_TOO_NEW},
+	}
+	validator := NewBlockValidator(nil, nil, nil)
+	validator.SetClock(FixedClock{time.Unix(now, 0)})
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validator.checkTime(&block.Header{TimeStamp: uint32(tc.time)}, parent)
+			if tc.code == 0 {
+				if err != nil {
+					t.Errorf("got %v, want nil", err)
+				}
+				return
+			}
+			var ruleErr RuleErr
+			if !errors.As(err, &ruleErr) || ruleErr.Code != tc.code {
+				t.Errorf("got %v, want %v", err, tc.code)
+			}
+		})
+	}
+}
+
+// The future drift limit follows the clock, not the wall time.
+func TestCheckTimeUsesClock(t *testing.T) {
+	parent := chainOf(1000)
+	header := &block.Header{TimeStamp: 1000 + 1 + uint32(t_config.MAX_FUTURE_BLOCK_TIME)}
+	validator := NewBlockValidator(nil, nil, nil)
+
+	validator.SetClock(FixedClock{time.Unix(1000, 0)})
+	if err := validator.checkTime(header, parent); err == nil {
+		t.Error("accepted a time past the drift limit")
+	}
+	validator.SetClock(FixedClock{time.Unix(1001, 0)})
+	if err := validator.checkTime(header, parent); err != nil {
+		t.Errorf("rejected a time at the drift limit: %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package validator
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+type RejectCode byte
+
+const (
+	// tx rules
+	REJECT_EMPTY_TX RejectCode = iota + 1
+	REJECT_COINBASE_INPUT
+	REJECT_MISSING_INPUT
+	REJECT_BAD_VALUE
+	REJECT_INSUFFICIENT_FEE
+	REJECT_IMMATURE_COINBASE
+	REJECT_BAD_SCRIPT_SYNTAX
+	REJECT_BAD_SIG
+	REJECT_IN_MEMPOOL
+	REJECT_NON_FINAL
+
+	// block rules
+	REJECT_EMPTY_BLOCK
+	REJECT_UNKNOWN_PARENT
+	REJECT_BAD_TARGET
+	REJECT_TIME_TOO_OLD
+	REJECT_TIME_TOO_NEW
+	REJECT_BAD_POW
+	REJECT_BAD_MERKLE_ROOT
+	REJECT_NO_COINBASE
+	REJECT_BAD_TXCOUNT
+	REJECT_DUPLICATE_TX
+	REJECT_DOUBLE_SPEND
+	REJECT_BAD_COINBASE_VALUE
+	REJECT_BAD_COINBASE_HEIGHT
+)
+
+var rejectReasons = map[RejectCode]string{
+	REJECT_EMPTY_TX:            "tx has no inputs or no outputs",
+	REJECT_COINBASE_INPUT:      "tx spends a null outpoint",
+	REJECT_MISSING_INPUT:       "input is not in the UTXO set",
+	REJECT_BAD_VALUE:           "outputs are negative or exceed inputs",
+	REJECT_INSUFFICIENT_FEE:    "fee is below the minimum",
+	REJECT_IMMATURE_COINBASE:   "input spends an immature coinbase",
+	REJECT_BAD_SCRIPT_SYNTAX:   "unlocking script is malformed",
+	REJECT_BAD_SIG:             "script evaluation failed",
+	REJECT_IN_MEMPOOL:          "tx is already in the mempool",
+	REJECT_NON_FINAL:           "tx or input is still time locked",
+	REJECT_EMPTY_BLOCK:         "block has no transactions",
+	REJECT_UNKNOWN_PARENT:      "previous block is unknown",
+	REJECT_BAD_TARGET:          "target does not match the difficulty at this height",
+	REJECT_TIME_TOO_OLD:        "timestamp is not after the median time past",
+	REJECT_TIME_TOO_NEW:        "timestamp is too far in the future",
+	REJECT_BAD_POW:             "hash does not meet the target",
+	REJECT_BAD_MERKLE_ROOT:     "merkle root does not match the transactions",
+	REJECT_NO_COINBASE:         "first tx is not a coinbase",
+	REJECT_BAD_TXCOUNT:         "tx count does not match the number of transactions",
+	REJECT_DUPLICATE_TX:        "block contains the same tx twice",
+	REJECT_DOUBLE_SPEND:        "two txs in the block spend the same output",
+	REJECT_BAD_COINBASE_VALUE:  "coinbase claims more than the subsidy and fees",
+	REJECT_BAD_COINBASE_HEIGHT: "coinbase does not start with the block height",
+}
+
+func (code RejectCode) String() string {
+	if reason, ok := rejectReasons[code]; ok {
+		return reason
+	}
+	return fmt.Sprintf("unknown rejection %d", code)
+}
+
+// BanScore is how much relaying data rejected for this reason counts
+// against a peer. Data that could not have been produced honestly scores
+// 100; data that is merely stale or unknown to us scores nothing.
+func (code RejectCode) BanScore() int {
+	switch code {
+	case REJECT_MISSING_INPUT,
+		REJECT_IN_MEMPOOL,
+		REJECT_INSUFFICIENT_FEE,
+		REJECT_IMMATURE_COINBASE,
+		REJECT_NON_FINAL,
+		REJECT_UNKNOWN_PARENT,
+		REJECT_TIME_TOO_NEW:
+		return 0
+	default:
+		return 100
+	}
+}
+
+// RuleErr is returned when a tx or block breaks a validation rule.
+type RuleErr struct {
+	Code  RejectCode
+	TxId  []byte // offending tx, nil for header rules
+	Input int    // offending input of TxId, -1 when not input specific
+	Cause error  // what exactly failed, if more is known than Code says
+}
+
+func NewTxErr(code RejectCode, txId []byte, input int) RuleErr {
+	return RuleErr{Code: code, TxId: txId, Input: input}
+}
+
+func NewBlockErr(code RejectCode) RuleErr {
+	return RuleErr{Code: code, Input: -1}
+}
+
+// Because returns e with cause attached.
+func (e RuleErr) Because(cause error) RuleErr {
+	e.Cause = cause
+	return e
+}
+
+func (e RuleErr) Unwrap() error {
+	return e.Cause
+}
+
+func (e RuleErr) Error() string {
+	msg := "Rejected: " + e.Code.String()
+	if e.TxId != nil {
+		msg += " (tx " + hex.EncodeToString(e.TxId)
+		if e.Input >= 0 {
+			msg += fmt.Sprintf(", input %d", e.Input)
+		}
+		msg += ")"
+	}
+	if e.Cause != nil {
+		msg += ": " + e.Cause.Error()
+	}
+	return msg
+}
+
+// Is matches on the rejection code so callers can use errors.Is with a
+// bare RuleErr{Code: ...}.
+func (e RuleErr) Is(target error) bool {
+	t, ok := target.(RuleErr)
+	return ok && t.Code == e.Code
+}
+
+// Code returns the rejection code of err, or 0 if it is not a RuleErr.
+func Code(err error) RejectCode {
+	var ruleErr RuleErr
+	if errors.As(err, &ruleErr) {
+		return ruleErr.Code
+	}
+	return 0
+}
+
+// BanScore returns how much err counts against the peer that sent the
+// rejected data, or 0 if err is not a RuleErr.
+func BanScore(err error) int {
+	if code := Code(err); code != 0 {
+		return code.BanScore()
+	}
+	return 0
+}
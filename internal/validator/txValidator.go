@@ -2,10 +2,7 @@ package validator
 
 import (
 	"bytes"
-	"encoding/binary"
-	"math/big"
 
-	"github.com/tiereum/trmnode/internal/blockStore"
 	"github.com/tiereum/trmnode/internal/blockchain"
 	"github.com/tiereum/trmnode/internal/mempool"
 	"github.com/tiereum/trmnode/internal/t_config"
@@ -17,159 +14,241 @@ type TxValidator struct {
 	ctx        *t_config.Context
 	blockchain *blockchain.Blockchain
 	tx         *transaction.Tx
-	txStore    *transaction.TxIndexIO
-	blockStore *blockStore.BlockStore
 	mempool    *mempool.MempoolIO
 	utxoStore  *utxoSet.UtxoStore
+	utxos      utxoSet.UtxoReader    // where inputs are looked up for the current tx
+	parent     *blockchain.BlockNode // the block the current tx would build on
+	height     int64                 // of the block the current tx would be in
 }
 
 func NewTxValidator(
 	ctx *t_config.Context,
-	_txStore *transaction.TxIndexIO,
-	_blockStore *blockStore.BlockStore,
+	_blockchain *blockchain.Blockchain,
 	_mempool *mempool.MempoolIO,
 	_utxoStore *utxoSet.UtxoStore,
 ) *TxValidator {
 	v := new(TxValidator)
 	v.ctx = ctx
-	v.blockchain = blockchain.NewBlockchain(ctx, _blockStore)
-	v.txStore = _txStore
-	v.blockStore = _blockStore
+	v.blockchain = _blockchain
 	v.mempool = _mempool
 	v.utxoStore = _utxoStore
 	return v
 }
 
-func (v *TxValidator) ValidateTx(tx *transaction.Tx) bool {
+// ValidateTx checks a loose tx for acceptance into the mempool.
+func (v *TxValidator) ValidateTx(tx *transaction.Tx) error {
 	v.tx = tx
-	if !v.assertNonEmpty() ||
-		!v.assertNoCoinbases() ||
-		!v.assertVal() ||
-		!v.assertSpentCoinbaseMaturity() ||
-		!v.assertSigScriptSyntax() ||
-		!v.assertTxNotInPool() ||
-		!v.assertTxInUTXOs() ||
-		!v.validate() {
-		return false
+	v.utxos = v.utxoStore
+	v.parent = v.blockchain.Tip()
+	v.height = v.parent.Height() + 1
+	if err := v.assertTxNotInPool(); err != nil {
+		return err
 	}
+	return v.validateTx()
+}
+
+// ValidateTxInView checks a tx that is part of a block building on parent,
+// looking up its inputs in view so it may spend outputs of earlier txs in
+// the block.
+func (v *TxValidator) ValidateTxInView(tx *transaction.Tx, view utxoSet.UtxoReader, parent *blockchain.BlockNode) error {
+	v.tx = tx
+	v.utxos = view
+	v.parent = parent
+	v.height = parent.Height() + 1
+	return v.validateTx()
+}
 
-	return true
+// CheckLocks checks a pooled tx against the current tip for the rules a
+// new tip can break: whether its inputs are still unspent, its LockTime
+// and its relative locks. A block spending the same output, or a reorg
+// that moves the tip back, can leave a tx that was accepted earlier
+// unminable.
+func (v *TxValidator) CheckLocks(tx *transaction.Tx) error {
+	v.tx = tx
+	v.utxos = v.utxoStore
+	v.parent = v.blockchain.Tip()
+	v.height = v.parent.Height() + 1
+	checks := []func() error{
+		v.assertTxInUTXOs,
+		v.assertFinal,
+		v.assertSequenceLocks,
+	}
+	for _, check := range checks {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *TxValidator) validateTx() error {
+	checks := []func() error{
+		v.assertNonEmpty,
+		v.assertNoCoinbases,
+		v.assertFinal,
+		v.assertTxInUTXOs,
+		v.assertVal,
+		v.assertSpentCoinbaseMaturity,
+		v.assertSequenceLocks,
+		v.assertSigScriptSyntax,
+		v.validate,
+	}
+	for _, check := range checks {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (v *TxValidator) assertNonEmpty() bool {
-	return len(v.tx.Inputs) > 0 && len(v.tx.Outputs) > 0
+func (v *TxValidator) reject(code RejectCode, input int) error {
+	return NewTxErr(code, v.tx.Hash(), input)
 }
 
-func (v *TxValidator) assertNoCoinbases() bool {
-	for _, in := range v.tx.Inputs {
+func (v *TxValidator) assertNonEmpty() error {
+	if len(v.tx.Inputs) == 0 || len(v.tx.Outputs) == 0 {
+		return v.reject(REJECT_EMPTY_TX, -1)
+	}
+	return nil
+}
+
+func (v *TxValidator) assertNoCoinbases() error {
+	for i, in := range v.tx.Inputs {
 		if in.PrevOutpt.Idx == -1 ||
 			bytes.Equal(in.PrevOutpt.TxId, make([]byte, 32)) {
-			return false
+			return v.reject(REJECT_COINBASE_INPUT, i)
 		}
 	}
-	return true
+	return nil
+}
+
+// assertFinal checks the tx's LockTime has passed, by height or by the
+// parent's median time past as blocks cannot lie about it.
+func (v *TxValidator) assertFinal() error {
+	if !v.tx.IsFinal(v.height, v.parent.MedianTimePast()) {
+		return v.reject(REJECT_NON_FINAL, -1)
+	}
+	return nil
 }
 
-func (v *TxValidator) assertVal() bool {
+// assertSequenceLocks checks every relative lock has passed since the
+// output its input spends was created.
+func (v *TxValidator) assertSequenceLocks() error {
+	for i, in := range v.tx.Inputs {
+		if !transaction.HasRelativeLock(in.Sequence) {
+			continue
+		}
+		utxo, ok := v.utxos.Read(&in.PrevOutpt)
+		if !ok {
+			return v.reject(REJECT_MISSING_INPUT, i)
+		}
+		var utxoTime uint32
+		if transaction.IsTimeRelativeLock(in.Sequence) {
+			utxoTime = v.parent.Ancestor(max(int64(utxo.Height)-1, 0)).MedianTimePast()
+		}
+		if !transaction.RelativeLockMet(in.Sequence, int64(utxo.Height), utxoTime, v.height, v.parent.MedianTimePast()) {
+			return v.reject(REJECT_NON_FINAL, i)
+		}
+	}
+	return nil
+}
+
+func (v *TxValidator) assertVal() error {
 	var sumIn int64 = 0
 	var sumOut int64 = 0
-	var inVal int64
-	var outVal int64
 	for i, tx_in := range v.tx.Inputs {
-		utxo, err := v.blockchain.FindUTXO(&tx_in.PrevOutpt)
-		if err != nil {
-			return false
+		utxo, ok := v.utxos.Read(&tx_in.PrevOutpt)
+		if !ok {
+			return v.reject(REJECT_MISSING_INPUT, i)
 		}
-		inVal = utxo.Value
-		outVal = v.tx.Outputs[i].Value
-		if outVal > inVal {
-			return false
+		sumIn += utxo.Value
+	}
+	for _, out := range v.tx.Outputs {
+		if out.Value < 0 {
+			return v.reject(REJECT_BAD_VALUE, -1)
 		}
-		sumIn += inVal
-		sumOut += outVal
+		sumOut += out.Value
 	}
-	return sumOut <= sumIn-int64(blockchain.TX_FEE)
+	if sumOut > sumIn {
+		return v.reject(REJECT_BAD_VALUE, -1)
+	}
+	if sumIn-sumOut < int64(blockchain.TX_FEE) {
+		return v.reject(REJECT_INSUFFICIENT_FEE, -1)
+	}
+	return nil
 }
 
-func (v *TxValidator) assertSpentCoinbaseMaturity() bool {
-
-	for _, in := range v.tx.Inputs {
-
-		txMeta := v.txStore.Read(in.PrevOutpt.TxId)
-		block, _ := v.blockStore.Read(txMeta.BlockHash)
-
-		prevTx := block.Transactions[txMeta.Index]
-
-		if (&prevTx).IsCoinbase() {
-			h := v.blockchain.Height()
-			if h.Cmp(new(big.Int).Add(&txMeta.BlockHeight, big.NewInt(int64(t_config.COINBASE_MATURITY)))) == -1 {
-				return false
-			}
+func (v *TxValidator) assertSpentCoinbaseMaturity() error {
+	for i, in := range v.tx.Inputs {
+		utxo, ok := v.utxos.Read(&in.PrevOutpt)
+		if ok && !utxo.IsMature(v.height) {
+			return v.reject(REJECT_IMMATURE_COINBASE, i)
 		}
 	}
-	return true
+	return nil
 }
 
-func (v *TxValidator) assertSigScriptSyntax() bool {
-	for _, in := range v.tx.Inputs {
-		i := 0
-		for i < len(in.UnlockingScript) {
-			_code := transaction.OpCode(in.UnlockingScript[i])
-			nSz, ok := transaction.OpPushMap[_code]
-			if !ok {
-				return false
-			}
-			i++
-			sz := binary.BigEndian.Uint32(in.UnlockingScript[i:nSz])
-			i += nSz
-
-			if len(in.UnlockingScript)-i != int(sz) {
-				return false
-			}
-			i += int(sz)
+func (v *TxValidator) assertSigScriptSyntax() error {
+	for i, in := range v.tx.Inputs {
+		if len(in.UnlockingScript) > transaction.MAX_SCRIPT_SIZE || !transaction.IsPushOnly(in.UnlockingScript) {
+			return v.reject(REJECT_BAD_SCRIPT_SYNTAX, i)
 		}
 	}
-	return true
+	return nil
 }
 
-func (v *TxValidator) assertTxNotInPool() bool {
-	_, _, ok := v.mempool.Read(v.tx.Hash())
-	return !ok
+func (v *TxValidator) assertTxNotInPool() error {
+	if _, _, ok := v.mempool.Read(v.tx.Hash()); ok {
+		return v.reject(REJECT_IN_MEMPOOL, -1)
+	}
+	return nil
 }
 
-func (v *TxValidator) assertTxInUTXOs() bool {
-	for _, in := range v.tx.Inputs {
+func (v *TxValidator) assertTxInUTXOs() error {
+	for i, in := range v.tx.Inputs {
 		outpt := in.PrevOutpt
-		_, ok := v.utxoStore.Read(&outpt)
+		_, ok := v.utxos.Read(&outpt)
 		if !ok {
-			return false
+			return v.reject(REJECT_MISSING_INPUT, i)
 		}
 	}
-	return true
+	return nil
 }
 
-func (v *TxValidator) validate() bool {
+func (v *TxValidator) validate() error {
 
 	for i, in := range v.tx.Inputs {
 		outpt := in.PrevOutpt
-		utxo, ok := v.utxoStore.Read(&outpt)
+		utxo, ok := v.utxos.Read(&outpt)
 		if !ok {
-			panic("Utxo not found")
+			return v.reject(REJECT_MISSING_INPUT, i)
 		}
 		opctx := transaction.OpCtx{
-			Tx:        v.tx,
-			Stack:     transaction.OpStack{},
-			State:     transaction.OP_OK,
-			TxIn:      &in,
-			InUtxo:    utxo,
-			InIdx:     uint8(i),
-			Script:    append(in.UnlockingScript, utxo.LockingScript...),
-			ScriptPtr: 0,
+			Tx:     v.tx,
+			TxIn:   &in,
+			InUtxo: utxo,
+			InIdx:  uint8(i),
 		}
 		interpreter := transaction.NewInterpreter(&opctx)
-		if interpreter.Execute() != transaction.OP_OK {
-			return false
+		if err := interpreter.Verify(in.UnlockingScript, utxo.LockingScript); err != nil {
+			return NewTxErr(REJECT_BAD_SIG, v.tx.Hash(), i).Because(err)
+		}
+
+		// a P2SH output only checked that the last push hashes right, now
+		// run that push as the script the output really locks to
+		if _, ok := transaction.P2SHScriptHash(utxo.LockingScript); ok {
+			args, redeem, err := transaction.SplitRedeemScript(in.UnlockingScript)
+			if err != nil {
+				return NewTxErr(REJECT_BAD_SIG, v.tx.Hash(), i).Because(err)
+			}
+			redeemUtxo := *utxo
+			redeemUtxo.LockingScript = redeem
+			redeemUtxo.LockingScriptSize = transaction.NewCompactSize(int64(len(redeem)))
+			opctx.InUtxo = &redeemUtxo
+			if err := interpreter.VerifyRedeemScript(args, redeem); err != nil {
+				return NewTxErr(REJECT_BAD_SIG, v.tx.Hash(), i).Because(err)
+			}
 		}
 	}
-	return false
+	return nil
 }
@@ -0,0 +1,204 @@
+package validator
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/tiereum/trmnode/internal/blockchain"
+	"github.com/tiereum/trmnode/internal/client"
+	"github.com/tiereum/trmnode/internal/transaction"
+)
+
+// oneUtxo is a UtxoReader holding a single output.
+type oneUtxo struct {
+	utxo *transaction.Utxo
+}
+
+func (r oneUtxo) Read(pt *transaction.OutPoint) (*transaction.Utxo, bool) {
+	if pt.Idx != r.utxo.OutPoint.Idx || !bytes.Equal(pt.TxId, r.utxo.OutPoint.TxId) {
+		return nil, false
+	}
+	return r.utxo, true
+}
+
+// spendingTx returns a tx spending an output locked by lock, and that
+// output.
+func spendingTx(lock []byte) (*transaction.Tx, *transaction.Utxo) {
+	utxo := &transaction.Utxo{
+		OutPoint:          transaction.OutPoint{TxId: bytes.Repeat([]byte{0x01}, 32), Idx: 0},
+		Value:             50,
+		LockingScriptSize: transaction.NewCompactSize(int64(len(lock))),
+		LockingScript:     lock,
+	}
+	tx := &transaction.Tx{
+		Version:    1,
+		NumInputs:  1,
+		Inputs:     []transaction.TxIn{{PrevOutpt: utxo.OutPoint, UnlockingScriptSize: transaction.NewCompactSize(0)}},
+		NumOutputs: 1,
+		Outputs:    []transaction.TxOut{{Value: 40, LockingScriptSize: transaction.NewCompactSize(1), LockingScript: []byte{0x00}}},
+	}
+	return tx, utxo
+}
+
+func multisigRedeem(t *testing.T, id *client.ClientId) []byte {
+	t.Helper()
+	redeem, err := transaction.MultisigLockScript(1, [][]byte{client.MarshalPubKey(id.PublicKey)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return redeem
+}
+
+// The scriptSig of a P2SH spend must reveal the script hashed into the
+// output, and that script must then accept the rest of the scriptSig.
+func TestValidateP2SH(t *testing.T) {
+	owner, other := client.NewClientId(), client.NewClientId()
+	redeem := multisigRedeem(t, owner)
+	flag := byte(transaction.SIGHASH_ALL)
+
+	tests := []struct {
+		name string
+		// unlocking builds the scriptSig for tx spending utxo, a P2SH
+		// output of redeem
+		unlocking func(tx *transaction.Tx, utxo *transaction.Utxo) []byte
+		cause     error
+	}{
+		{"valid", func(tx *transaction.Tx, utxo *transaction.Utxo) []byte {
+			return p2shUnlock(owner, tx, utxo, redeem, flag)
+		}, nil},
+		{"redeem hash mismatch", func(tx *transaction.Tx, utxo *transaction.Utxo) []byte {
+			return p2shUnlock(owner, tx, utxo, multisigRedeem(t, other), flag)
+		}, transaction.EVAL_FALSE_ERR{}},
+		{"no redeem script", func(tx *transaction.Tx, utxo *transaction.Utxo) []byte {
+			return nil
+		}, transaction.STACK_UNDERFLOW_ERR{Op: transaction.OP_HASH160}},
+		{"not push only", func(tx *transaction.Tx, utxo *transaction.Utxo) []byte {
+			unlocking := p2shUnlock(owner, tx, utxo, redeem, flag)
+			return append([]byte{byte(transaction.OP_1), byte(transaction.OP_DUP)}, unlocking...)
+		}, transaction.PUSH_ONLY_ERR{}},
+		// the hash matches but the redeem script rejects what is left
+		{"redeem script fails", func(tx *transaction.Tx, utxo *transaction.Utxo) []byte {
+			return p2shUnlock(other, tx, utxo, redeem, flag)
+		}, transaction.EVAL_FALSE_ERR{}},
+		{"redeem script underflows", func(tx *transaction.Tx, utxo *transaction.Utxo) []byte {
+			return transaction.PushData(redeem)
+		}, transaction.STACK_UNDERFLOW_ERR{Op: transaction.OP_CHECKMULTISIG}},
+		// signatures commit to the redeem script, not the P2SH lock
+		{"signed over the P2SH lock", func(tx *transaction.Tx, utxo *transaction.Utxo) []byte {
+			sig := append(owner.Sign(tx.Preimage(0, utxo, flag)), flag)
+			return append(transaction.MultisigUnlockScript([][]byte{sig}), transaction.PushData(redeem)...)
+		}, transaction.EVAL_FALSE_ERR{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tx, utxo := spendingTx(transaction.P2SH_LockScript(transaction.ScriptHash(redeem)))
+			tx.Inputs[0].UnlockingScript = tc.unlocking(tx, utxo)
+			tx.Inputs[0].UnlockingScriptSize = transaction.NewCompactSize(int64(len(tx.Inputs[0].UnlockingScript)))
+
+			v := &TxValidator{tx: tx, utxos: oneUtxo{utxo}}
+			err := v.validate()
+			if tc.cause == nil {
+				if err != nil {
+					t.Fatalf("rejected: %v", err)
+				}
+				return
+			}
+			var rule RuleErr
+			if !errors.As(err, &rule) || rule.Code != REJECT_BAD_SIG || rule.Input != 0 {
+				t.Fatalf("got %v, want %v on input 0", err, REJECT_BAD_SIG)
+			}
+			if rule.Cause != tc.cause {
+				t.Errorf("cause is %v, want %v", rule.Cause, tc.cause)
+			}
+		})
+	}
+}
+
+// p2shUnlock is a scriptSig revealing redeem with id's signature, made
+// as though utxo were locked by redeem.
+func p2shUnlock(id *client.ClientId, tx *transaction.Tx, utxo *transaction.Utxo, redeem []byte, flag byte) []byte {
+	redeemUtxo := *utxo
+	redeemUtxo.LockingScript = redeem
+	redeemUtxo.LockingScriptSize = transaction.NewCompactSize(int64(len(redeem)))
+	sig := append(id.Sign(tx.Preimage(0, &redeemUtxo, flag)), flag)
+	return append(transaction.MultisigUnlockScript([][]byte{sig}), transaction.PushData(redeem)...)
+}
+
+// lockChain is a parent 20 blocks tall, blocks 600 seconds apart, for a tx
+// in the block after it. Its median time past is block 14's time.
+func lockChain() *blockchain.BlockNode {
+	times := make([]uint32, 20)
+	for i := range times {
+		times[i] = 1_700_000_000 + uint32(i)*600
+	}
+	return chainOf(times...)
+}
+
+// LockTime is held against the parent's median time past rather than any
+// block's own timestamp.
+func TestAssertFinal(t *testing.T) {
+	parent := lockChain()
+	mtp := parent.MedianTimePast()
+	tests := []struct {
+		name     string
+		lockTime uint32
+		ok       bool
+	}{
+		{"height passed", 20 - 1, true},
+		{"at height", 20, false},
+		{"time passed", mtp - 1, true},
+		{"at median time", mtp, false},
+		{"before parent time", parent.Meta.TimeStamp - 1, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tx, _ := spendingTx(nil)
+			tx.LockTime = tc.lockTime
+			v := &TxValidator{tx: tx, parent: parent, height: parent.Height() + 1}
+			assertLockResult(t, v.assertFinal(), tc.ok, -1)
+		})
+	}
+}
+
+func TestAssertSequenceLocks(t *testing.T) {
+	parent := lockChain()
+	// the output is in block 10, so a time lock runs from block 9's median
+	// time past, block 5's time, to block 14's time: 5400 seconds
+	const utxoHeight = 10
+	timeLock := func(units uint32) uint32 { return transaction.SEQUENCE_LOCKTIME_TYPE_FLAG | units }
+	tests := []struct {
+		name string
+		seq  uint32
+		ok   bool
+	}{
+		{"no lock", transaction.SEQUENCE_LOCKTIME_DISABLE_FLAG | 100, true},
+		{"blocks met", 20 - utxoHeight, true},
+		{"blocks not met", 20 - utxoHeight + 1, false},
+		{"time met", timeLock(5400 >> transaction.SEQUENCE_LOCKTIME_GRANULARITY), true},
+		{"time not met", timeLock(5400>>transaction.SEQUENCE_LOCKTIME_GRANULARITY + 1), false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tx, utxo := spendingTx(nil)
+			utxo.Height = utxoHeight
+			tx.Inputs[0].Sequence = tc.seq
+			v := &TxValidator{tx: tx, utxos: oneUtxo{utxo}, parent: parent, height: parent.Height() + 1}
+			assertLockResult(t, v.assertSequenceLocks(), tc.ok, 0)
+		})
+	}
+}
+
+func assertLockResult(t *testing.T, err error, ok bool, input int) {
+	t.Helper()
+	if ok {
+		if err != nil {
+			t.Errorf("rejected: %v", err)
+		}
+		return
+	}
+	var rule RuleErr
+	if !errors.As(err, &rule) || rule.Code != REJECT_NON_FINAL || rule.Input != input {
+		t.Errorf("got %v, want %v on input %d", err, REJECT_NON_FINAL, input)
+	}
+}
@@ -0,0 +1,162 @@
+package wallet
+
+import (
+	"bytes"
+
+	"github.com/tiereum/trmnode/internal/client"
+	"github.com/tiereum/trmnode/internal/transaction"
+)
+
+type NOT_MULTISIG_ERR struct{}
+
+func (e NOT_MULTISIG_ERR) Error() string {
+	return "Output is not locked by a multisig script."
+}
+
+type NOT_A_SIGNER_ERR struct{}
+
+func (e NOT_A_SIGNER_ERR) Error() string {
+	return "Key is not one of the multisig keys."
+}
+
+type BAD_PARTIAL_SIG_ERR struct{}
+
+func (e BAD_PARTIAL_SIG_ERR) Error() string {
+	return "Signature does not sign this input with that key."
+}
+
+type WRONG_REDEEM_SCRIPT_ERR struct{}
+
+func (e WRONG_REDEEM_SCRIPT_ERR) Error() string {
+	return "Redeem script does not hash to the P2SH output's script hash."
+}
+
+type MISSING_SIGS_ERR struct{}
+
+func (e MISSING_SIGS_ERR) Error() string {
+	return "Not enough signatures to unlock the multisig output."
+}
+
+// MultisigSigner collects signatures for one input spending a multisig
+// output, bare or behind P2SH. Each key holder signs, here or elsewhere,
+// and once m have signed Finalize writes the unlocking script.
+type MultisigSigner struct {
+	tx      *transaction.Tx
+	inIdx   uint8
+	utxo    *transaction.Utxo // with the script signatures commit to
+	redeem  []byte            // nil unless the output is P2SH
+	flag    byte
+	m       int
+	pubKeys [][]byte
+	sigs    map[int][]byte
+}
+
+func NewMultisigSigner(
+	tx *transaction.Tx,
+	inIdx uint8,
+	utxo *transaction.Utxo,
+	sigHashFlag byte) (*MultisigSigner, error) {
+
+	m, pubKeys, ok := transaction.ParseMultisigLockScript(utxo.LockingScript)
+	if !ok {
+		return nil, NOT_MULTISIG_ERR{}
+	}
+	s := new(MultisigSigner)
+	s.tx = tx
+	s.inIdx = inIdx
+	s.utxo = utxo
+	s.flag = sigHashFlag
+	s.m = m
+	s.pubKeys = pubKeys
+	s.sigs = make(map[int][]byte)
+	return s, nil
+}
+
+// NewP2SHMultisigSigner is NewMultisigSigner for a P2SH output whose redeem
+// script is a multisig script. Signatures commit to the redeem script,
+// which Finalize reveals after them.
+func NewP2SHMultisigSigner(
+	tx *transaction.Tx,
+	inIdx uint8,
+	utxo *transaction.Utxo,
+	redeemScript []byte,
+	sigHashFlag byte) (*MultisigSigner, error) {
+
+	if !transaction.IsP2SHRedeem(utxo, redeemScript) {
+		return nil, WRONG_REDEEM_SCRIPT_ERR{}
+	}
+	redeemUtxo := *utxo
+	redeemUtxo.LockingScript = redeemScript
+	redeemUtxo.LockingScriptSize = transaction.NewCompactSize(int64(len(redeemScript)))
+	s, err := NewMultisigSigner(tx, inIdx, &redeemUtxo, sigHashFlag)
+	if err != nil {
+		return nil, err
+	}
+	s.redeem = redeemScript
+	return s, nil
+}
+
+func (s *MultisigSigner) keyIdx(pubKey []byte) int {
+	for i, pk := range s.pubKeys {
+		if bytes.Equal(pk, pubKey) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Sign adds id's signature. id must hold one of the script's keys.
+func (s *MultisigSigner) Sign(id *client.ClientId) error {
+	idx := s.keyIdx(client.MarshalPubKey(id.PublicKey))
+	if idx < 0 {
+		return NOT_A_SIGNER_ERR{}
+	}
+	preimage := s.tx.Preimage(s.inIdx, s.utxo, s.flag)
+	s.sigs[idx] = append(id.Sign(preimage), s.flag)
+	return nil
+}
+
+// AddSignature adds a signature made by another key holder, with its
+// sighash flag appended, after checking it.
+func (s *MultisigSigner) AddSignature(pubKey, sig []byte) error {
+	idx := s.keyIdx(pubKey)
+	if idx < 0 {
+		return NOT_A_SIGNER_ERR{}
+	}
+	key, err := client.ParsePubKey(pubKey)
+	if err != nil || len(sig) < 2 {
+		return BAD_PARTIAL_SIG_ERR{}
+	}
+	preimage := s.tx.Preimage(s.inIdx, s.utxo, sig[len(sig)-1])
+	if !client.Verify(preimage, sig[:len(sig)-1], key) {
+		return BAD_PARTIAL_SIG_ERR{}
+	}
+	s.sigs[idx] = sig
+	return nil
+}
+
+// Complete reports whether enough keys have signed.
+func (s *MultisigSigner) Complete() bool {
+	return len(s.sigs) >= s.m
+}
+
+// Finalize writes the unlocking script to the input, using the first m
+// signatures in key order as OP_CHECKMULTISIG expects.
+func (s *MultisigSigner) Finalize() error {
+	if !s.Complete() {
+		return MISSING_SIGS_ERR{}
+	}
+	sigs := make([][]byte, 0, s.m)
+	for i := range s.pubKeys {
+		if sig, ok := s.sigs[i]; ok && len(sigs) < s.m {
+			sigs = append(sigs, sig)
+		}
+	}
+	in := &s.tx.Inputs[s.inIdx]
+	in.UnlockingScript = transaction.MultisigUnlockScript(sigs)
+	if s.redeem != nil {
+		in.UnlockingScript = append(in.UnlockingScript, transaction.PushData(s.redeem)...)
+	}
+	in.UnlockingScriptSize = transaction.NewCompactSize(int64(len(in.UnlockingScript)))
+	return nil
+}
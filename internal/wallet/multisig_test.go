@@ -0,0 +1,142 @@
+package wallet
+
+import (
+	"testing"
+
+	"github.com/tiereum/trmnode/internal/client"
+	"github.com/tiereum/trmnode/internal/transaction"
+)
+
+// spendingTx returns a tx spending an output locked by lock, and that
+// output.
+func spendingTx(lock []byte) (*transaction.Tx, *transaction.Utxo) {
+	utxo := &transaction.Utxo{
+		OutPoint:          transaction.OutPoint{TxId: make([]byte, 32), Idx: 0},
+		Value:             50,
+		LockingScriptSize: transaction.NewCompactSize(int64(len(lock))),
+		LockingScript:     lock,
+	}
+	tx := &transaction.Tx{
+		Version:    1,
+		NumInputs:  1,
+		Inputs:     []transaction.TxIn{{PrevOutpt: utxo.OutPoint, UnlockingScriptSize: transaction.NewCompactSize(0)}},
+		NumOutputs: 1,
+		Outputs:    []transaction.TxOut{{Value: 40, LockingScriptSize: transaction.NewCompactSize(1), LockingScript: []byte{0x00}}},
+	}
+	return tx, utxo
+}
+
+func multisigLock(t *testing.T, m int, ids ...*client.ClientId) []byte {
+	t.Helper()
+	keys := [][]byte{}
+	for _, id := range ids {
+		keys = append(keys, client.MarshalPubKey(id.PublicKey))
+	}
+	lock, err := transaction.MultisigLockScript(m, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lock
+}
+
+func verifyInput(tx *transaction.Tx, utxo *transaction.Utxo) error {
+	ctx := &transaction.OpCtx{Tx: tx, TxIn: &tx.Inputs[0], InUtxo: utxo}
+	return transaction.NewInterpreter(ctx).Verify(tx.Inputs[0].UnlockingScript, utxo.LockingScript)
+}
+
+func TestMultisigSigner(t *testing.T) {
+	k1, k2, k3 := client.NewClientId(), client.NewClientId(), client.NewClientId()
+	tests := []struct {
+		name    string
+		m       int
+		keys    []*client.ClientId
+		signers []*client.ClientId // in the order they sign
+	}{
+		{"1 of 1", 1, []*client.ClientId{k1}, []*client.ClientId{k1}},
+		{"2 of 3", 2, []*client.ClientId{k1, k2, k3}, []*client.ClientId{k1, k3}},
+		// Finalize puts the signatures in key order
+		{"2 of 3 out of order", 2, []*client.ClientId{k1, k2, k3}, []*client.ClientId{k3, k2}},
+		{"2 of 3 all sign", 2, []*client.ClientId{k1, k2, k3}, []*client.ClientId{k3, k1, k2}},
+		{"3 of 3", 3, []*client.ClientId{k1, k2, k3}, []*client.ClientId{k2, k3, k1}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tx, utxo := spendingTx(multisigLock(t, tc.m, tc.keys...))
+			signer, err := NewMultisigSigner(tx, 0, utxo, byte(transaction.SIGHASH_ALL))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, id := range tc.signers {
+				if err := signer.Sign(id); err != nil {
+					t.Fatal(err)
+				}
+				if want := i+1 >= tc.m; signer.Complete() != want {
+					t.Errorf("complete after %d signatures is %v, want %v", i+1, !want, want)
+				}
+			}
+			if err := signer.Finalize(); err != nil {
+				t.Fatal(err)
+			}
+			if err := verifyInput(tx, utxo); err != nil {
+				t.Errorf("finalized input does not verify: %v", err)
+			}
+		})
+	}
+}
+
+// A signature made by a key holder elsewhere is checked before it is
+// added.
+func TestMultisigSignerAddSignature(t *testing.T) {
+	k1, k2, outsider := client.NewClientId(), client.NewClientId(), client.NewClientId()
+	tx, utxo := spendingTx(multisigLock(t, 2, k1, k2))
+	flag := byte(transaction.SIGHASH_ALL)
+	// sign makes id's signature over flag and marks it with mark
+	sign := func(id *client.ClientId, flag, mark byte) []byte {
+		return append(id.Sign(tx.Preimage(0, utxo, flag)), mark)
+	}
+	k1Key, k2Key := client.MarshalPubKey(k1.PublicKey), client.MarshalPubKey(k2.PublicKey)
+
+	signer, err := NewMultisigSigner(tx, 0, utxo, flag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		key, sig []byte
+		err      error
+	}{
+		{"key not in script", client.MarshalPubKey(outsider.PublicKey), sign(outsider, flag, flag), NOT_A_SIGNER_ERR{}},
+		{"signed by another key", k1Key, sign(k2, flag, flag), BAD_PARTIAL_SIG_ERR{}},
+		{"flag swapped", k1Key, sign(k1, flag, byte(transaction.SIGHASH_NONE)), BAD_PARTIAL_SIG_ERR{}},
+		{"too short", k1Key, []byte{flag}, BAD_PARTIAL_SIG_ERR{}},
+		{"valid", k2Key, sign(k2, flag, flag), nil},
+	}
+	for _, tc := range tests {
+		if err := signer.AddSignature(tc.key, tc.sig); err != tc.err {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.err)
+		}
+	}
+
+	if err := signer.Finalize(); err != (MISSING_SIGS_ERR{}) {
+		t.Errorf("finalize with 1 of 2: got %v, want %v", err, MISSING_SIGS_ERR{})
+	}
+	if err := signer.Sign(outsider); err != (NOT_A_SIGNER_ERR{}) {
+		t.Errorf("sign with outsider: got %v, want %v", err, NOT_A_SIGNER_ERR{})
+	}
+	if err := signer.Sign(k1); err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyInput(tx, utxo); err != nil {
+		t.Errorf("finalized input does not verify: %v", err)
+	}
+}
+
+func TestMultisigSignerRejectsOtherScripts(t *testing.T) {
+	tx, utxo := spendingTx([]byte{byte(transaction.OP_1)})
+	if _, err := NewMultisigSigner(tx, 0, utxo, byte(transaction.SIGHASH_ALL)); err != (NOT_MULTISIG_ERR{}) {
+		t.Errorf("got %v, want %v", err, NOT_MULTISIG_ERR{})
+	}
+}
@@ -3,36 +3,61 @@ package wallet
 import (
 	"bytes"
 	"encoding/hex"
+	"os"
+	"path"
 	"sync"
 
 	"github.com/tiereum/trmnode/internal/client"
-	"github.com/tiereum/trmnode/internal/server"
+	"github.com/tiereum/trmnode/internal/rpc"
 	"github.com/tiereum/trmnode/internal/t_config"
 	"github.com/tiereum/trmnode/internal/t_error"
-	"github.com/tiereum/trmnode/internal/t_util"
 	"github.com/tiereum/trmnode/internal/transaction"
-	"github.com/tiereum/trmnode/internal/utxoSet"
 )
 
 type WalletController struct {
 	wallet *Wallet
 	ctx    *t_config.Context
-	server *server.Server
+	rpc    *rpc.Client
 }
 
 func NewWalletController(wallet *Wallet, ctx *t_config.Context) *WalletController {
 	w := new(WalletController)
 	w.wallet = wallet
 	w.ctx = ctx
-	w.server = server.NewServer(ctx)
+	w.rpc = rpc.NewClient(ctx)
 	return w
 }
 
+// Unspent asks the running node for the wallet's confirmed outputs that
+// can be spent now, leaving out immature coinbase outputs.
+func (w *WalletController) Unspent() []transaction.Utxo {
+	var unspent []rpc.UnspentResult
+	t_error.LogErr(w.rpc.Call("listunspent", &unspent, w.wallet.ClientId.Address))
+
+	utxos := make([]transaction.Utxo, 0, len(unspent))
+	for _, u := range unspent {
+		if !u.Spendable {
+			continue
+		}
+		txid, err := hex.DecodeString(u.TxId)
+		t_error.LogErr(err)
+		script, err := hex.DecodeString(u.ScriptPubKey)
+		t_error.LogErr(err)
+		utxos = append(utxos, transaction.Utxo{
+			OutPoint:          transaction.OutPoint{TxId: txid, Idx: u.Vout},
+			Value:             u.Value,
+			LockingScriptSize: transaction.NewCompactSize(int64(len(script))),
+			LockingScript:     script,
+			Height:            u.Height,
+			Coinbase:          u.Coinbase,
+		})
+	}
+	return utxos
+}
+
 func (w *WalletController) GetOutPointsUntil(sum int64) []transaction.OutPoint {
 
-	store := utxoSet.NewUtxoStore(w.ctx)
-	defer store.Close()
-	utxos := store.FindUTXOsByAddr(w.wallet.ClientId.Address)
+	utxos := w.Unspent()
 	r := []transaction.OutPoint{}
 
 	var currSum int64 = 0
@@ -66,19 +91,28 @@ func (w *WalletController) GenP2PKH(
 	inputs := make([]transaction.TxIn, nIn)
 	outputs := make([]transaction.TxOut, nOut)
 	utxos := make([]*transaction.Utxo, nIn)
-	store := utxoSet.NewUtxoStore(w.ctx)
-	defer store.Close()
+	unspent := w.Unspent()
+
+	// LockTime is ignored if every input is final
+	sequence := transaction.SEQUENCE_FINAL
+	if locktime != 0 {
+		sequence--
+	}
 
 	for i, outPoint := range utxoOutPoints {
-		u, ok := store.Read(&outPoint)
-		if !ok {
+		for j := range unspent {
+			if bytes.Equal(unspent[j].OutPoint.TxId, outPoint.TxId) && unspent[j].OutPoint.Idx == outPoint.Idx {
+				utxos[i] = &unspent[j]
+			}
+		}
+		if utxos[i] == nil {
 			panic("Utxo doesnt exist.")
 		}
-		utxos[i] = u
 		inputs[i] = transaction.TxIn{
 			PrevOutpt:           outPoint,
 			UnlockingScriptSize: transaction.NewCompactSize(0),
 			UnlockingScript:     []byte{0x00},
+			Sequence:            sequence,
 		}
 	}
 	wg := sync.WaitGroup{}
@@ -87,19 +121,12 @@ func (w *WalletController) GenP2PKH(
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
-			lockingScript := []byte{
-				byte(transaction.OP_DUP),       // 1
-				byte(transaction.OP_HASH160),   // 1
-				byte(transaction.OP_PUSHDATA1), // 1
-				byte(0x14),
-			}
-			lockingScript = append(lockingScript, []byte(recipientAddrs[i])[1:21]...)
-			lockingScript = append(lockingScript, byte(transaction.OP_EQUALVERIFY),
-				byte(transaction.OP_CHECKSIG))
+			lockingScript, err := transaction.LockScriptForAddress(recipientAddrs[i])
+			t_error.LogErr(err)
 
 			outputs[i] = transaction.TxOut{
 				Value:             recipientVal[i],
-				LockingScriptSize: transaction.NewCompactSize(transaction.P2PKH_LOCK_SCRIPT_SZ),
+				LockingScriptSize: transaction.NewCompactSize(int64(len(lockingScript))),
 				LockingScript:     lockingScript,
 			}
 
@@ -127,12 +154,13 @@ func (w *WalletController) SignTxIn(
 	inUTXO *transaction.Utxo,
 	sigHashFlag byte) {
 
-	sig := w.wallet.ClientId.Sign(tx.Preimage(inIdx, inUTXO, sigHashFlag))
+	// the flag goes after the signature so OP_CHECKSIG can rebuild the preimage
+	sig := append(w.wallet.ClientId.Sign(tx.Preimage(inIdx, inUTXO, sigHashFlag)), sigHashFlag)
 	pk := client.MarshalPubKey(w.wallet.ClientId.PublicKey)
 	nPk := len(pk)
 	tx.Inputs[inIdx].UnlockingScript = []byte{
 		byte(transaction.OP_PUSHDATA1),
-		byte(0x20),
+		byte(len(sig)),
 	}
 	tx.Inputs[inIdx].UnlockingScript = append(tx.Inputs[inIdx].UnlockingScript, sig...)
 	tx.Inputs[inIdx].UnlockingScript = append(tx.Inputs[inIdx].UnlockingScript, byte(transaction.OP_PUSHDATA1),
@@ -149,33 +177,41 @@ func (w *WalletController) SignTx(
 
 	for i := range inUTXO {
 		if sigHashFlags != nil {
-			w.SignTxIn(tx, uint8(len(inUTXO)), inUTXO[i], sigHashFlags[i])
+			w.SignTxIn(tx, uint8(i), inUTXO[i], sigHashFlags[i])
 		} else {
-			w.SignTxIn(tx, uint8(len(inUTXO)), inUTXO[i], byte(transaction.SIGHASH_ALL))
+			w.SignTxIn(tx, uint8(i), inUTXO[i], byte(transaction.SIGHASH_ALL))
 		}
 	}
 }
 
 func (w *WalletController) Balance() int64 {
-	var sum int64 = 0
-	store := utxoSet.NewUtxoStore(w.ctx)
-	defer store.Close()
-	utxos := store.FindUTXOsByAddr(hex.EncodeToString(w.wallet.ClientId.PubKeyHash))
-	for _, utxo := range utxos {
-		sum += utxo.Value
-	}
-	return sum
+	balance := new(rpc.BalanceResult)
+	t_error.LogErr(w.rpc.Call("getbalance", balance, w.wallet.ClientId.Address))
+	return balance.Balance
 }
 
-func (w *WalletController) BroadcastTx(tx *transaction.Tx) {
-	w.server.Tx().InStream <- tx
+// BroadcastTx hands tx to the running node, which validates it, adds it to
+// its mempool and relays it to peers.
+func (w *WalletController) BroadcastTx(tx *transaction.Tx) error {
+	return w.rpc.Call("sendrawtransaction", nil, hex.EncodeToString(tx.Serialize()))
 }
 
+// ValidateAddress reports whether hexxAddr is a well formed key address.
 func ValidateAddress(hexxAddr string) bool {
-	if len(hexxAddr) != 50 {
-		return false
-	}
-	addrbytes, err := hex.DecodeString(hexxAddr)
+	_, err := client.AddressPubKeyHash(hexxAddr)
+	return err == nil
+}
+
+// WriteTmpTx saves tx under .tmp/txs by its txid, where --sendTx picks it up.
+func (w *WalletController) WriteTmpTx(tx *transaction.Tx) {
+	p := path.Join(w.ctx.TmpDir, "txs", hex.EncodeToString(tx.Hash()))
+	t_error.LogErr(os.WriteFile(p, tx.Serialize(), 0600))
+}
+
+func (w *WalletController) ReadTmpTx(txid string) *transaction.Tx {
+	b, err := os.ReadFile(path.Join(w.ctx.TmpDir, "txs", txid))
 	t_error.LogErr(err)
-	return bytes.Equal(t_util.Hash256(addrbytes[:len(addrbytes)-4])[:4], addrbytes[len(addrbytes)-4:])
+	dec := transaction.NewTxDecoder(nil)
+	t_error.LogErr(dec.Decode(bytes.NewBuffer(b)))
+	return dec.Out()
 }